@@ -0,0 +1,277 @@
+// Command kafka-replay republish a range of a kafka topic to another topic,
+// possibly on another cluster, e.g. to re-drive a dead letter topic:
+//
+//	kafka-replay -brokers localhost:9092 -topic orders.dlq -target-topic orders \
+//		-from-time 2024-05-01T10:00:00Z -to-time 2024-05-01T11:00:00Z \
+//		-header x-error-type=timeout -rate 50 -dry-run
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/lukmanlukmin/go-lib/kafka"
+	"github.com/lukmanlukmin/go-lib/kafka/replay"
+	"gopkg.in/yaml.v2"
+)
+
+// pairs repeatable name=value flag
+type pairs map[string]string
+
+func (p pairs) String() string {
+	parts := make([]string, 0, len(p))
+	for k, v := range p {
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (p pairs) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expect name=value, got %q", s)
+	}
+	p[k] = v
+	return nil
+}
+
+// names repeatable flag
+type names []string
+
+func (n *names) String() string {
+	return strings.Join(*n, ",")
+}
+
+func (n *names) Set(s string) error {
+	*n = append(*n, s)
+	return nil
+}
+
+type flags struct {
+	brokers       string
+	config        string
+	targetBrokers string
+	targetConfig  string
+
+	topic       string
+	targetTopic string
+	partitions  string
+	fromOffset  int64
+	last        int64
+	fromTime    string
+	toOffset    int64
+	toTime      string
+	follow      bool
+
+	key        string
+	headers    pairs
+	setHeaders pairs
+	dropHeader names
+
+	rate   float64
+	dryRun bool
+}
+
+func main() {
+	f := flags{headers: pairs{}, setHeaders: pairs{}}
+	flag.StringVar(&f.brokers, "brokers", "", "source brokers, comma separated")
+	flag.StringVar(&f.config, "config", "", "source kafka.Config YAML file, for SASL or TLS settings")
+	flag.StringVar(&f.targetBrokers, "target-brokers", "", "target brokers, comma separated (defaults to the source)")
+	flag.StringVar(&f.targetConfig, "target-config", "", "target kafka.Config YAML file (defaults to the source)")
+	flag.StringVar(&f.topic, "topic", "", "source topic")
+	flag.StringVar(&f.targetTopic, "target-topic", "", "target topic (defaults to -topic)")
+	flag.StringVar(&f.partitions, "partitions", "", "source partitions, comma separated (defaults to all)")
+	flag.Int64Var(&f.fromOffset, "from-offset", sarama.OffsetOldest, "first offset, -2 for the oldest message")
+	flag.Int64Var(&f.last, "last", 0, "start this many messages before the end of each partition")
+	flag.StringVar(&f.fromTime, "from-time", "", "start at messages produced from this RFC3339 time")
+	flag.Int64Var(&f.toOffset, "to-offset", 0, "stop before this offset of the single -partitions partition (defaults to the end of each partition)")
+	flag.StringVar(&f.toTime, "to-time", "", "stop at messages produced after this RFC3339 time")
+	flag.BoolVar(&f.follow, "follow", false, "keep mirroring new messages until interrupted")
+	flag.StringVar(&f.key, "key", "", "replay messages with this key only")
+	flag.Var(f.headers, "header", "replay messages with this name=value header only, repeatable")
+	flag.Var(f.setHeaders, "set-header", "set name=value header on republished messages, repeatable")
+	flag.Var(&f.dropHeader, "drop-header", "remove header from republished messages, repeatable")
+	flag.Float64Var(&f.rate, "rate", 0, "maximum messages published per second (defaults to unlimited)")
+	flag.BoolVar(&f.dryRun, "dry-run", false, "log messages instead of publishing them")
+	flag.Parse()
+
+	if err := run(f); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(f flags) error {
+	if f.topic == "" {
+		return errors.New("-topic is required")
+	}
+
+	srcCfg, err := loadConfig(f.config, f.brokers)
+	if err != nil {
+		return err
+	}
+	dstCfg := srcCfg
+	if f.targetConfig != "" || f.targetBrokers != "" {
+		if dstCfg, err = loadConfig(f.targetConfig, f.targetBrokers); err != nil {
+			return err
+		}
+	}
+
+	opts, err := options(f)
+	if err != nil {
+		return err
+	}
+
+	if len(opts.Partitions) == 0 {
+		if opts.Partitions, err = topicPartitions(srcCfg, f.topic); err != nil {
+			return err
+		}
+	}
+
+	src, err := kafka.NewPartitionConsumer(srcCfg)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := kafka.NewProducer(dstCfg)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	stats, err := replay.Run(ctx, src, dst, opts)
+	fmt.Fprintf(os.Stderr, "read %d, skipped %d, published %d\n", stats.Read, stats.Skipped, stats.Published)
+	return err
+}
+
+// loadConfig read kafka.Config from the YAML file path, brokers override
+// the file brokers
+func loadConfig(path, brokers string) (*kafka.Config, error) {
+	cfg := &kafka.Config{}
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(b, cfg); err != nil {
+			return nil, fmt.Errorf("parse %s got: %w", path, err)
+		}
+	}
+	if brokers != "" {
+		cfg.Brokers = strings.Split(brokers, ",")
+	}
+	if len(cfg.Brokers) == 0 {
+		return nil, errors.New("-brokers or -config is required")
+	}
+	return cfg, nil
+}
+
+// options return replay options from the command flags
+func options(f flags) (replay.Options, error) {
+	opts := replay.Options{
+		Topic:         f.topic,
+		TargetTopic:   f.targetTopic,
+		StopOffset:    f.toOffset,
+		Follow:        f.follow,
+		RatePerSecond: f.rate,
+		DryRun:        f.dryRun,
+		Start:         kafka.FromOffset(f.fromOffset),
+	}
+
+	if f.partitions != "" {
+		for _, p := range strings.Split(f.partitions, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(p), 10, 32)
+			if err != nil {
+				return opts, fmt.Errorf("-partitions: %w", err)
+			}
+			opts.Partitions = append(opts.Partitions, int32(id))
+		}
+	}
+
+	switch {
+	case f.fromTime != "":
+		t, err := time.Parse(time.RFC3339, f.fromTime)
+		if err != nil {
+			return opts, fmt.Errorf("-from-time: %w", err)
+		}
+		opts.Start = kafka.FromTime(t)
+	case f.last > 0:
+		opts.Start = kafka.FromLast(f.last)
+	}
+
+	if f.toTime != "" {
+		t, err := time.Parse(time.RFC3339, f.toTime)
+		if err != nil {
+			return opts, fmt.Errorf("-to-time: %w", err)
+		}
+		opts.Until = t
+	}
+
+	var filters []replay.Filter
+	if f.key != "" {
+		filters = append(filters, replay.Key(f.key))
+	}
+	for k, v := range f.headers {
+		filters = append(filters, replay.Header(k, v))
+	}
+	if len(filters) > 0 {
+		opts.Filter = replay.All(filters...)
+	}
+
+	if len(f.setHeaders) > 0 || len(f.dropHeader) > 0 {
+		target := f.targetTopic
+		if target == "" {
+			target = f.topic
+		}
+		opts.Transform = func(msg *kafka.MessageDecoder) (*kafka.MessageContext, error) {
+			out := replay.Copy(msg, target)
+			for _, name := range f.dropHeader {
+				delete(out.Headers, name)
+			}
+			for k, v := range f.setHeaders {
+				out.Headers[k] = v
+			}
+			return out, nil
+		}
+	}
+
+	return opts, nil
+}
+
+// topicPartitions return every partition of topic
+func topicPartitions(cfg *kafka.Config, topic string) ([]int32, error) {
+	admin, err := kafka.NewAdmin(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer admin.Close()
+
+	topics, err := admin.DescribeTopics(topic)
+	if err != nil {
+		return nil, err
+	}
+	if len(topics) == 0 || len(topics[0].Partitions) == 0 {
+		return nil, fmt.Errorf("topic %s not found", topic)
+	}
+
+	partitions := make([]int32, 0, len(topics[0].Partitions))
+	for _, p := range topics[0].Partitions {
+		partitions = append(partitions, p.ID)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+	return partitions, nil
+}
@@ -0,0 +1,434 @@
+// Package kafka messaging broker
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+const (
+	// OffsetEarliest reset to the oldest offset still available
+	OffsetEarliest = sarama.OffsetOldest
+	// OffsetLatest reset to the offset of the next produced message
+	OffsetLatest = sarama.OffsetNewest
+)
+
+var (
+	// ErrGroupActive returned when resetting offsets of a group with members
+	ErrGroupActive = errors.New("[kafka-admin] consumer group has active members")
+	// ErrResetOffset returned when resetting offsets to neither OffsetEarliest
+	// nor OffsetLatest, see ResetOffsetsToTime for resets to a time
+	ErrResetOffset = errors.New("[kafka-admin] reset offset must be OffsetEarliest or OffsetLatest")
+)
+
+// TopicDescription partitions and non default configs of a topic
+type TopicDescription struct {
+	Name       string
+	Internal   bool
+	Partitions []PartitionDescription
+	Configs    map[string]string
+}
+
+// PartitionDescription leader and replicas of a partition
+type PartitionDescription struct {
+	ID       int32
+	Leader   int32
+	Replicas []int32
+	Isr      []int32
+}
+
+// GroupDescription consumer group state with the lag of its committed partitions
+type GroupDescription struct {
+	GroupID    string
+	State      string
+	Members    int
+	Lag        int64
+	Partitions []PartitionLag
+}
+
+// PartitionLag committed offset of a group against the partition high water mark
+type PartitionLag struct {
+	Topic         string
+	Partition     int32
+	Committed     int64
+	HighWaterMark int64
+	Lag           int64
+}
+
+type admin struct {
+	client sarama.Client
+	admin  sarama.ClusterAdmin
+}
+
+// NewAdmin return admin client connecting with the brokers, version, SASL
+// and TLS settings of cfg
+func NewAdmin(cfg *Config) (Admin, error) {
+	config, err := newClientConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sarama.NewClient(cfg.Brokers, config)
+	if err != nil {
+		return nil, &ConnectionError{Brokers: cfg.Brokers, Attempts: 1, Err: err}
+	}
+
+	ca, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("[kafka-admin] connect got: %w", err)
+	}
+
+	return &admin{client: client, admin: ca}, nil
+}
+
+// CreateTopic create topic, replication factor defaults to the broker setting when 0
+func (a *admin) CreateTopic(topic TopicConfig) error {
+	if err := a.admin.CreateTopic(topic.Name, topicDetail(topic), false); err != nil {
+		return fmt.Errorf("[kafka-admin] create topic %s got: %w", topic.Name, err)
+	}
+	return nil
+}
+
+// DeleteTopic delete topic
+func (a *admin) DeleteTopic(topic string) error {
+	if err := a.admin.DeleteTopic(topic); err != nil {
+		return fmt.Errorf("[kafka-admin] delete topic %s got: %w", topic, err)
+	}
+	return nil
+}
+
+// DescribeTopics return partitions and configs of topics, every topic of the cluster when none given
+func (a *admin) DescribeTopics(topics ...string) ([]TopicDescription, error) {
+	if len(topics) == 0 {
+		all, err := a.admin.ListTopics()
+		if err != nil {
+			return nil, fmt.Errorf("[kafka-admin] list topics got: %w", err)
+		}
+		for name := range all {
+			topics = append(topics, name)
+		}
+		sort.Strings(topics)
+	}
+
+	metas, err := a.admin.DescribeTopics(topics)
+	if err != nil {
+		return nil, fmt.Errorf("[kafka-admin] describe topics %v got: %w", topics, err)
+	}
+
+	out := make([]TopicDescription, 0, len(metas))
+	for _, m := range metas {
+		if m.Err != sarama.ErrNoError {
+			return nil, fmt.Errorf("[kafka-admin] describe topic %s got: %w", m.Name, m.Err)
+		}
+
+		configs, err := a.topicConfigs(m.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		d := TopicDescription{
+			Name:       m.Name,
+			Internal:   m.IsInternal,
+			Partitions: make([]PartitionDescription, 0, len(m.Partitions)),
+			Configs:    configs,
+		}
+		for _, p := range m.Partitions {
+			d.Partitions = append(d.Partitions, PartitionDescription{
+				ID:       p.ID,
+				Leader:   p.Leader,
+				Replicas: p.Replicas,
+				Isr:      p.Isr,
+			})
+		}
+		sort.Slice(d.Partitions, func(i, j int) bool { return d.Partitions[i].ID < d.Partitions[j].ID })
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// topicConfigs return configs set on the topic, broker defaults are left out
+func (a *admin) topicConfigs(topic string) (map[string]string, error) {
+	entries, err := a.admin.DescribeConfig(sarama.ConfigResource{Type: sarama.TopicResource, Name: topic})
+	if err != nil {
+		return nil, fmt.Errorf("[kafka-admin] describe topic %s config got: %w", topic, err)
+	}
+
+	configs := map[string]string{}
+	for _, e := range entries {
+		if e.Source == sarama.SourceTopic {
+			configs[e.Name] = e.Value
+		}
+	}
+	return configs, nil
+}
+
+// AddPartitions grow topic to count partitions, partitions can't be removed
+func (a *admin) AddPartitions(topic string, count int32) error {
+	if err := a.admin.CreatePartitions(topic, count, nil, false); err != nil {
+		return fmt.Errorf("[kafka-admin] add partitions to %s got: %w", topic, err)
+	}
+	return nil
+}
+
+// AlterTopicConfig set configs of topic, other configs set on the topic are kept
+func (a *admin) AlterTopicConfig(topic string, configs map[string]string) error {
+	current, err := a.topicConfigs(topic)
+	if err != nil {
+		return err
+	}
+
+	// AlterConfigs replace every config of the resource
+	entries := make(map[string]*string, len(current)+len(configs))
+	for k, v := range current {
+		v := v
+		entries[k] = &v
+	}
+	for k, v := range configs {
+		v := v
+		entries[k] = &v
+	}
+
+	if err := a.admin.AlterConfig(sarama.TopicResource, topic, entries, false); err != nil {
+		return fmt.Errorf("[kafka-admin] alter topic %s config got: %w", topic, err)
+	}
+	return nil
+}
+
+// EnsureTopics create missing topics and add partitions to topics having
+// less than configured, existing configs are left untouched
+func (a *admin) EnsureTopics(topics ...TopicConfig) error {
+	existing, err := a.admin.ListTopics()
+	if err != nil {
+		return fmt.Errorf("[kafka-admin] list topics got: %w", err)
+	}
+
+	for _, t := range topics {
+		detail, ok := existing[t.Name]
+		if !ok {
+			err := a.admin.CreateTopic(t.Name, topicDetail(t), false)
+			if err != nil && !errors.Is(err, sarama.ErrTopicAlreadyExists) {
+				return fmt.Errorf("[kafka-admin] create topic %s got: %w", t.Name, err)
+			}
+			continue
+		}
+
+		if t.Partitions > detail.NumPartitions {
+			if err := a.AddPartitions(t.Name, t.Partitions); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ListGroups return every consumer group with its lag
+func (a *admin) ListGroups() ([]GroupDescription, error) {
+	groups, err := a.admin.ListConsumerGroups()
+	if err != nil {
+		return nil, fmt.Errorf("[kafka-admin] list consumer groups got: %w", err)
+	}
+
+	ids := make([]string, 0, len(groups))
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return a.DescribeGroups(ids...)
+}
+
+// DescribeGroups return state and lag of groups
+func (a *admin) DescribeGroups(groupIDs ...string) ([]GroupDescription, error) {
+	if len(groupIDs) == 0 {
+		return nil, nil
+	}
+
+	descs, err := a.admin.DescribeConsumerGroups(groupIDs)
+	if err != nil {
+		return nil, fmt.Errorf("[kafka-admin] describe consumer groups got: %w", err)
+	}
+
+	out := make([]GroupDescription, 0, len(descs))
+	for _, d := range descs {
+		lags, err := a.groupLag(d.GroupId)
+		if err != nil {
+			return nil, err
+		}
+
+		g := GroupDescription{
+			GroupID:    d.GroupId,
+			State:      d.State,
+			Members:    len(d.Members),
+			Partitions: lags,
+		}
+		for _, l := range lags {
+			g.Lag += l.Lag
+		}
+		out = append(out, g)
+	}
+	return out, nil
+}
+
+// groupLag return lag of every partition groupID committed an offset for
+func (a *admin) groupLag(groupID string) ([]PartitionLag, error) {
+	offsets, err := a.admin.ListConsumerGroupOffsets(groupID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("[kafka-admin] list group %s offsets got: %w", groupID, err)
+	}
+
+	var lags []PartitionLag
+	for topic, partitions := range offsets.Blocks {
+		for partition, block := range partitions {
+			if block.Err != sarama.ErrNoError || block.Offset < 0 {
+				continue
+			}
+
+			hwm, err := a.client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				return nil, fmt.Errorf("[kafka-admin] get %s/%d high water mark got: %w", topic, partition, err)
+			}
+
+			lag := hwm - block.Offset
+			if lag < 0 {
+				lag = 0
+			}
+			lags = append(lags, PartitionLag{
+				Topic:         topic,
+				Partition:     partition,
+				Committed:     block.Offset,
+				HighWaterMark: hwm,
+				Lag:           lag,
+			})
+		}
+	}
+
+	sort.Slice(lags, func(i, j int) bool {
+		if lags[i].Topic != lags[j].Topic {
+			return lags[i].Topic < lags[j].Topic
+		}
+		return lags[i].Partition < lags[j].Partition
+	})
+	return lags, nil
+}
+
+// ResetOffsets commit offset for every partition of topic in groupID,
+// offset is OffsetEarliest or OffsetLatest, moving them forward or
+// backward, any other offset return ErrResetOffset. The group must have no
+// member.
+func (a *admin) ResetOffsets(groupID, topic string, offset int64) error {
+	if offset != OffsetEarliest && offset != OffsetLatest {
+		return fmt.Errorf("%w: got %d", ErrResetOffset, offset)
+	}
+	return a.resetOffsets(groupID, topic, func(partition int32) (int64, error) {
+		return a.client.GetOffset(topic, partition, offset)
+	})
+}
+
+// ResetOffsetsToTime commit for every partition of topic in groupID the
+// first offset whose timestamp is at or after t, partitions without such
+// message are reset to the latest offset. The group must have no member.
+func (a *admin) ResetOffsetsToTime(groupID, topic string, t time.Time) error {
+	return a.resetOffsets(groupID, topic, func(partition int32) (int64, error) {
+		offset, err := a.client.GetOffset(topic, partition, t.UnixMilli())
+		if err == nil && offset < 0 {
+			return a.client.GetOffset(topic, partition, sarama.OffsetNewest)
+		}
+		return offset, err
+	})
+}
+
+func (a *admin) resetOffsets(groupID, topic string, target func(partition int32) (int64, error)) error {
+	descs, err := a.admin.DescribeConsumerGroups([]string{groupID})
+	if err != nil {
+		return fmt.Errorf("[kafka-admin] describe consumer group %s got: %w", groupID, err)
+	}
+	for _, d := range descs {
+		if len(d.Members) > 0 {
+			return fmt.Errorf("%w: %s is %s", ErrGroupActive, groupID, d.State)
+		}
+	}
+
+	partitions, err := a.client.Partitions(topic)
+	if err != nil {
+		return fmt.Errorf("[kafka-admin] get %s partitions got: %w", topic, err)
+	}
+
+	// committed directly rather than through an offset manager, which
+	// only move offsets backwards on reset
+	req := &sarama.OffsetCommitRequest{
+		Version:                 2,
+		ConsumerGroup:           groupID,
+		ConsumerGroupGeneration: sarama.GroupGenerationUndefined,
+		RetentionTime:           -1,
+	}
+	for _, partition := range partitions {
+		offset, err := target(partition)
+		if err != nil {
+			return fmt.Errorf("[kafka-admin] get %s/%d target offset got: %w", topic, partition, err)
+		}
+		req.AddBlock(topic, partition, offset, 0, "")
+	}
+
+	coordinator, err := a.client.Coordinator(groupID)
+	if err != nil {
+		return fmt.Errorf("[kafka-admin] reset group %s offsets got: %w", groupID, err)
+	}
+	resp, err := coordinator.CommitOffset(req)
+	if err != nil {
+		return fmt.Errorf("[kafka-admin] reset group %s offsets got: %w", groupID, err)
+	}
+	for _, partition := range partitions {
+		if kerr := resp.Errors[topic][partition]; kerr != sarama.ErrNoError {
+			return fmt.Errorf("[kafka-admin] reset group %s offset %s/%d got: %w", groupID, topic, partition, kerr)
+		}
+	}
+	return nil
+}
+
+// Close close the admin connections
+func (a *admin) Close() error {
+	return a.admin.Close()
+}
+
+func topicDetail(t TopicConfig) *sarama.TopicDetail {
+	detail := &sarama.TopicDetail{
+		NumPartitions:     t.Partitions,
+		ReplicationFactor: t.ReplicationFactor,
+	}
+	if detail.NumPartitions < 1 {
+		detail.NumPartitions = 1
+	}
+	if detail.ReplicationFactor < 1 {
+		detail.ReplicationFactor = -1
+	}
+	if len(t.Configs) > 0 {
+		detail.ConfigEntries = make(map[string]*string, len(t.Configs))
+		for k, v := range t.Configs {
+			v := v
+			detail.ConfigEntries[k] = &v
+		}
+	}
+	return detail
+}
+
+// ensureTopics run EnsureTopics of cfg.Topics when cfg.EnsureTopics is set
+func ensureTopics(cfg *Config) error {
+	if !cfg.EnsureTopics || len(cfg.Topics) == 0 {
+		return nil
+	}
+
+	a, err := NewAdmin(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = a.Close()
+	}()
+
+	return a.EnsureTopics(cfg.Topics...)
+}
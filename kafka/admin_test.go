@@ -0,0 +1,129 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func newMockAdmin(t *testing.T, handlers map[string]sarama.MockResponse) (*sarama.MockBroker, Admin) {
+	broker := sarama.NewMockBroker(t, 1)
+	t.Cleanup(broker.Close)
+
+	handlers["MetadataRequest"] = sarama.NewMockMetadataResponse(t).
+		SetController(broker.BrokerID()).
+		SetBroker(broker.Addr(), broker.BrokerID()).
+		SetLeader("orders", 0, broker.BrokerID()).
+		SetLeader("orders", 1, broker.BrokerID())
+	handlers["FindCoordinatorRequest"] = sarama.NewMockFindCoordinatorResponse(t).
+		SetCoordinator(sarama.CoordinatorGroup, "billing", broker)
+	broker.SetHandlerByMap(handlers)
+
+	a, err := NewAdmin(&Config{Brokers: []string{broker.Addr()}})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { _ = a.Close() })
+	return broker, a
+}
+
+func TestAdminEnsureTopics(t *testing.T) {
+	broker, a := newMockAdmin(t, map[string]sarama.MockResponse{
+		"DescribeConfigsRequest":  sarama.NewMockDescribeConfigsResponse(t),
+		"CreateTopicsRequest":     sarama.NewMockCreateTopicsResponse(t),
+		"CreatePartitionsRequest": sarama.NewMockCreatePartitionsResponse(t),
+	})
+
+	assert.Nil(t, a.EnsureTopics(
+		TopicConfig{Name: "orders", Partitions: 4},
+		TopicConfig{Name: "payments", Partitions: 3, Configs: map[string]string{"retention.ms": "60000"}},
+	))
+
+	var created []string
+	var expanded map[string]*sarama.TopicPartition
+	for _, rr := range broker.History() {
+		switch req := rr.Request.(type) {
+		case *sarama.CreateTopicsRequest:
+			for name, detail := range req.TopicDetails {
+				created = append(created, name)
+				assert.Equal(t, int32(3), detail.NumPartitions)
+				assert.Equal(t, "60000", *detail.ConfigEntries["retention.ms"])
+			}
+		case *sarama.CreatePartitionsRequest:
+			expanded = req.TopicPartitions
+		}
+	}
+	assert.Equal(t, []string{"payments"}, created)
+	assert.Equal(t, int32(4), expanded["orders"].Count)
+}
+
+func TestAdminDescribeGroupsLag(t *testing.T) {
+	_, a := newMockAdmin(t, map[string]sarama.MockResponse{
+		"DescribeGroupsRequest": sarama.NewMockDescribeGroupsResponse(t).
+			AddGroupDescription("billing", &sarama.GroupDescription{GroupId: "billing", State: "Empty"}),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("billing", "orders", 0, 7, "", sarama.ErrNoError).
+			SetOffset("billing", "orders", 1, 10, "", sarama.ErrNoError),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("orders", 0, sarama.OffsetNewest, 10).
+			SetOffset("orders", 1, sarama.OffsetNewest, 10),
+	})
+
+	groups, err := a.DescribeGroups("billing")
+	assert.Nil(t, err)
+	assert.Len(t, groups, 1)
+	assert.Equal(t, "Empty", groups[0].State)
+	assert.Equal(t, int64(3), groups[0].Lag)
+	assert.Equal(t, []PartitionLag{
+		{Topic: "orders", Partition: 0, Committed: 7, HighWaterMark: 10, Lag: 3},
+		{Topic: "orders", Partition: 1, Committed: 10, HighWaterMark: 10, Lag: 0},
+	}, groups[0].Partitions)
+}
+
+func TestAdminResetOffsets(t *testing.T) {
+	at := time.Now().Add(-time.Hour)
+	commits := sarama.NewMockOffsetCommitResponse(t)
+	broker, a := newMockAdmin(t, map[string]sarama.MockResponse{
+		"DescribeGroupsRequest": sarama.NewMockDescribeGroupsResponse(t).
+			AddGroupDescription("billing", &sarama.GroupDescription{GroupId: "billing", State: "Empty"}),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("orders", 0, sarama.OffsetOldest, 2).
+			SetOffset("orders", 1, sarama.OffsetOldest, 0).
+			SetOffset("orders", 0, sarama.OffsetNewest, 10).
+			SetOffset("orders", 1, sarama.OffsetNewest, 8).
+			SetOffset("orders", 0, at.UnixMilli(), 6).
+			SetOffset("orders", 1, at.UnixMilli(), -1),
+		"OffsetCommitRequest": commits,
+	})
+
+	committed := func() map[int32]int64 {
+		out := map[int32]int64{}
+		history := broker.History()
+		req := history[len(history)-1].Request.(*sarama.OffsetCommitRequest)
+		for _, p := range []int32{0, 1} {
+			offset, _, err := req.Offset("orders", p)
+			assert.Nil(t, err)
+			out[p] = offset
+		}
+		return out
+	}
+
+	// forward to the end, back to the start, then forward to a time
+	assert.Nil(t, a.ResetOffsets("billing", "orders", sarama.OffsetNewest))
+	assert.Equal(t, map[int32]int64{0: 10, 1: 8}, committed())
+	assert.Nil(t, a.ResetOffsets("billing", "orders", sarama.OffsetOldest))
+	assert.Equal(t, map[int32]int64{0: 2, 1: 0}, committed())
+	assert.Nil(t, a.ResetOffsetsToTime("billing", "orders", at))
+	assert.Equal(t, map[int32]int64{0: 6, 1: 8}, committed())
+
+	// an explicit offset is not taken for a timestamp
+	requests := len(broker.History())
+	assert.ErrorIs(t, a.ResetOffsets("billing", "orders", at.UnixMilli()), ErrResetOffset)
+	assert.ErrorIs(t, a.ResetOffsets("billing", "orders", 5), ErrResetOffset)
+	assert.Len(t, broker.History(), requests)
+
+	commits.SetError("billing", "orders", 1, sarama.ErrOffsetMetadataTooLarge)
+	assert.ErrorIs(t, a.ResetOffsets("billing", "orders", sarama.OffsetNewest), sarama.ErrOffsetMetadataTooLarge)
+}
@@ -0,0 +1,83 @@
+// Package kafka messaging broker
+package kafka
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// newClientConfig return sarama configuration shared by producers,
+// consumers and admin from cfg: version, client id, SASL, TLS, buffers and
+// metadata. It return a *ConfigError when cfg is invalid.
+func newClientConfig(cfg *Config) (*sarama.Config, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	/**
+	 * Construct a new Sarama configuration.
+	 * The Kafka cluster version has to be defined before the consumer/producer is initialized.
+	 */
+	config := sarama.NewConfig()
+
+	if cfg.Version == "" {
+		cfg.Version = defaultVersion
+	}
+
+	version, err := sarama.ParseKafkaVersion(cfg.Version)
+	if err != nil {
+		return nil, &ConfigError{Problems: []error{fmt.Errorf("version %q: %w", cfg.Version, err)}}
+	}
+	config.Version = version
+
+	if cfg.ClientID != "" {
+		config.ClientID = cfg.ClientID
+	}
+
+	if cfg.SASL.Enable {
+		if err := saslConfig(config, cfg); err != nil {
+			return nil, &ConfigError{Problems: []error{err}}
+		}
+		if cfg.SASL.VersionSet {
+			config.Net.SASL.Version = cfg.SASL.Version
+		}
+		if cfg.SASL.HandshakeSet {
+			config.Net.SASL.Handshake = cfg.SASL.Handshake
+		}
+	}
+
+	// The TLS configuration to use for secure connections if
+	// enabled (defaults to nil).
+	if cfg.TLS.Enable {
+		if config.Net.TLS.Config, err = createTlsConfig(cfg.TLS); err != nil {
+			return nil, &ConfigError{Problems: []error{fmt.Errorf("tls: %w", err)}}
+		}
+		config.Net.TLS.Enable = true
+	}
+
+	if cfg.ChannelBufferSize > 0 {
+		config.ChannelBufferSize = cfg.ChannelBufferSize
+	}
+
+	if cfg.Metadata.RefreshSecond > 0 {
+		config.Metadata.RefreshFrequency = time.Duration(cfg.Metadata.RefreshSecond) * time.Second
+	}
+	if cfg.Metadata.RetryMax > 0 {
+		config.Metadata.Retry.Max = cfg.Metadata.RetryMax
+	}
+	if cfg.Metadata.RetryBackoffMs > 0 {
+		config.Metadata.Retry.Backoff = time.Duration(cfg.Metadata.RetryBackoffMs) * time.Millisecond
+	}
+
+	return config, nil
+}
+
+// validClientConfig return config once sarama accept it
+func validClientConfig(config *sarama.Config) (*sarama.Config, error) {
+	if err := config.Validate(); err != nil {
+		return nil, &ConfigError{Problems: []error{err}}
+	}
+	return config, nil
+}
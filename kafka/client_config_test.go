@@ -0,0 +1,49 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientConfigSharedByProducerAndConsumer(t *testing.T) {
+	cfg := &Config{
+		Brokers:  []string{"localhost:9092"},
+		ClientID: "billing-svc",
+		SASL:     SASL{Enable: true, User: "svc", Password: "secret", Version: sarama.SASLHandshakeV0, VersionSet: true, HandshakeSet: true},
+		Metadata: MetadataConfig{RefreshSecond: 60},
+		Producer: ProducerConfig{Compression: "zstd", MaxMessageBytes: 2 << 20, RetryMax: 5},
+		Consumer: ConsumerConfig{FetchMinBytes: 1024, FetchDefaultBytes: 4 << 20, MaxWaitTimeMs: 200},
+	}
+
+	producer, err := newProducerConfig(cfg)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	consumer, err := newConsumerConfig(cfg)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	for _, config := range []*sarama.Config{producer, consumer} {
+		assert.Equal(t, "billing-svc", config.ClientID)
+		assert.Equal(t, sarama.SASLHandshakeV0, config.Net.SASL.Version)
+		assert.False(t, config.Net.SASL.Handshake)
+		assert.Equal(t, time.Minute, config.Metadata.RefreshFrequency)
+	}
+
+	assert.Equal(t, sarama.CompressionZSTD, producer.Producer.Compression)
+	assert.Equal(t, 2<<20, producer.Producer.MaxMessageBytes)
+	assert.Equal(t, 5, producer.Producer.Retry.Max)
+
+	assert.Equal(t, int32(1024), consumer.Consumer.Fetch.Min)
+	assert.Equal(t, int32(4<<20), consumer.Consumer.Fetch.Default)
+	assert.Equal(t, 200*time.Millisecond, consumer.Consumer.MaxWaitTime)
+
+	cfg.Producer.Compression = "brotli"
+	cfg.ClientID = "billing svc"
+	_, err = newProducerConfig(cfg)
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+}
@@ -14,7 +14,9 @@ type Config struct {
 	Brokers []string `json:"brokers" yaml:"brokers"`
 	SASL    SASL     `json:"sasl" yaml:"sasl"`
 	// kafka broker Version
-	Version  string         `json:"version" yaml:"version"`
+	Version string `json:"version" yaml:"version"`
+	// ClientID name sent to the brokers in every request, used in broker
+	// logs and quotas (defaults to "sarama")
 	ClientID string         `json:"client_id" yaml:"client_id"`
 	Producer ProducerConfig `json:"producer" yaml:"producer"`
 	Consumer ConsumerConfig `json:"consumer" yaml:"consumer"`
@@ -24,6 +26,53 @@ type Config struct {
 	// in the background while user code is working, greatly improving throughput.
 	// Defaults to 256.
 	ChannelBufferSize int `json:"channel_buffer_size" yaml:"channel_buffer_size"`
+	// Metadata cluster metadata refresh settings
+	Metadata MetadataConfig `json:"metadata" yaml:"metadata"`
+	// ConnectBackoffMs wait before retrying a failed broker connection,
+	// doubled on every failure (defaults to 1000). Producers and consumers
+	// connect on first use and keep retrying instead of failing at startup.
+	ConnectBackoffMs int `json:"connect_backoff_ms" yaml:"connect_backoff_ms"`
+	// ConnectMaxBackoffMs upper bound of the connection backoff (defaults to 30000)
+	ConnectMaxBackoffMs int `json:"connect_max_backoff_ms" yaml:"connect_max_backoff_ms"`
+	// EnsureTopics create missing Topics and expand their partitions when
+	// a producer or consumer start
+	EnsureTopics bool          `json:"ensure_topics" yaml:"ensure_topics"`
+	Topics       []TopicConfig `json:"topics" yaml:"topics"`
+	// Delay topics of delayed messages, see NewDelayProducer and NewScheduler
+	Delay DelayConfig `json:"delay" yaml:"delay"`
+}
+
+// DelayConfig delay topics `<prefix>.<bucket>` holding delayed messages.
+// A message wait in the longest bucket not exceeding its remaining delay
+// and move on to shorter buckets until it is due.
+type DelayConfig struct {
+	// Buckets delays of the delay topics (defaults to ["1s", "1m", "10m", "1h"])
+	Buckets []string `json:"buckets" yaml:"buckets"`
+	// TopicPrefix prefix of the delay topics (defaults to "delay")
+	TopicPrefix string `json:"topic_prefix" yaml:"topic_prefix"`
+}
+
+// MetadataConfig cluster metadata settings, 0 keep sarama defaults
+type MetadataConfig struct {
+	// RefreshSecond interval of the background metadata refresh, picking up
+	// new partitions and leader changes (defaults to 600)
+	RefreshSecond int `json:"refresh_second" yaml:"refresh_second"`
+	// RetryMax attempts of a metadata request during leader election (defaults to 3)
+	RetryMax int `json:"retry_max" yaml:"retry_max"`
+	// RetryBackoffMs wait between metadata request attempts (defaults to 250)
+	RetryBackoffMs int `json:"retry_backoff_ms" yaml:"retry_backoff_ms"`
+}
+
+// TopicConfig topic settings used by Admin CreateTopic and EnsureTopics
+type TopicConfig struct {
+	Name string `json:"name" yaml:"name"`
+	// Partitions number of partitions (defaults to 1)
+	Partitions int32 `json:"partitions" yaml:"partitions"`
+	// ReplicationFactor 0 use the broker default.replication.factor,
+	// supported from Kafka 2.4
+	ReplicationFactor int16 `json:"replication_factor" yaml:"replication_factor"`
+	// Configs topic configs, e.g. retention.ms or cleanup.policy
+	Configs map[string]string `json:"configs" yaml:"configs"`
 }
 
 type ProducerConfig struct {
@@ -49,6 +98,27 @@ type ProducerConfig struct {
 	// (defaults to hashing the message key). Similar to the `partitioner.class`
 	// setting for the JVM producer.
 	PartitionStrategy string `json:"partition_strategy" yaml:"partition_strategy"`
+
+	// TransactionalID identify the transactional producer across restarts,
+	// required by NewTransactionalProducer. Enabling transactions implies
+	// IdemPotent.
+	TransactionalID string `json:"transactional_id" yaml:"transactional_id"`
+	// TransactionTimeoutSecond maximum time a transaction can remain open
+	// before the broker abort it (defaults to 60 seconds)
+	TransactionTimeoutSecond int `json:"transaction_timeout_second" yaml:"transaction_timeout_second"`
+
+	// Compression codec of produced batches: none, gzip, snappy, lz4 or
+	// zstd (defaults to none). zstd require Kafka 2.1.
+	Compression string `json:"compression" yaml:"compression"`
+	// CompressionLevel codec specific level, 0 use the codec default
+	CompressionLevel int `json:"compression_level" yaml:"compression_level"`
+	// MaxMessageBytes maximum size of a produced message, it should not
+	// exceed the broker message.max.bytes (defaults to 1048576)
+	MaxMessageBytes int `json:"max_message_bytes" yaml:"max_message_bytes"`
+	// RetryMax attempts to send a message before publish fail (defaults to 3)
+	RetryMax int `json:"retry_max" yaml:"retry_max"`
+	// RetryBackoffMs wait between send attempts (defaults to 100)
+	RetryBackoffMs int `json:"retry_backoff_ms" yaml:"retry_backoff_ms"`
 }
 
 type ConsumerConfig struct {
@@ -58,7 +128,57 @@ type ConsumerConfig struct {
 	HeartbeatInterval    int    `json:"heartbeat_interval" yaml:"heartbeat_interval"`
 	RebalanceStrategy    string `json:"rebalance_strategy" yaml:"rebalance_strategy"`
 	AutoCommit           bool   `json:"auto_commit" yaml:"auto_commit"`
-	IsolationLevel       int8   `json:"isolation_level" yaml:"isolation_level"`
+	// IsolationLevel 0 = ReadUncommitted, 1 = ReadCommitted hides messages of
+	// aborted transactions, use it when consuming transactional topics.
+	IsolationLevel int8 `json:"isolation_level" yaml:"isolation_level"`
+	// Concurrency number of workers processing messages of a partition in
+	// parallel, messages with the same key are still processed in order.
+	// 0 or 1 process one message at a time (defaults to 1).
+	Concurrency int `json:"concurrency" yaml:"concurrency"`
+	// BatchSize maximum number of messages delivered to a BatchHandler at
+	// once (defaults to 100)
+	BatchSize int `json:"batch_size" yaml:"batch_size"`
+	// BatchTimeoutMs maximum wait for a batch to fill before it is delivered
+	// anyway (defaults to 1000)
+	BatchTimeoutMs int `json:"batch_timeout_ms" yaml:"batch_timeout_ms"`
+	// Retry policy applied when the handler return an error
+	Retry RetryConfig `json:"retry" yaml:"retry"`
+	// PatternRefreshSecond interval between topic metadata refreshes of a
+	// ConsumerContext TopicPattern subscription (defaults to 30)
+	PatternRefreshSecond int `json:"pattern_refresh_second" yaml:"pattern_refresh_second"`
+
+	// FetchMinBytes minimum bytes the broker wait for before answering a
+	// fetch (defaults to 1)
+	FetchMinBytes int32 `json:"fetch_min_bytes" yaml:"fetch_min_bytes"`
+	// FetchDefaultBytes bytes requested per partition in each fetch
+	// (defaults to 1048576)
+	FetchDefaultBytes int32 `json:"fetch_default_bytes" yaml:"fetch_default_bytes"`
+	// FetchMaxBytes upper bound of the bytes fetched per partition,
+	// 0 is unlimited
+	FetchMaxBytes int32 `json:"fetch_max_bytes" yaml:"fetch_max_bytes"`
+	// MaxWaitTimeMs maximum wait of the broker for FetchMinBytes (defaults to 500)
+	MaxWaitTimeMs int `json:"max_wait_time_ms" yaml:"max_wait_time_ms"`
+}
+
+// RetryConfig policy for messages the consumer handler failed to process.
+// A failed message is first retried in place, then republished to each
+// retry topic `<topic>.retry.<delay>` in order and finally to `<topic>.dlq`.
+type RetryConfig struct {
+	// Attempts number of handler attempts in place before the message is
+	// forwarded (defaults to 3 with Delays or DeadLetter). Without retry
+	// topic nor dead letter 0 retries in place until the handler succeed,
+	// otherwise the message is dropped once attempts are exhausted.
+	Attempts int `json:"attempts" yaml:"attempts"`
+	// InitialBackoffMs wait before the second attempt, doubled on every
+	// failure (defaults to 100ms)
+	InitialBackoffMs int `json:"initial_backoff_ms" yaml:"initial_backoff_ms"`
+	// MaxBackoffMs upper bound of the wait between attempts (defaults to 10s)
+	MaxBackoffMs int `json:"max_backoff_ms" yaml:"max_backoff_ms"`
+	// Delays of tiered retry topics, e.g. ["1m", "10m"] consumes
+	// `<topic>.retry.1m` and `<topic>.retry.10m` in addition to `<topic>`
+	Delays []string `json:"delays" yaml:"delays"`
+	// DeadLetter republish messages failing the last tier to `<topic>.dlq`
+	DeadLetter bool `json:"dead_letter" yaml:"dead_letter"`
 }
 
 type SASL struct {
@@ -66,22 +186,44 @@ type SASL struct {
 	// (defaults to false).
 	Enable bool `json:"enable" yaml:"enable"`
 	// SASLMechanism is the name of the enabled SASL mechanism.
-	// Possible values: OAUTHBEARER, PLAIN (defaults to PLAIN).
+	// Possible values: PLAIN, SCRAM-SHA-256, SCRAM-SHA-512, OAUTHBEARER
+	// (defaults to PLAIN). SASL doesn't enable TLS, set TLS.Enable for
+	// SASL_SSL listeners.
 	Mechanism string `json:"mechanism" yaml:"mechanism"`
-	// Version is the SASL Protocol Version to use
-	// Kafka > 1.x should use V1, except on Azure EventHub which use V0
+	// Version is the SASL Protocol Version to use, applied only when
+	// VersionSet (defaults to V1). Kafka > 1.x should use V1, except on
+	// Azure EventHub which use V0. OAUTHBEARER require V1.
 	Version int16 `json:"version" yaml:"version"`
-	// Whether or not to send the Kafka SASL handshake first if enabled
-	// (defaults to true). You should only set this to false if you're using
-	// a non-Kafka SASL proxy.
+	// VersionSet apply Version instead of the V1 default
+	VersionSet bool `json:"version_set" yaml:"version_set"`
+	// Whether or not to send the Kafka SASL handshake first if enabled,
+	// applied only when HandshakeSet (defaults to true). You should only set
+	// this to false if you're using a non-Kafka SASL proxy.
 	Handshake bool `json:"handshake" yaml:"handshake"`
+	// HandshakeSet apply Handshake instead of the true default
+	HandshakeSet bool `json:"handshake_set" yaml:"handshake_set"`
 	// User is the authentication identity (authcid) to present for
 	// SASL/PLAIN or SASL/SCRAM authentication
 	User string `json:"user" yaml:"user"`
-	// Password for SASL/PLAIN authentication
+	// Password for SASL/PLAIN or SASL/SCRAM authentication
 	Password string `json:"password" yaml:"password"`
 	// authz id used for SASL/SCRAM authentication
+	AuthzID string `json:"authz_id" yaml:"authz_id"`
+	// OAuth client credentials used for SASL/OAUTHBEARER when TokenProvider
+	// is nil
+	OAuth OAuthConfig `json:"oauth" yaml:"oauth"`
+	// TokenProvider supply SASL/OAUTHBEARER tokens, it take precedence over OAuth
+	TokenProvider TokenProvider `json:"-" yaml:"-"`
+}
 
+// OAuthConfig OAuth 2.0 client credentials grant, see NewClientCredentialsProvider
+type OAuthConfig struct {
+	TokenURL     string   `json:"token_url" yaml:"token_url"`
+	ClientID     string   `json:"client_id" yaml:"client_id"`
+	ClientSecret string   `json:"client_secret" yaml:"client_secret"`
+	Scopes       []string `json:"scopes" yaml:"scopes"`
+	// Extensions SASL extensions sent along the token, e.g. logicalCluster
+	Extensions map[string]string `json:"extensions" yaml:"extensions"`
 }
 
 type TLS struct {
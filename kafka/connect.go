@@ -0,0 +1,63 @@
+// Package kafka messaging broker
+package kafka
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultConnectBackoff    = time.Second
+	defaultConnectMaxBackoff = 30 * time.Second
+)
+
+// backoff exponential wait between broker connection attempts
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+func newConnectBackoff(cfg *Config) *backoff {
+	b := &backoff{
+		initial: defaultConnectBackoff,
+		max:     defaultConnectMaxBackoff,
+	}
+	if cfg.ConnectBackoffMs > 0 {
+		b.initial = time.Duration(cfg.ConnectBackoffMs) * time.Millisecond
+	}
+	if cfg.ConnectMaxBackoffMs > 0 {
+		b.max = time.Duration(cfg.ConnectMaxBackoffMs) * time.Millisecond
+	}
+	if b.max < b.initial {
+		b.max = b.initial
+	}
+	return b
+}
+
+// next return the wait before the next attempt, doubled on every call
+func (b *backoff) next() time.Duration {
+	if b.current == 0 {
+		b.current = b.initial
+	} else if b.current *= 2; b.current > b.max {
+		b.current = b.max
+	}
+	return b.current
+}
+
+func (b *backoff) reset() {
+	b.current = 0
+}
+
+// sleep wait d, it return false when ctx is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/IBM/sarama"
@@ -23,138 +24,135 @@ const (
 )
 
 type consumerGroup struct {
-	config     *sarama.Config
-	brokers    []string
-	autoCommit bool
+	cfg          *Config
+	config       *sarama.Config
+	brokers      []string
+	autoCommit   bool
+	retry        *retryPolicy
+	concurrency  int
+	batchSize    int
+	batchTimeout time.Duration
+	// producerConfig of the retry producer of every subscription, nil
+	// when failed messages are not forwarded
+	producerConfig *sarama.Config
+
+	mux    sync.Mutex
+	active *subscription
 }
 
-// NewConsumer return consumer message broker
-func NewConsumerGroup(cfg *Config) Consumer {
-	m := &consumerGroup{}
+// NewConsumer return consumer message broker. The brokers are connected
+// once subscribed, failed connections are retried with backoff.
+func NewConsumerGroup(cfg *Config) (Consumer, error) {
+	return newConsumerGroup(cfg)
+}
+
+// NewGroupConsumer return consumer message broker controlled by Start and Stop
+func NewGroupConsumer(cfg *Config) (GroupConsumer, error) {
+	return newConsumerGroup(cfg)
+}
 
-	/**
-	 * Construct a new Sarama configuration.
-	 * The Kafka cluster version has to be defined before the consumer/producer is initialized.
-	 */
-	config := sarama.NewConfig()
+func newConsumerGroup(cfg *Config) (*consumerGroup, error) {
+	m := &consumerGroup{}
 
-	if cfg.Version == "" {
-		cfg.Version = defaultVersion
+	config, err := newConsumerConfig(cfg)
+	if err != nil {
+		return nil, err
 	}
-	lf := map[string]interface{}{}
-	lf["event"] = logEventEventName
-	lf["state"] = "KafkaConsumerGroupInitialize"
 
-	version, err := sarama.ParseKafkaVersion(cfg.Version)
+	retry, err := newRetryPolicy(cfg.Consumer.Retry)
 	if err != nil {
-		log.WithFields(lf).Fatal(fmt.Sprintf("parse kafka version got: %v", err))
+		return nil, &ConfigError{Problems: []error{err}}
 	}
 
-	if cfg.SASL.Enable {
-		config.Net.SASL.Enable = true
-		config.Net.SASL.User = cfg.SASL.User
-		config.Net.SASL.Password = cfg.SASL.Password
-		config.Net.SASL.Version = sarama.SASLHandshakeV0
-		config.Net.SASL.Handshake = true
-		config.Net.SASL.Mechanism = sarama.SASLMechanism(cfg.SASL.Mechanism)
-		config.Net.TLS.Enable = true
+	// failed messages are republished to retry and dead letter topics
+	if retry.forwarding() {
+		if m.producerConfig, err = newProducerConfig(cfg); err != nil {
+			return nil, err
+		}
 	}
 
-	// The TLS configuration to use for secure connections if
-	// enabled (defaults to nil).
-	if config.Net.TLS.Enable || cfg.TLS.Enable {
-		config.Net.TLS.Config = createTlsConfig(cfg.TLS)
-		config.Net.TLS.Enable = true
+	m.cfg = cfg
+	m.brokers = cfg.Brokers
+	m.config = config
+	m.autoCommit = cfg.Consumer.AutoCommit
+	m.retry = retry
+	m.concurrency = cfg.Consumer.Concurrency
+	m.batchSize = cfg.Consumer.BatchSize
+	m.batchTimeout = time.Duration(cfg.Consumer.BatchTimeoutMs) * time.Millisecond
+
+	if m.batchSize < 1 {
+		m.batchSize = defaultBatchSize
 	}
+	if m.batchTimeout <= 0 {
+		m.batchTimeout = defaultBatchTimeout
+	}
+	return m, nil
+}
 
-	config.Version = version
+// newConsumerConfig return sarama consumer configuration from cfg, a
+// *ConfigError when cfg is invalid
+func newConsumerConfig(cfg *Config) (*sarama.Config, error) {
+	config, err := newClientConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	config.Consumer.Offsets.Initial = cfg.Consumer.OffsetInitial
+	if cfg.Consumer.OffsetInitial != 0 {
+		config.Consumer.Offsets.Initial = cfg.Consumer.OffsetInitial
+	}
 	config.Consumer.Return.Errors = true
-	config.Consumer.Group.Session.Timeout = time.Duration(cfg.Consumer.SessionTimeoutSecond) * time.Second
-	config.Consumer.Group.Heartbeat.Interval = time.Duration(cfg.Consumer.HeartbeatInterval) * time.Millisecond
+	if cfg.Consumer.SessionTimeoutSecond > 0 {
+		config.Consumer.Group.Session.Timeout = time.Duration(cfg.Consumer.SessionTimeoutSecond) * time.Second
+	}
+	if cfg.Consumer.HeartbeatInterval > 0 {
+		config.Consumer.Group.Heartbeat.Interval = time.Duration(cfg.Consumer.HeartbeatInterval) * time.Millisecond
+	}
 
 	if len(strings.Trim(cfg.Consumer.RebalanceStrategy, " ")) == 0 {
 		cfg.Consumer.RebalanceStrategy = sarama.RangeBalanceStrategyName
 	}
 
 	st, ok := balanceStrategies[cfg.Consumer.RebalanceStrategy]
-
 	if !ok {
-		lf["state"] = "ParseKafkaRebalanceStrategy"
-		log.WithFields(lf).Fatal(fmt.Sprintf(
-			`rebalance strateggy only available : %q, %q, %q,   on setting value : %q`,
-			sarama.RoundRobinBalanceStrategyName,
-			sarama.RangeBalanceStrategyName,
-			sarama.StickyBalanceStrategyName,
-			cfg.Consumer.RebalanceStrategy,
-		))
-	}
-
-	if cfg.ChannelBufferSize > 0 {
-		config.ChannelBufferSize = cfg.ChannelBufferSize
+		return nil, &ConfigError{Problems: []error{fmt.Errorf("consumer rebalance strategy %q not supported", cfg.Consumer.RebalanceStrategy)}}
 	}
 
 	config.Consumer.IsolationLevel = sarama.IsolationLevel(cfg.Consumer.IsolationLevel)
 
 	config.Consumer.Group.Rebalance.Strategy = st
 
-	m.brokers = cfg.Brokers
-	m.config = config
-	m.autoCommit = cfg.Consumer.AutoCommit
-	return m
-}
-
-// Subscribe message
-func (k *consumerGroup) Subscribe(ctx *ConsumerContext) {
-
-	lf := map[string]interface{}{}
-	lf["event"] = logEventEventName
-	lf["topics"] = ctx.Topics
-
-	client, err := sarama.NewConsumerGroup(k.brokers, ctx.GroupID, k.config)
-
-	if err != nil {
-		log.WithFields(lf).Fatal(err.Error())
+	if cfg.Consumer.FetchMinBytes > 0 {
+		config.Consumer.Fetch.Min = cfg.Consumer.FetchMinBytes
+	}
+	if cfg.Consumer.FetchDefaultBytes > 0 {
+		config.Consumer.Fetch.Default = cfg.Consumer.FetchDefaultBytes
+	}
+	if cfg.Consumer.FetchMaxBytes > 0 {
+		config.Consumer.Fetch.Max = cfg.Consumer.FetchMaxBytes
+	}
+	if cfg.Consumer.MaxWaitTimeMs > 0 {
+		config.Consumer.MaxWaitTime = time.Duration(cfg.Consumer.MaxWaitTimeMs) * time.Millisecond
 	}
 
-	handler := NewConsumerHandler(ctx.Handler, k.autoCommit, ctx.GroupID)
-
-	// kafka consumer client
-	nCtx, cancel := context.WithCancel(ctx.Context)
-
-	defer func() {
-		_ = client.Close()
-	}()
+	return validClientConfig(config)
+}
 
-	// subscriber errors
-	go func() {
-		for err := range client.Errors() {
-			log.WithFields(lf).Error(err.Error())
-		}
-	}()
-
-	go func() {
-		for {
-			select {
-			case <-nCtx.Done():
-				lf["state"] = logStateNameTerminated
-				log.WithFields(lf).Warn(fmt.Sprintf("stopped consume topics %v", ctx.Topics))
-				return
-			default:
-				err := client.Consume(nCtx, ctx.Topics, handler)
-				if err != nil {
-					log.WithFields(lf).Warn(fmt.Sprintf("consume topic %v message error %s", ctx.Topics, err.Error()))
-				}
-			}
-		}
-	}()
+// Subscribe message, it block until ctx.Context is done then stop gracefully
+func (k *consumerGroup) Subscribe(ctx *ConsumerContext) {
+	s := k.subscribe(ctx)
 
-	lf["state"] = logStateNameStarting
-	log.WithFields(lf).Info(fmt.Sprintf("consumer group up and running!... group %s, queue %v", ctx.Context, ctx.Topics))
+	lf := s.logFields(logStateNameStarting)
+	log.WithFields(lf).Info(fmt.Sprintf("consumer group up and running!... group %s, queue %v", ctx.GroupID, s.currentTopics()))
 
 	<-ctx.Context.Done()
-	cancel()
 	lf["state"] = logStateNameTerminated
 	log.WithFields(lf).Info("Shutdown signal received via context cancel")
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), defaultStopTimeout)
+	defer cancel()
+
+	if err := s.stop(stopCtx); err != nil {
+		log.WithFields(lf).Warn(err.Error())
+	}
+	log.WithFields(lf).Warn(fmt.Sprintf("stopped consume topics %v", s.currentTopics()))
 }
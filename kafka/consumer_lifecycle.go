@@ -0,0 +1,777 @@
+// Package kafka messaging
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"github.com/lukmanlukmin/go-lib/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	// defaultStopTimeout time Subscribe wait in-flight handlers on shutdown
+	defaultStopTimeout = 30 * time.Second
+	// allPartitions pause key covering every partition of a topic
+	allPartitions int32 = -1
+	// defaultPatternRefresh interval between refreshes of pattern topics
+	defaultPatternRefresh = 30 * time.Second
+)
+
+// ErrConsumerStarted returned by Start when the consumer is already running
+var ErrConsumerStarted = errors.New("[kafka] consumer already started")
+
+// ConsumerState lifecycle state of a consumer group
+type ConsumerState string
+
+const (
+	ConsumerStateIdle        ConsumerState = "idle"
+	ConsumerStateStarting    ConsumerState = "starting"
+	ConsumerStateRunning     ConsumerState = "running"
+	ConsumerStateRebalancing ConsumerState = "rebalancing"
+	ConsumerStateStopping    ConsumerState = "stopping"
+	ConsumerStateStopped     ConsumerState = "stopped"
+)
+
+// ConsumerHealth snapshot of a consumer group for liveness and readiness probes
+type ConsumerHealth struct {
+	State ConsumerState `json:"state" yaml:"state"`
+	// Live consume loop is running, it may be retrying to join the group
+	Live bool `json:"live" yaml:"live"`
+	// Ready member joined the group and is consuming its claims
+	Ready       bool               `json:"ready" yaml:"ready"`
+	Assigned    map[string][]int32 `json:"assigned,omitempty" yaml:"assigned,omitempty"`
+	Paused      map[string][]int32 `json:"paused,omitempty" yaml:"paused,omitempty"`
+	LastError   string             `json:"last_error,omitempty" yaml:"last_error,omitempty"`
+	LastErrorAt time.Time          `json:"last_error_at,omitempty" yaml:"last_error_at,omitempty"`
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// pauseGate hold claim loops of paused partitions. Sarama forget pauses of
+// partitions reassigned by a rebalance, the gate keep them across sessions
+// and fetching stop once the claim channel is full.
+type pauseGate struct {
+	mux    sync.Mutex
+	paused map[topicPartition]chan struct{}
+}
+
+func newPauseGate() *pauseGate {
+	return &pauseGate{paused: map[topicPartition]chan struct{}{}}
+}
+
+func (g *pauseGate) pause(topic string, partitions ...int32) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	if len(partitions) == 0 {
+		partitions = []int32{allPartitions}
+	}
+	for _, p := range partitions {
+		tp := topicPartition{topic, p}
+		if _, ok := g.paused[tp]; !ok {
+			g.paused[tp] = make(chan struct{})
+		}
+	}
+}
+
+// resume release partitions of topic, every paused partition of topic when none given
+func (g *pauseGate) resume(topic string, partitions ...int32) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	for tp, ch := range g.paused {
+		if tp.topic != topic {
+			continue
+		}
+		if len(partitions) > 0 && !containsPartition(partitions, tp.partition) {
+			continue
+		}
+		close(ch)
+		delete(g.paused, tp)
+	}
+}
+
+func (g *pauseGate) blocked(topic string, partition int32) chan struct{} {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	if ch, ok := g.paused[topicPartition{topic, allPartitions}]; ok {
+		return ch
+	}
+	return g.paused[topicPartition{topic, partition}]
+}
+
+// wait block while partition is paused, it return false when ctx is done or
+// the consumer is stopping before the partition is resumed
+func (g *pauseGate) wait(ctx context.Context, stopping <-chan struct{}, topic string, partition int32) bool {
+	if g == nil {
+		return true
+	}
+	for {
+		ch := g.blocked(topic, partition)
+		if ch == nil {
+			return true
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return false
+		case <-stopping:
+			return false
+		}
+	}
+}
+
+// claims return paused partitions, partitions of topic wide pauses are taken from assigned
+func (g *pauseGate) claims(assigned map[string][]int32) map[string][]int32 {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	out := map[string][]int32{}
+	for tp := range g.paused {
+		if tp.partition == allPartitions {
+			out[tp.topic] = append(out[tp.topic], assigned[tp.topic]...)
+			continue
+		}
+		out[tp.topic] = append(out[tp.topic], tp.partition)
+	}
+	for topic, ps := range out {
+		out[topic] = uniquePartitions(ps)
+	}
+	return out
+}
+
+// subscription one run of a consumer group, from joining until the client is closed
+type subscription struct {
+	group   *consumerGroup
+	groupID string
+	ctx     *ConsumerContext
+	config  *sarama.Config
+	// pattern subscribe matching topics in addition to ctx.Topics,
+	// topicsChanged is signalled when the matching set change
+	pattern       *regexp.Regexp
+	topicsChanged chan struct{}
+	handler       *consumerHandler
+	backoff       *backoff
+	gate          *pauseGate
+	cancel        context.CancelFunc
+	stopping      chan struct{}
+	done          chan struct{}
+	stopOnce      sync.Once
+	stopErr       error
+	// metrics bridge sarama metrics until stop
+	metrics metric.Registration
+	// retryProducer forward failed messages until stop
+	retryProducer *producer
+
+	mux         sync.RWMutex
+	client      sarama.ConsumerGroup
+	metadata    sarama.Client
+	topics      []string
+	restart     context.CancelFunc
+	restarting  bool
+	held        map[topicPartition]int
+	state       ConsumerState
+	assigned    map[string][]int32
+	lastErr     string
+	lastErrorAt time.Time
+}
+
+// subscribe connect, join the group and consume in the background until stop
+func (k *consumerGroup) subscribe(ctx *ConsumerContext) *subscription {
+	s := &subscription{
+		group:         k,
+		groupID:       ctx.GroupID,
+		config:        k.config,
+		topics:        k.retry.topics(ctx.Topics),
+		ctx:           ctx,
+		pattern:       ctx.TopicPattern,
+		topicsChanged: make(chan struct{}, 1),
+		backoff:       newConnectBackoff(k.cfg),
+		gate:          newPauseGate(),
+		held:          map[topicPartition]int{},
+		stopping:      make(chan struct{}),
+		done:          make(chan struct{}),
+		state:         ConsumerStateStarting,
+	}
+
+	// the group config with the initial offset of the subscription
+	if o := ctx.OffsetInitial; o == sarama.OffsetOldest || o == sarama.OffsetNewest {
+		config := *k.config
+		config.Consumer.Offsets.Initial = o
+		s.config = &config
+	}
+
+	retry := k.retry
+	if k.producerConfig != nil {
+		s.retryProducer = newProducer(k.cfg, k.producerConfig)
+		r := *k.retry
+		r.producer = s.retryProducer
+		retry = &r
+	}
+
+	handler := newConsumerHandler(ctx.Handler, k.autoCommit, ctx.GroupID, retry)
+	if len(ctx.Middlewares) > 0 {
+		if ctx.Handler != nil {
+			handler.handler = Chain(ctx.Handler, ctx.Middlewares...)
+		}
+		handler.handlers = make(map[string]Handler, len(ctx.Handlers))
+		for topic, h := range ctx.Handlers {
+			handler.handlers[topic] = Chain(h, ctx.Middlewares...)
+		}
+	} else {
+		handler.handlers = ctx.Handlers
+	}
+	handler.concurrency = k.concurrency
+	handler.batchHandler = ctx.BatchHandler
+	handler.batchSize = k.batchSize
+	handler.batchTimeout = k.batchTimeout
+	handler.stopping = s.stopping
+	handler.restarting = s.isRestarting
+	handler.gate = s.gate
+	handler.hold = s.hold
+	handler.onSetup = s.setup
+	handler.onCleanup = s.cleanup
+	s.handler = handler
+
+	reg, err := BridgeSaramaMetrics(k.config.MetricRegistry, attribute.String("client", "consumer"))
+	if err != nil {
+		log.WithFields(s.logFields(logStateNameStarting)).Warn(fmt.Sprintf("bridge sarama consumer metrics got: %s", err.Error()))
+	}
+	s.metrics = reg
+
+	parent := ctx.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	// handlers keep running on graceful stop, the consume context is
+	// cancelled only when Stop give up waiting
+	nCtx, cancel := context.WithCancel(context.WithoutCancel(parent))
+	s.cancel = cancel
+	handler.ctx = nCtx
+
+	go s.run(nCtx)
+
+	return s
+}
+
+func (s *subscription) logFields(state string) map[string]interface{} {
+	return map[string]interface{}{
+		"event":  logEventEventName,
+		"state":  state,
+		"group":  s.groupID,
+		"topics": s.currentTopics(),
+	}
+}
+
+// watchErrors record client errors until the client is closed
+func (s *subscription) watchErrors(client sarama.ConsumerGroup) {
+	for err := range client.Errors() {
+		s.fail(err)
+		log.WithFields(s.logFields("KafkaConsumerGroupError")).Error(err.Error())
+	}
+}
+
+func (s *subscription) run(ctx context.Context) {
+	defer close(s.done)
+
+	client, ok := s.connect(ctx)
+	if !ok {
+		return
+	}
+	go s.watchErrors(client)
+	if s.pattern != nil {
+		s.refreshTopics()
+		go s.watchTopics(ctx)
+	}
+
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		topics := s.currentTopics()
+		if len(topics) == 0 {
+			// nothing match the pattern yet
+			select {
+			case <-s.stopping:
+				return
+			case <-ctx.Done():
+				return
+			case <-s.topicsChanged:
+			}
+			continue
+		}
+
+		// the session is ended early to rejoin when the topics change
+		cCtx, restart := context.WithCancel(ctx)
+		s.mux.Lock()
+		s.restart = restart
+		s.mux.Unlock()
+
+		err := client.Consume(cCtx, topics, s.handler)
+		restart()
+		if err == nil {
+			s.backoff.reset()
+			continue
+		}
+		if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+			return
+		}
+
+		s.fail(err)
+		log.WithFields(s.logFields(logStateNameStarting)).Warn(fmt.Sprintf("consume topic %v message error %s", topics, err.Error()))
+
+		if !s.wait(ctx, s.backoff.next()) {
+			return
+		}
+	}
+}
+
+// connect ensure configured topics and create the consumer group client,
+// retrying with backoff until it succeed or the subscription stop
+func (s *subscription) connect(ctx context.Context) (sarama.ConsumerGroup, bool) {
+	for {
+		err := ensureTopics(s.group.cfg)
+		var metadata sarama.Client
+		if err == nil {
+			metadata, err = sarama.NewClient(s.group.brokers, s.config)
+		}
+		var client sarama.ConsumerGroup
+		if err == nil {
+			if client, err = sarama.NewConsumerGroupFromClient(s.groupID, metadata); err != nil {
+				_ = metadata.Close()
+			}
+		}
+		if err == nil {
+			s.mux.Lock()
+			s.client = client
+			s.metadata = metadata
+			s.mux.Unlock()
+			s.backoff.reset()
+			return client, true
+		}
+
+		s.fail(err)
+		wait := s.backoff.next()
+		log.WithFields(s.logFields(logStateNameStarting)).Warn(fmt.Sprintf("connect brokers %v got: %s, retry in %s", s.group.brokers, err.Error(), wait))
+
+		if !s.wait(ctx, wait) {
+			return nil, false
+		}
+	}
+}
+
+// wait wait d, it return false when the subscription stop first
+func (s *subscription) wait(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-s.stopping:
+		return false
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stopping:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return sleep(ctx, d)
+}
+
+// watchTopics refresh the topics matching the pattern until the
+// subscription stop
+func (s *subscription) watchTopics(ctx context.Context) {
+	interval := defaultPatternRefresh
+	if s.group.cfg.Consumer.PatternRefreshSecond > 0 {
+		interval = time.Duration(s.group.cfg.Consumer.PatternRefreshSecond) * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.refreshTopics()
+		}
+	}
+}
+
+// refreshTopics match the cluster topics against the pattern, the running
+// session is ended when the subscribed topics change
+func (s *subscription) refreshTopics() {
+	s.mux.RLock()
+	metadata := s.metadata
+	s.mux.RUnlock()
+
+	if err := metadata.RefreshMetadata(); err != nil {
+		s.fail(err)
+		log.WithFields(s.logFields(logStateNameStarting)).Warn(fmt.Sprintf("refresh topics matching %s got: %s", s.pattern, err.Error()))
+		return
+	}
+	all, err := metadata.Topics()
+	if err != nil {
+		s.fail(err)
+		return
+	}
+
+	// the group fail to consume missing topics, retry tiers of matching
+	// topics are subscribed once they exist
+	static := s.group.retry.topics(s.ctx.Topics)
+	var topics []string
+	for _, t := range s.group.retry.topics(matchTopics(s.pattern, s.ctx.Topics, all)) {
+		if slices.Contains(static, t) || slices.Contains(all, t) {
+			topics = append(topics, t)
+		}
+	}
+
+	s.mux.Lock()
+	changed := !slices.Equal(topics, s.topics)
+	if changed {
+		s.topics = topics
+		// handlers of the ended session finish their message
+		s.restarting = s.restart != nil
+	}
+	restart := s.restart
+	s.mux.Unlock()
+
+	if !changed {
+		return
+	}
+	log.WithFields(s.logFields(logStateNameStarting)).Info(fmt.Sprintf("topics matching %s changed", s.pattern))
+	select {
+	case s.topicsChanged <- struct{}{}:
+	default:
+	}
+	if restart != nil {
+		restart()
+	}
+}
+
+// matchTopics return topics and the main topics of all matching pattern,
+// retry tiers, dead letter and internal topics are left out
+func matchTopics(pattern *regexp.Regexp, topics, all []string) []string {
+	matched := append([]string{}, topics...)
+	for _, t := range all {
+		if strings.HasPrefix(t, "__") || forwardedTopic(t) {
+			continue
+		}
+		if pattern.MatchString(t) && !slices.Contains(matched, t) {
+			matched = append(matched, t)
+		}
+	}
+	sort.Strings(matched)
+	return matched
+}
+
+func (s *subscription) currentTopics() []string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.topics
+}
+
+func (s *subscription) isRestarting() bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.restarting
+}
+
+func (s *subscription) getClient() sarama.ConsumerGroup {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.client
+}
+
+func (s *subscription) setup(session sarama.ConsumerGroupSession) {
+	claims := session.Claims()
+
+	s.mux.Lock()
+	s.assigned = claims
+	s.restarting = false
+	if s.state != ConsumerStateStopping {
+		s.state = ConsumerStateRunning
+	}
+	s.mux.Unlock()
+
+	if s.ctx.OnAssigned != nil {
+		s.ctx.OnAssigned(session.Context(), claims)
+	}
+}
+
+// cleanup run once every claim returned, marked offsets are committed
+// before the partitions are released
+func (s *subscription) cleanup(session sarama.ConsumerGroupSession) {
+	if s.ctx.OnRevoked != nil {
+		s.ctx.OnRevoked(context.WithoutCancel(session.Context()), session.Claims())
+	}
+
+	session.Commit()
+
+	s.mux.Lock()
+	s.assigned = nil
+	if s.state != ConsumerStateStopping {
+		s.state = ConsumerStateRebalancing
+	}
+	s.mux.Unlock()
+}
+
+func (s *subscription) fail(err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.lastErr = err.Error()
+	s.lastErrorAt = time.Now()
+}
+
+func (s *subscription) setState(state ConsumerState) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.state = state
+}
+
+// stop stop fetching, wait claims to finish the messages in hand and leave
+// the group. In-flight handlers are cancelled when ctx is done first.
+func (s *subscription) stop(ctx context.Context) error {
+	s.stopOnce.Do(func() {
+		s.setState(ConsumerStateStopping)
+		close(s.stopping)
+
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			s.stopErr = fmt.Errorf("[kafka] stop consumer group %s got: %w", s.groupID, ctx.Err())
+		}
+
+		s.cancel()
+		<-s.done
+
+		if client := s.getClient(); client != nil {
+			if err := client.Close(); err != nil && s.stopErr == nil {
+				s.stopErr = fmt.Errorf("[kafka] close consumer group %s got: %w", s.groupID, err)
+			}
+			// consumer groups created from a client leave it open
+			s.mux.RLock()
+			metadata := s.metadata
+			s.mux.RUnlock()
+			_ = metadata.Close()
+		}
+		if s.metrics != nil {
+			_ = s.metrics.Unregister()
+		}
+		if s.retryProducer != nil {
+			_ = s.retryProducer.Close()
+		}
+		s.setState(ConsumerStateStopped)
+	})
+
+	<-s.done
+	return s.stopErr
+}
+
+func (s *subscription) stopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *subscription) pause(topic string, partitions ...int32) {
+	s.gate.pause(topic, partitions...)
+
+	s.mux.RLock()
+	if len(partitions) == 0 {
+		partitions = s.assigned[topic]
+	}
+	s.mux.RUnlock()
+
+	if client := s.getClient(); client != nil && len(partitions) > 0 {
+		client.Pause(map[string][]int32{topic: partitions})
+	}
+}
+
+func (s *subscription) resume(topic string, partitions ...int32) {
+	s.gate.resume(topic, partitions...)
+
+	s.mux.RLock()
+	if len(partitions) == 0 {
+		partitions = s.assigned[topic]
+	}
+	s.mux.RUnlock()
+
+	if client := s.getClient(); client != nil && len(partitions) > 0 {
+		client.Resume(map[string][]int32{topic: partitions})
+	}
+}
+
+// hold pause fetching partition of topic while handlers wait, the fetch
+// resume once the last of them return. Partitions paused by Pause are left
+// as they are.
+func (s *subscription) hold(topic string, partition int32) func() {
+	tp := topicPartition{topic, partition}
+	claims := map[string][]int32{topic: {partition}}
+
+	s.mux.Lock()
+	s.held[tp]++
+	first := s.held[tp] == 1
+	s.mux.Unlock()
+
+	if client := s.getClient(); first && client != nil && s.gate.blocked(topic, partition) == nil {
+		client.Pause(claims)
+	}
+
+	return func() {
+		s.mux.Lock()
+		s.held[tp]--
+		last := s.held[tp] == 0
+		if last {
+			delete(s.held, tp)
+		}
+		s.mux.Unlock()
+
+		if client := s.getClient(); last && client != nil && s.gate.blocked(topic, partition) == nil {
+			client.Resume(claims)
+		}
+	}
+}
+
+func (s *subscription) health() ConsumerHealth {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	h := ConsumerHealth{
+		State:       s.state,
+		Ready:       s.state == ConsumerStateRunning,
+		Assigned:    s.assigned,
+		Paused:      s.gate.claims(s.assigned),
+		LastError:   s.lastErr,
+		LastErrorAt: s.lastErrorAt,
+	}
+	h.Live = h.State != ConsumerStateStopped && !s.stopped()
+	return h
+}
+
+// Start join the group and consume ctx.Topics in the background. The
+// consumer stop gracefully when ctx.Context is done or Stop is called.
+func (k *consumerGroup) Start(ctx *ConsumerContext) error {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	if k.active != nil && !k.active.stopped() {
+		return ErrConsumerStarted
+	}
+
+	s := k.subscribe(ctx)
+	k.active = s
+
+	log.WithFields(s.logFields(logStateNameStarting)).Info(fmt.Sprintf("consumer group up and running!... group %s, queue %v", ctx.GroupID, s.currentTopics()))
+
+	if ctx.Context != nil {
+		go func() {
+			select {
+			case <-ctx.Context.Done():
+				stopCtx, cancel := context.WithTimeout(context.Background(), defaultStopTimeout)
+				defer cancel()
+				_ = s.stop(stopCtx)
+			case <-s.done:
+			}
+		}()
+	}
+	return nil
+}
+
+// Stop stop the consumer started by Start, waiting in-flight handlers and
+// committing their offsets until ctx is done
+func (k *consumerGroup) Stop(ctx context.Context) error {
+	k.mux.Lock()
+	s := k.active
+	k.mux.Unlock()
+
+	if s == nil {
+		return nil
+	}
+
+	err := s.stop(ctx)
+	log.WithFields(s.logFields(logStateNameTerminated)).Info(fmt.Sprintf("stopped consume topics %v", s.currentTopics()))
+	return err
+}
+
+// Pause stop consuming partitions of topic, all assigned when none given
+func (k *consumerGroup) Pause(topic string, partitions ...int32) {
+	if s := k.current(); s != nil {
+		s.pause(topic, partitions...)
+	}
+}
+
+// Resume resume partitions of topic, every paused partition of topic when none given
+func (k *consumerGroup) Resume(topic string, partitions ...int32) {
+	if s := k.current(); s != nil {
+		s.resume(topic, partitions...)
+	}
+}
+
+// Health return status of the consumer started by Start
+func (k *consumerGroup) Health() ConsumerHealth {
+	if s := k.current(); s != nil {
+		return s.health()
+	}
+	return ConsumerHealth{State: ConsumerStateIdle}
+}
+
+func (k *consumerGroup) current() *subscription {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	return k.active
+}
+
+func containsPartition(partitions []int32, p int32) bool {
+	for _, v := range partitions {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
+
+func uniquePartitions(ps []int32) []int32 {
+	sort.Slice(ps, func(i, j int) bool { return ps[i] < ps[j] })
+	out := ps[:0]
+	for i, p := range ps {
+		if i == 0 || p != ps[i-1] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
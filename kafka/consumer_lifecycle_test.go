@@ -0,0 +1,314 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumeClaimStoppingFinishMessageInHand(t *testing.T) {
+	session := newFakeSession(context.Background())
+	messages := make(chan *sarama.ConsumerMessage, 3)
+	for i := int64(0); i < 3; i++ {
+		messages <- consumerMessage("orders", 0, i, "a")
+	}
+	claim := &fakeClaim{topic: "orders", partition: 0, messages: messages}
+
+	stopping := make(chan struct{})
+	var seen []int64
+	h := NewConsumerHandler(func(_ context.Context, msg *MessageDecoder) error {
+		seen = append(seen, msg.Offset)
+		close(stopping)
+		return nil
+	}, false, "group").(*consumerHandler)
+	h.stopping = stopping
+
+	done := make(chan struct{})
+	go func() {
+		assert.Nil(t, h.ConsumeClaim(session, claim))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("claim did not return after stop")
+	}
+	assert.Equal(t, []int64{0}, seen)
+	assert.Equal(t, int64(1), session.committed("orders", 0))
+}
+
+func TestConsumeClaimStoppingLetOtherPartitionsFinish(t *testing.T) {
+	sessionCtx, endSession := context.WithCancel(context.Background())
+	session := newFakeSession(sessionCtx)
+	slow := newFakeClaim("orders", 0, consumerMessage("orders", 0, 4, "a"))
+	idle := &fakeClaim{topic: "orders", partition: 1, messages: make(chan *sarama.ConsumerMessage)}
+
+	started := make(chan struct{})
+	attempts := 0
+	var cancelled bool
+	h := NewConsumerHandler(func(ctx context.Context, _ *MessageDecoder) error {
+		attempts++
+		if attempts == 1 {
+			close(started)
+			<-sessionCtx.Done()
+			cancelled = ctx.Err() != nil
+			return errors.New("transient")
+		}
+		return nil
+	}, false, "group").(*consumerHandler)
+	stopping := make(chan struct{})
+	h.stopping = stopping
+	h.ctx = context.Background()
+
+	slowDone := make(chan struct{})
+	go func() {
+		assert.Nil(t, h.ConsumeClaim(session, slow))
+		close(slowDone)
+	}()
+	idleDone := make(chan struct{})
+	go func() {
+		assert.Nil(t, h.ConsumeClaim(session, idle))
+		close(idleDone)
+	}()
+
+	<-started
+	close(stopping)
+	<-idleDone
+	// sarama cancel the session once a claim loop return
+	endSession()
+
+	select {
+	case <-slowDone:
+	case <-time.After(time.Second):
+		t.Fatal("slow partition did not finish")
+	}
+	assert.False(t, cancelled)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, int64(5), session.committed("orders", 0))
+}
+
+func TestConsumeClaimPausedPartition(t *testing.T) {
+	session := newFakeSession(context.Background())
+	claim := newFakeClaim("orders", 1, consumerMessage("orders", 1, 0, "a"))
+
+	gate := newPauseGate()
+	gate.pause("orders")
+
+	handled := make(chan int64, 1)
+	h := NewConsumerHandler(func(_ context.Context, msg *MessageDecoder) error {
+		handled <- msg.Offset
+		return nil
+	}, false, "group").(*consumerHandler)
+	h.gate = gate
+
+	go func() { _ = h.ConsumeClaim(session, claim) }()
+
+	select {
+	case <-handled:
+		t.Fatal("paused partition was consumed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, map[string][]int32{"orders": {1, 2}}, gate.claims(map[string][]int32{"orders": {2, 1}}))
+
+	gate.resume("orders")
+	select {
+	case offset := <-handled:
+		assert.Equal(t, int64(0), offset)
+	case <-time.After(time.Second):
+		t.Fatal("resumed partition was not consumed")
+	}
+	assert.Empty(t, gate.claims(nil))
+}
+
+func TestMatchTopics(t *testing.T) {
+	all := []string{"orders.eu", "orders.us", "orders.eu.retry.1m", "orders.eu.dlq", "payments", "__consumer_offsets"}
+	assert.Equal(t,
+		[]string{"orders.eu", "orders.us", "payments"},
+		matchTopics(regexp.MustCompile(`^orders\.`), []string{"payments"}, all),
+	)
+}
+
+func TestConsumeClaimRouteByTopic(t *testing.T) {
+	retried := consumerMessage("orders.eu.retry.1m", 0, 0, "b")
+	retried.Headers = []*sarama.RecordHeader{{Key: []byte(HeaderOriginalTopic), Value: []byte("orders.eu")}}
+	// main topics ignore the header, e.g. of replayed messages
+	replayed := consumerMessage("orders.us", 0, 1, "d")
+	replayed.Headers = retried.Headers
+
+	var routed []string
+	ctx := &ConsumerContext{
+		Handler: func(_ context.Context, msg *MessageDecoder) error {
+			routed = append(routed, "default "+msg.Topic)
+			return nil
+		},
+		Handlers: map[string]Handler{
+			"orders.eu": func(_ context.Context, msg *MessageDecoder) error {
+				routed = append(routed, "eu "+msg.Topic)
+				return nil
+			},
+		},
+	}
+	h := newConsumerHandler(ctx.Handler, false, "group", &retryPolicy{})
+	h.handlers = ctx.Handlers
+
+	session := newFakeSession(context.Background())
+	assert.Nil(t, h.ConsumeClaim(session, newFakeClaim("orders.eu", 0, consumerMessage("orders.eu", 0, 0, "a"))))
+	assert.Nil(t, h.ConsumeClaim(session, newFakeClaim("orders.eu.retry.1m", 0, retried)))
+	assert.Nil(t, h.ConsumeClaim(session, newFakeClaim("orders.us", 0, consumerMessage("orders.us", 0, 0, "c"), replayed)))
+	assert.Equal(t, []string{"eu orders.eu", "eu orders.eu.retry.1m", "default orders.us", "default orders.us"}, routed)
+}
+
+func TestRefreshTopicsRestartSession(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	metadata := sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID())
+	for _, topic := range []string{"payments", "orders.eu", "orders.eu.retry.1m"} {
+		metadata.SetLeader(topic, 0, broker.BrokerID())
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{"MetadataRequest": metadata})
+
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer client.Close()
+
+	retry, err := newRetryPolicy(RetryConfig{Delays: []string{"1m"}})
+	assert.Nil(t, err)
+	s := &subscription{
+		group:         &consumerGroup{cfg: &Config{}, retry: retry},
+		ctx:           &ConsumerContext{Topics: []string{"payments"}},
+		pattern:       regexp.MustCompile(`^orders\.`),
+		topicsChanged: make(chan struct{}, 1),
+		metadata:      client,
+	}
+	s.refreshTopics()
+	assert.Equal(t, []string{"orders.eu", "payments", "orders.eu.retry.1m", "payments.retry.1m"}, s.currentTopics())
+
+	sessionCtx, endSession := context.WithCancel(context.Background())
+	session := newFakeSession(sessionCtx)
+	restarted := 0
+	s.restart = func() {
+		restarted++
+		endSession()
+	}
+
+	started := make(chan struct{})
+	var cancelled bool
+	h := NewConsumerHandler(func(ctx context.Context, _ *MessageDecoder) error {
+		close(started)
+		<-sessionCtx.Done()
+		select {
+		case <-ctx.Done():
+			cancelled = true
+		case <-time.After(50 * time.Millisecond):
+		}
+		return nil
+	}, false, "group").(*consumerHandler)
+	h.ctx = context.Background()
+	h.restarting = s.isRestarting
+
+	done := make(chan struct{})
+	go func() {
+		assert.Nil(t, h.ConsumeClaim(session, newFakeClaim("orders.eu", 0, consumerMessage("orders.eu", 0, 0, "a"))))
+		close(done)
+	}()
+	<-started
+
+	// orders.us is created without its retry tier
+	metadata.SetLeader("orders.us", 0, broker.BrokerID())
+	s.refreshTopics()
+	<-done
+
+	assert.Equal(t, 1, restarted)
+	assert.False(t, cancelled)
+	assert.Equal(t, int64(1), session.committed("orders.eu", 0))
+	assert.Equal(t, []string{"orders.eu", "orders.us", "payments", "orders.eu.retry.1m", "payments.retry.1m"}, s.currentTopics())
+
+	// the next session clear the restart
+	s.setup(newFakeSession(context.Background()))
+	assert.False(t, s.isRestarting())
+}
+
+func TestStopCloseRetryProducer(t *testing.T) {
+	k, err := newConsumerGroup(&Config{
+		Brokers:          []string{"127.0.0.1:1"},
+		ConnectBackoffMs: 10,
+		Consumer:         ConsumerConfig{Retry: RetryConfig{DeadLetter: true}},
+	})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	var producers []*producer
+	for i := 0; i < 2; i++ {
+		s := k.subscribe(&ConsumerContext{
+			Topics:  []string{"orders"},
+			GroupID: "billing",
+			Handler: func(context.Context, *MessageDecoder) error { return nil },
+		})
+		if !assert.NotNil(t, s.retryProducer) {
+			t.FailNow()
+		}
+		assert.Equal(t, Producer(s.retryProducer), s.handler.retry.producer)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		assert.Nil(t, s.stop(ctx))
+		cancel()
+
+		// closed with its metrics bridge
+		assert.Nil(t, s.retryProducer.metrics)
+		producers = append(producers, s.retryProducer)
+	}
+	// every subscription forward through a producer of its own
+	assert.NotSame(t, producers[0], producers[1])
+}
+
+// pausingGroup record the partitions paused and resumed on a consumer group
+type pausingGroup struct {
+	sarama.ConsumerGroup
+	calls []string
+}
+
+func (g *pausingGroup) Pause(partitions map[string][]int32) {
+	g.record("pause", partitions)
+}
+
+func (g *pausingGroup) Resume(partitions map[string][]int32) {
+	g.record("resume", partitions)
+}
+
+func (g *pausingGroup) record(op string, partitions map[string][]int32) {
+	for topic, ps := range partitions {
+		for _, p := range ps {
+			g.calls = append(g.calls, fmt.Sprintf("%s %s/%d", op, topic, p))
+		}
+	}
+}
+
+func TestSubscriptionHold(t *testing.T) {
+	client := &pausingGroup{}
+	s := &subscription{gate: newPauseGate(), held: map[topicPartition]int{}, client: client}
+
+	// the partition resume once the last holder release it
+	release1 := s.hold("delay.1s", 2)
+	release2 := s.hold("delay.1s", 2)
+	release1()
+	assert.Equal(t, []string{"pause delay.1s/2"}, client.calls)
+	release2()
+	assert.Equal(t, []string{"pause delay.1s/2", "resume delay.1s/2"}, client.calls)
+
+	// partitions paused by an operator stay paused
+	s.pause("delay.1s", 2)
+	client.calls = nil
+	s.hold("delay.1s", 2)()
+	assert.Empty(t, client.calls)
+}
@@ -3,6 +3,7 @@ package kafka
 
 import (
 	"context"
+	"regexp"
 	"time"
 
 	"github.com/IBM/sarama"
@@ -13,14 +14,83 @@ type Producer interface {
 	Publish(ctx context.Context, msg *MessageContext) error
 }
 
+// ProducerCloser represents kafka publisher holding a brokers connection
+// until Close
+type ProducerCloser interface {
+	Producer
+	Close() error
+}
+
+// TransactionalProducer represents kafka publisher sending messages and
+// consumer offsets atomically, messages published between BeginTxn and
+// Commit are visible to read committed consumers only once committed.
+type TransactionalProducer interface {
+	Producer
+	BeginTxn() error
+	Commit() error
+	Abort() error
+	// AddOffset add the offset after msg to the transaction, it is committed
+	// for groupID together with the transaction
+	AddOffset(msg *MessageDecoder, groupID string) error
+	Close() error
+}
+
 // Consumer represents a Sarama consumer consumer interface
 type Consumer interface {
 	Subscribe(*ConsumerContext)
 }
 
+// GroupConsumer represents consumer group with controlled lifecycle, Start
+// return once the group is joining and Stop wait in-flight handlers and
+// commit their offsets before leaving the group.
+type GroupConsumer interface {
+	Consumer
+	Start(*ConsumerContext) error
+	Stop(ctx context.Context) error
+	// Pause stop fetching partitions of topic, all assigned partitions when
+	// none given, without leaving the group
+	Pause(topic string, partitions ...int32)
+	Resume(topic string, partitions ...int32)
+	Health() ConsumerHealth
+}
+
+// PartitionConsumer represents consumer reading a partition from a given
+// position without joining a group, e.g. for replay tools
+type PartitionConsumer interface {
+	Consume(*PartitionContext) error
+	Close() error
+}
+
+// Admin represents kafka cluster administration
+type Admin interface {
+	CreateTopic(topic TopicConfig) error
+	DeleteTopic(topic string) error
+	DescribeTopics(topics ...string) ([]TopicDescription, error)
+	AddPartitions(topic string, count int32) error
+	AlterTopicConfig(topic string, configs map[string]string) error
+	// EnsureTopics create missing topics and expand the partitions of existing ones
+	EnsureTopics(topics ...TopicConfig) error
+	ListGroups() ([]GroupDescription, error)
+	DescribeGroups(groupIDs ...string) ([]GroupDescription, error)
+	ResetOffsets(groupID, topic string, offset int64) error
+	ResetOffsetsToTime(groupID, topic string, t time.Time) error
+	Close() error
+}
+
+// Serializer encode message values, e.g. schemaregistry.Serializer
+type Serializer interface {
+	Serialize(ctx context.Context, topic string, v interface{}) ([]byte, error)
+}
+
+// Deserializer decode message values, e.g. schemaregistry.Deserializer
+type Deserializer interface {
+	Deserialize(ctx context.Context, topic string, data []byte, out interface{}) error
+}
+
 type MessageContext struct {
 	Value     string
 	Key       []byte
+	Headers   map[string]string
 	LogId     interface{}
 	Topic     string
 	Partition int32
@@ -30,10 +100,37 @@ type MessageContext struct {
 }
 
 type ConsumerContext struct {
-	Handler MessageProcessorFunc
-	Topics  []string
-	GroupID string
-	Context context.Context
+	Handler Handler
+	// Handlers route messages of a topic to their own handler, other topics
+	// go to Handler. Messages of retry and dead letter topics are routed by
+	// their original topic.
+	Handlers map[string]Handler
+	// Middlewares wrap Handler and every Handlers in order, see Chain. They
+	// don't apply to BatchHandler.
+	Middlewares []Middleware
+	// BatchHandler receive messages in batches instead of Handler when set,
+	// see ConsumerConfig BatchSize and BatchTimeoutMs
+	BatchHandler BatchHandler
+	Topics       []string
+	// TopicPattern subscribe every topic matching the pattern in addition
+	// to Topics, topics created later are picked up on the next refresh,
+	// see ConsumerConfig PatternRefreshSecond
+	TopicPattern *regexp.Regexp
+	GroupID      string
+	Context      context.Context
+	// OffsetInitial override ConsumerConfig OffsetInitial for this
+	// subscription when sarama.OffsetOldest or sarama.OffsetNewest
+	OffsetInitial int64
+	// OnAssigned called with the claimed partitions when a session start
+	OnAssigned func(ctx context.Context, claims map[string][]int32)
+	// OnRevoked called with the released partitions once their in-flight
+	// messages are handled, before offsets are committed
+	OnRevoked func(ctx context.Context, claims map[string][]int32)
+}
+
+// HandlerFor return the handler of msg wrapped by Middlewares, see Handlers
+func (c *ConsumerContext) HandlerFor(msg *MessageDecoder) Handler {
+	return Chain(route(c.Handlers, c.Handler, msg), c.Middlewares...)
 }
 
 var balanceStrategies = map[string]sarama.BalanceStrategy{
@@ -0,0 +1,144 @@
+// Package dedup skip kafka messages already processed, making at-least-once
+// delivery idempotent for handlers.
+package dedup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lukmanlukmin/go-lib/kafka"
+	"github.com/lukmanlukmin/go-lib/log"
+)
+
+const (
+	logEventName = "KafkaDeduplicate"
+	// DefaultHeader header carrying the message ID set by producers
+	DefaultHeader = "x-message-id"
+)
+
+// ErrNoID returned by IDFunc when the message carry no usable ID
+var ErrNoID = errors.New("[dedup] message has no id")
+
+// IDFunc derive the identity of a message
+type IDFunc func(msg *kafka.MessageDecoder) (string, error)
+
+// HeaderID use the value of header name
+func HeaderID(name string) IDFunc {
+	return func(msg *kafka.MessageDecoder) (string, error) {
+		id := msg.Headers[name]
+		if id == "" {
+			return "", ErrNoID
+		}
+		return id, nil
+	}
+}
+
+// KeyOffsetID identify a message by its key and position in the partition,
+// catching redeliveries after rebalances but not duplicates published twice
+func KeyOffsetID(msg *kafka.MessageDecoder) (string, error) {
+	return fmt.Sprintf("%s/%d/%d/%s", msg.Topic, msg.Partition, msg.Offset, msg.Key), nil
+}
+
+// EnvelopeHashID use MessageMetadata.Hash of messages built with
+// kafka.BuildPayload, catching the same payload published twice
+func EnvelopeHashID(msg *kafka.MessageDecoder) (string, error) {
+	meta, err := msg.DecodeEnvelope(nil)
+	if err != nil {
+		return "", err
+	}
+	if meta.Hash == "" {
+		return "", ErrNoID
+	}
+	return meta.Event + "/" + meta.Hash, nil
+}
+
+// FirstOf use the first IDFunc returning an ID
+func FirstOf(fns ...IDFunc) IDFunc {
+	return func(msg *kafka.MessageDecoder) (string, error) {
+		err := ErrNoID
+		for _, fn := range fns {
+			var id string
+			if id, err = fn(msg); err == nil {
+				return id, nil
+			}
+		}
+		return "", err
+	}
+}
+
+// Store record processed message IDs
+type Store interface {
+	Exists(ctx context.Context, id string) (bool, error)
+	Mark(ctx context.Context, id string) error
+}
+
+// transactional store running the handler and Mark in one transaction
+type transactional interface {
+	transaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// Option configure Middleware
+type Option func(*options)
+
+type options struct {
+	id IDFunc
+}
+
+// WithID replace the default ID, the DefaultHeader falling back to KeyOffsetID
+func WithID(fn IDFunc) Option {
+	return func(o *options) {
+		o.id = fn
+	}
+}
+
+// Middleware return handler middleware calling next only for messages not
+// recorded in store yet, and recording them once next succeed. With a
+// SQLStore the record is written in the same transaction the handler joins
+// through database.BeginTransaction.
+func Middleware(store Store, opts ...Option) kafka.Middleware {
+	o := options{
+		id: FirstOf(HeaderID(DefaultHeader), KeyOffsetID),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return func(next kafka.Handler) kafka.Handler {
+		return func(ctx context.Context, msg *kafka.MessageDecoder) error {
+			id, err := o.id(msg)
+			if err != nil {
+				return fmt.Errorf("[dedup] derive message id got: %w", err)
+			}
+
+			handle := func(ctx context.Context) error {
+				seen, err := store.Exists(ctx, id)
+				if err != nil {
+					return fmt.Errorf("[dedup] lookup message %s got: %w", id, err)
+				}
+				if seen {
+					log.WithContext(ctx).WithFields(map[string]interface{}{
+						"event":  logEventName,
+						"topic":  msg.Topic,
+						"offset": msg.Offset,
+					}).Debug(fmt.Sprintf("skip duplicate message %s", id))
+					return nil
+				}
+
+				if err := next(ctx, msg); err != nil {
+					return err
+				}
+
+				if err := store.Mark(ctx, id); err != nil {
+					return fmt.Errorf("[dedup] record message %s got: %w", id, err)
+				}
+				return nil
+			}
+
+			if tx, ok := store.(transactional); ok {
+				return tx.transaction(ctx, handle)
+			}
+			return handle(ctx)
+		}
+	}
+}
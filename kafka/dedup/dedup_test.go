@@ -0,0 +1,58 @@
+package dedup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/lukmanlukmin/go-lib/cache/mem"
+	"github.com/lukmanlukmin/go-lib/kafka"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddlewareSkipDuplicates(t *testing.T) {
+	ctx := context.Background()
+	store := NewCacheStore(mem.NewMemoryCache(), "", 60)
+
+	calls := 0
+	fail := true
+	h := Middleware(store)(func(_ context.Context, _ *kafka.MessageDecoder) error {
+		calls++
+		if fail {
+			return errors.New("boom")
+		}
+		return nil
+	})
+
+	msg := &kafka.MessageDecoder{Topic: "orders", Offset: 1, Headers: map[string]string{DefaultHeader: "m-1"}}
+
+	// failed messages are not recorded
+	assert.NotNil(t, h(ctx, msg))
+	fail = false
+	assert.Nil(t, h(ctx, msg))
+	assert.Nil(t, h(ctx, msg))
+	assert.Equal(t, 2, calls)
+
+	// same id redelivered at another offset is skipped
+	assert.Nil(t, h(ctx, &kafka.MessageDecoder{Topic: "orders", Offset: 9, Headers: map[string]string{DefaultHeader: "m-1"}}))
+	assert.Equal(t, 2, calls)
+
+	// without header the position is used
+	assert.Nil(t, h(ctx, &kafka.MessageDecoder{Topic: "orders", Offset: 9}))
+	assert.Nil(t, h(ctx, &kafka.MessageDecoder{Topic: "orders", Offset: 9}))
+	assert.Equal(t, 3, calls)
+}
+
+func TestEnvelopeHashID(t *testing.T) {
+	env, err := kafka.BuildPayload(map[string]string{"id": "o-1"}, "order.created")
+	assert.Nil(t, err)
+	body, _ := json.Marshal(env)
+
+	id, err := EnvelopeHashID(&kafka.MessageDecoder{Body: body})
+	assert.Nil(t, err)
+	assert.Equal(t, "order.created/"+env.Metadata.Hash, id)
+
+	_, err = EnvelopeHashID(&kafka.MessageDecoder{Body: []byte(`{"data": 1}`)})
+	assert.ErrorIs(t, err, ErrNoID)
+}
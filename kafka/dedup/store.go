@@ -0,0 +1,117 @@
+package dedup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lukmanlukmin/go-lib/cache"
+	"github.com/lukmanlukmin/go-lib/database"
+)
+
+const (
+	defaultPrefix = "kafka-dedup:"
+	// DefaultTable default SQL store table name
+	DefaultTable = "kafka_processed_messages"
+)
+
+// CacheStore record processed IDs in a cache with expiration
+type CacheStore struct {
+	cache  cache.Cache
+	prefix string
+	ttl    int
+}
+
+// NewCacheStore return store keeping IDs in c for ttlSecond, duplicates
+// arriving after the TTL are processed again
+func NewCacheStore(c cache.Cache, prefix string, ttlSecond int) *CacheStore {
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	return &CacheStore{
+		cache:  c,
+		prefix: prefix,
+		ttl:    ttlSecond,
+	}
+}
+
+// Exists report whether id was recorded
+func (s *CacheStore) Exists(ctx context.Context, id string) (bool, error) {
+	return s.cache.Exist(ctx, s.prefix+id), nil
+}
+
+// Mark record id
+func (s *CacheStore) Mark(ctx context.Context, id string) error {
+	return s.cache.Set(ctx, s.prefix+id, 1, s.ttl)
+}
+
+// SQLStore record processed IDs in a table, see SQLSchema. IDs are stored
+// as their hex sha256 so any ID length fit the id column.
+type SQLStore struct {
+	db    *sqlx.DB
+	table string
+}
+
+// NewSQLStore return store recording IDs in table of db, DefaultTable when empty
+func NewSQLStore(db *sqlx.DB, table string) *SQLStore {
+	if table == "" {
+		table = DefaultTable
+	}
+	return &SQLStore{
+		db:    db,
+		table: table,
+	}
+}
+
+// SQLSchema return CREATE TABLE statement of the SQL store, valid for MySQL and Postgres
+func SQLSchema(table string) string {
+	if table == "" {
+		table = DefaultTable
+	}
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	id VARCHAR(255) NOT NULL PRIMARY KEY,
+	processed_at TIMESTAMP NOT NULL
+)`, table)
+}
+
+// querier return transaction in ctx or the database
+func (s *SQLStore) querier(ctx context.Context) database.SQLQueryExec {
+	if tx := database.GetTxFromContext(ctx); tx != nil {
+		return tx
+	}
+	return s.db
+}
+
+// Exists report whether id was recorded
+func (s *SQLStore) Exists(ctx context.Context, id string) (bool, error) {
+	q := s.querier(ctx)
+	var n int
+	err := q.GetContext(ctx, &n, q.Rebind(fmt.Sprintf(`SELECT COUNT(1) FROM %s WHERE id = ?`, s.table)), hashID(id))
+	return n > 0, err
+}
+
+// Mark record id
+func (s *SQLStore) Mark(ctx context.Context, id string) error {
+	q := s.querier(ctx)
+	_, err := q.ExecContext(ctx, q.Rebind(fmt.Sprintf(`INSERT INTO %s (id, processed_at) VALUES (?, ?)`, s.table)), hashID(id), time.Now().UTC())
+	return err
+}
+
+// Cleanup delete IDs recorded before olderThan ago
+func (s *SQLStore) Cleanup(ctx context.Context, olderThan time.Duration) error {
+	_, err := s.db.ExecContext(ctx, s.db.Rebind(fmt.Sprintf(`DELETE FROM %s WHERE processed_at < ?`, s.table)), time.Now().UTC().Add(-olderThan))
+	return err
+}
+
+// hashID return the stored form of id
+func hashID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *SQLStore) transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return database.BeginTransaction(ctx, s.db, fn)
+}
@@ -0,0 +1,34 @@
+package dedup
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLStoreLongID(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer sqlDB.Close()
+	store := NewSQLStore(sqlx.NewDb(sqlDB, "mysql"), "")
+	ctx := context.Background()
+
+	// KeyOffsetID of a key longer than the id column
+	id := "orders/0/" + strings.Repeat("k", 300) + "/42"
+	stored := hashID(id)
+	assert.Len(t, stored, 64)
+
+	mock.ExpectExec("INSERT INTO kafka_processed_messages").WithArgs(stored, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT COUNT\\(1\\) FROM kafka_processed_messages").WithArgs(stored).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	assert.Nil(t, store.Mark(ctx, id))
+	seen, err := store.Exists(ctx, id)
+	assert.Nil(t, err)
+	assert.True(t, seen)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,274 @@
+// Package kafka messaging broker
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lukmanlukmin/go-lib/log"
+)
+
+const (
+	// HeaderDelayTopic header naming the topic a delayed message is delivered to
+	HeaderDelayTopic = "x-delay-topic"
+	// HeaderDelayUntil header holding a delayed message in its delay topic
+	// until the time in unix milliseconds, it then move on to its topic or,
+	// when due after the longest bucket, to another bucket
+	HeaderDelayUntil = "x-delay-until"
+)
+
+const defaultDelayTopicPrefix = "delay"
+
+var defaultDelayBuckets = []string{"1s", "1m", "10m", "1h"}
+
+// delayBuckets delay topics ordered by ascending delay
+type delayBuckets struct {
+	delays []time.Duration
+	topics []string
+}
+
+func newDelayBuckets(cfg DelayConfig) (*delayBuckets, error) {
+	prefix := cfg.TopicPrefix
+	if prefix == "" {
+		prefix = defaultDelayTopicPrefix
+	}
+	buckets := cfg.Buckets
+	if len(buckets) == 0 {
+		buckets = defaultDelayBuckets
+	}
+
+	b := &delayBuckets{}
+	for _, s := range buckets {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay bucket %q: %w", s, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid delay bucket %q: must be positive", s)
+		}
+		b.delays = append(b.delays, d)
+		b.topics = append(b.topics, prefix+"."+s)
+	}
+
+	sort.Sort(b)
+	for i := 1; i < len(b.delays); i++ {
+		if b.delays[i] == b.delays[i-1] {
+			return nil, fmt.Errorf("duplicate delay bucket %s", b.delays[i])
+		}
+	}
+	return b, nil
+}
+
+func (b *delayBuckets) Len() int           { return len(b.delays) }
+func (b *delayBuckets) Less(i, j int) bool { return b.delays[i] < b.delays[j] }
+func (b *delayBuckets) Swap(i, j int) {
+	b.delays[i], b.delays[j] = b.delays[j], b.delays[i]
+	b.topics[i], b.topics[j] = b.topics[j], b.topics[i]
+}
+
+// bucket return the delay topic of a message due in remaining and how long
+// it is held there. Messages go to the shortest bucket not shorter than
+// remaining and are held until due, so they reach their topic in a single
+// hop. A message due sooner than the one ahead of it in its bucket wait at
+// most the gap to the next shorter bucket. Messages due after the longest
+// bucket are held for it and hop again.
+func (b *delayBuckets) bucket(remaining time.Duration) (string, time.Duration) {
+	i := sort.Search(len(b.delays), func(j int) bool {
+		return b.delays[j] >= remaining
+	})
+	if i == len(b.delays) {
+		i--
+		return b.topics[i], b.delays[i]
+	}
+	return b.topics[i], remaining
+}
+
+// publish publish msg to the delay topic it wait in until at, or to target
+// once at is reached
+func (b *delayBuckets) publish(ctx context.Context, producer Producer, msg *MessageContext, target string, at time.Time) error {
+	out := *msg
+	out.Headers = make(map[string]string, len(msg.Headers)+3)
+	for k, v := range msg.Headers {
+		out.Headers[k] = v
+	}
+
+	now := time.Now()
+	if !now.Before(at) {
+		out.Topic = target
+		delete(out.Headers, HeaderDeliverAt)
+		delete(out.Headers, HeaderDelayTopic)
+		delete(out.Headers, HeaderDelayUntil)
+		return producer.Publish(ctx, &out)
+	}
+
+	topic, hold := b.bucket(at.Sub(now))
+	out.Topic = topic
+	out.Headers[HeaderDeliverAt] = strconv.FormatInt(at.UnixMilli(), 10)
+	out.Headers[HeaderDelayTopic] = target
+	out.Headers[HeaderDelayUntil] = strconv.FormatInt(now.Add(hold).UnixMilli(), 10)
+	return producer.Publish(ctx, &out)
+}
+
+// headerTime return the time of a unix milliseconds header
+func headerTime(headers map[string]string, key string) (time.Time, error) {
+	ms, err := strconv.ParseInt(headers[key], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("header %s %q: %w", key, headers[key], err)
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// DelayProducer publish messages delivered to their topic later by a
+// Scheduler. Kafka can't hold messages, they wait in the delay topics of
+// DelayConfig instead.
+type DelayProducer struct {
+	producer Producer
+	buckets  *delayBuckets
+}
+
+// NewDelayProducer return producer publishing delayed messages through producer
+func NewDelayProducer(producer Producer, cfg DelayConfig) (*DelayProducer, error) {
+	buckets, err := newDelayBuckets(cfg)
+	if err != nil {
+		return nil, &ConfigError{Problems: []error{fmt.Errorf("delay: %w", err)}}
+	}
+	return &DelayProducer{producer: producer, buckets: buckets}, nil
+}
+
+// Publish publish msg to its topic once the time of its HeaderDeliverAt
+// header in unix milliseconds is reached, messages without the header are
+// published right away
+func (d *DelayProducer) Publish(ctx context.Context, msg *MessageContext) error {
+	if _, ok := msg.Headers[HeaderDeliverAt]; !ok {
+		return d.producer.Publish(ctx, msg)
+	}
+
+	at, err := headerTime(msg.Headers, HeaderDeliverAt)
+	if err != nil {
+		return fmt.Errorf("[kafka-publisher] topic %s got: %w", msg.Topic, err)
+	}
+	return d.buckets.publish(ctx, d.producer, msg, msg.Topic, at)
+}
+
+// PublishAt publish msg to its topic at t
+func (d *DelayProducer) PublishAt(ctx context.Context, msg *MessageContext, t time.Time) error {
+	return d.buckets.publish(ctx, d.producer, msg, msg.Topic, t)
+}
+
+// PublishAfter publish msg to its topic once delay elapsed
+func (d *DelayProducer) PublishAfter(ctx context.Context, msg *MessageContext, delay time.Duration) error {
+	return d.PublishAt(ctx, msg, time.Now().Add(delay))
+}
+
+// Topics return the delay topics, e.g. to add them to Config Topics
+func (d *DelayProducer) Topics() []string {
+	return append([]string(nil), d.buckets.topics...)
+}
+
+// Scheduler consume the delay topics and forward delayed messages to their
+// topic once due. The partition of a held message is paused until it is
+// due when consumer is a GroupConsumer of this package, the scheduler
+// consumer should run with Concurrency 1.
+type Scheduler struct {
+	consumer GroupConsumer
+	producer Producer
+	groupID  string
+	buckets  *delayBuckets
+}
+
+// NewScheduler return scheduler consuming the delay topics of cfg with
+// consumer as group groupID and forwarding messages through producer
+func NewScheduler(consumer GroupConsumer, producer Producer, groupID string, cfg DelayConfig) (*Scheduler, error) {
+	buckets, err := newDelayBuckets(cfg)
+	if err != nil {
+		return nil, &ConfigError{Problems: []error{fmt.Errorf("delay: %w", err)}}
+	}
+	return &Scheduler{
+		consumer: consumer,
+		producer: producer,
+		groupID:  groupID,
+		buckets:  buckets,
+	}, nil
+}
+
+// Run forward delayed messages until ctx is done. Held messages are not
+// waited on shutdown, they stay uncommitted and are held again by the next
+// owner of their partition.
+func (s *Scheduler) Run(ctx context.Context) error {
+	err := s.consumer.Start(&ConsumerContext{
+		Handler: s.handle,
+		Topics:  s.buckets.topics,
+		GroupID: s.groupID,
+		Context: context.WithoutCancel(ctx),
+	})
+	if err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+
+	stopCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.consumer.Stop(stopCtx); err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+// handle hold msg until its HeaderDelayUntil time with its partition
+// paused, then forward it to its topic or a shorter delay topic
+func (s *Scheduler) handle(ctx context.Context, msg *MessageDecoder) error {
+	lf := map[string]interface{}{
+		"event":     logEventEventName,
+		"topic":     msg.Topic,
+		"partition": msg.Partition,
+		"offset":    msg.Offset,
+	}
+
+	target := msg.Headers[HeaderDelayTopic]
+	at, err := headerTime(msg.Headers, HeaderDeliverAt)
+	if target == "" || err != nil {
+		log.WithContext(ctx).WithFields(lf).Error(fmt.Sprintf("drop delayed message without %s or %s header", HeaderDelayTopic, HeaderDeliverAt))
+		return nil
+	}
+
+	if until, err := headerTime(msg.Headers, HeaderDelayUntil); err == nil {
+		if wait := time.Until(until); wait > 0 {
+			if err := s.hold(ctx, msg, wait); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.buckets.publish(ctx, s.producer, &MessageContext{
+		Value:   string(msg.Body),
+		Key:     msg.Key,
+		Headers: msg.Headers,
+	}, target, at)
+}
+
+// hold pause the partition of msg for wait through the hold of its
+// consumer, messages behind msg are not fetched meanwhile. A partition
+// already paused, e.g. by an operator, is left paused. The wait end early
+// with the session of msg, which is then held again by the next session.
+func (s *Scheduler) hold(ctx context.Context, msg *MessageDecoder, wait time.Duration) error {
+	if msg.hold != nil {
+		defer msg.hold(msg.Topic, msg.Partition)()
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-msg.session:
+		return errSessionEnded
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,169 @@
+package kafka
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeGroupConsumer consumer the scheduler never start
+type fakeGroupConsumer struct{}
+
+func (c *fakeGroupConsumer) Subscribe(*ConsumerContext)   {}
+func (c *fakeGroupConsumer) Start(*ConsumerContext) error { return nil }
+func (c *fakeGroupConsumer) Stop(context.Context) error   { return nil }
+func (c *fakeGroupConsumer) Health() ConsumerHealth       { return ConsumerHealth{} }
+func (c *fakeGroupConsumer) Pause(string, ...int32)       {}
+func (c *fakeGroupConsumer) Resume(string, ...int32)      {}
+
+func unixMilli(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+func TestDelayBuckets(t *testing.T) {
+	b, err := newDelayBuckets(DelayConfig{Buckets: []string{"1h", "1s", "1m"}, TopicPrefix: "reminders.delay"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"reminders.delay.1s", "reminders.delay.1m", "reminders.delay.1h"}, b.topics)
+
+	for remaining, want := range map[time.Duration]struct {
+		topic string
+		hold  time.Duration
+	}{
+		500 * time.Millisecond: {"reminders.delay.1s", 500 * time.Millisecond},
+		time.Minute:            {"reminders.delay.1m", time.Minute},
+		90 * time.Second:       {"reminders.delay.1h", 90 * time.Second},
+		3 * time.Hour:          {"reminders.delay.1h", time.Hour},
+	} {
+		topic, hold := b.bucket(remaining)
+		assert.Equal(t, want.topic, topic)
+		assert.Equal(t, want.hold, hold)
+	}
+
+	// bucket hops until due
+	hops := func(remaining time.Duration) int {
+		n := 0
+		for remaining > 0 {
+			_, hold := b.bucket(remaining)
+			remaining -= hold
+			n++
+		}
+		return n
+	}
+	assert.Equal(t, 1, hops(59*time.Second))
+	assert.Equal(t, 1, hops(59*time.Minute))
+	assert.Equal(t, 3, hops(2*time.Hour+time.Second))
+
+	_, err = NewDelayProducer(&fakeProducer{}, DelayConfig{Buckets: []string{"1m", "60s"}})
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+	_, err = NewScheduler(&fakeGroupConsumer{}, &fakeProducer{}, "scheduler", DelayConfig{Buckets: []string{"soon"}})
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+}
+
+func TestDelayProducer(t *testing.T) {
+	inner := &fakeProducer{}
+	p, err := NewDelayProducer(inner, DelayConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"delay.1s", "delay.1m", "delay.10m", "delay.1h"}, p.Topics())
+
+	ctx := context.Background()
+	assert.Nil(t, p.PublishAfter(ctx, &MessageContext{Topic: "reminders", Value: "r-1"}, 30*time.Minute))
+	assert.Nil(t, p.Publish(ctx, &MessageContext{Topic: "reminders", Value: "r-2"}))
+	assert.Nil(t, p.Publish(ctx, &MessageContext{Topic: "reminders", Value: "r-3", Headers: map[string]string{
+		HeaderDeliverAt: unixMilli(time.Now().Add(-time.Second)),
+	}}))
+	assert.NotNil(t, p.Publish(ctx, &MessageContext{Topic: "reminders", Headers: map[string]string{HeaderDeliverAt: "soon"}}))
+
+	if assert.Len(t, inner.published, 3) {
+		delayed := inner.published[0]
+		assert.Equal(t, "delay.1h", delayed.Topic)
+		assert.Equal(t, "reminders", delayed.Headers[HeaderDelayTopic])
+		assert.NotEmpty(t, delayed.Headers[HeaderDeliverAt])
+		assert.NotEmpty(t, delayed.Headers[HeaderDelayUntil])
+
+		assert.Equal(t, "reminders", inner.published[1].Topic)
+		assert.Equal(t, "reminders", inner.published[2].Topic)
+		assert.Empty(t, inner.published[2].Headers)
+	}
+}
+
+func TestSchedulerHandle(t *testing.T) {
+	producer := &fakeProducer{}
+	s, err := NewScheduler(&fakeGroupConsumer{}, producer, "scheduler", DelayConfig{})
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	now := time.Now()
+
+	var calls []string
+	hold := func(topic string, partition int32) func() {
+		calls = append(calls, "hold "+topic+"/"+strconv.Itoa(int(partition)))
+		return func() { calls = append(calls, "release "+topic+"/"+strconv.Itoa(int(partition))) }
+	}
+
+	// held with its partition paused until due, then delivered
+	start := time.Now()
+	assert.Nil(t, s.handle(ctx, &MessageDecoder{Topic: "delay.1s", Partition: 2, Key: []byte("k"), Body: []byte("r-1"), hold: hold, Headers: map[string]string{
+		HeaderDelayTopic: "reminders",
+		HeaderDeliverAt:  unixMilli(now.Add(30 * time.Millisecond)),
+		HeaderDelayUntil: unixMilli(now.Add(30 * time.Millisecond)),
+		"tenant":         "acme",
+	}}))
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	assert.Equal(t, []string{"hold delay.1s/2", "release delay.1s/2"}, calls)
+
+	// not due yet after its bucket hold, moved on to the bucket holding it
+	// until due
+	assert.Nil(t, s.handle(ctx, &MessageDecoder{Topic: "delay.1h", Body: []byte("r-2"), hold: hold, Headers: map[string]string{
+		HeaderDelayTopic: "reminders",
+		HeaderDeliverAt:  unixMilli(now.Add(5 * time.Minute)),
+		HeaderDelayUntil: unixMilli(now.Add(-time.Second)),
+	}}))
+
+	// without target it is dropped
+	assert.Nil(t, s.handle(ctx, &MessageDecoder{Topic: "delay.1m", Body: []byte("r-3")}))
+
+	if assert.Len(t, producer.published, 2) {
+		delivered := producer.published[0]
+		assert.Equal(t, "reminders", delivered.Topic)
+		assert.Equal(t, "k", string(delivered.Key))
+		assert.Equal(t, map[string]string{"tenant": "acme"}, delivered.Headers)
+
+		assert.Equal(t, "delay.10m", producer.published[1].Topic)
+		assert.Equal(t, "reminders", producer.published[1].Headers[HeaderDelayTopic])
+	}
+	// a message already past its bucket hold is not held
+	assert.Len(t, calls, 2)
+
+	// consumers without hold only wait
+	assert.Nil(t, s.handle(ctx, &MessageDecoder{Topic: "delay.1s", Partition: 2, Body: []byte("r-4"), Headers: map[string]string{
+		HeaderDelayTopic: "reminders",
+		HeaderDeliverAt:  unixMilli(now),
+		HeaderDelayUntil: unixMilli(time.Now().Add(10 * time.Millisecond)),
+	}}))
+	assert.Len(t, producer.published, 3)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = s.handle(cancelled, &MessageDecoder{Topic: "delay.1h", Headers: map[string]string{
+		HeaderDelayTopic: "reminders",
+		HeaderDeliverAt:  unixMilli(now.Add(time.Hour)),
+		HeaderDelayUntil: unixMilli(now.Add(time.Hour)),
+	}})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, producer.published, 3)
+
+	// a session ended to restart end the hold, the message stay for the
+	// next session
+	ended := make(chan struct{})
+	close(ended)
+	err = s.handle(ctx, &MessageDecoder{Topic: "delay.1h", session: ended, Headers: map[string]string{
+		HeaderDelayTopic: "reminders",
+		HeaderDeliverAt:  unixMilli(now.Add(time.Hour)),
+		HeaderDelayUntil: unixMilli(now.Add(time.Hour)),
+	}})
+	assert.ErrorIs(t, err, errSessionEnded)
+	assert.Len(t, producer.published, 3)
+}
@@ -0,0 +1,224 @@
+// Package kafka messaging
+package kafka
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Envelope verification errors
+var (
+	ErrHashMissing       = errors.New("[kafka] envelope hash missing")
+	ErrHashMismatch      = errors.New("[kafka] envelope hash mismatch")
+	ErrSignatureMissing  = errors.New("[kafka] envelope signature missing")
+	ErrSignatureMismatch = errors.New("[kafka] envelope signature mismatch")
+)
+
+// EnvelopeOption configure DecodeEnvelope
+type EnvelopeOption func(*envelopeOptions)
+
+type envelopeOptions struct {
+	verifyKey []byte
+}
+
+// WithVerifyKey require the envelope to carry its hash and to be signed with
+// the shared key
+func WithVerifyKey(key []byte) EnvelopeOption {
+	return func(o *envelopeOptions) {
+		o.verifyKey = key
+	}
+}
+
+type rawMessageFormat struct {
+	Data     json.RawMessage `json:"data,omitempty"`
+	Metadata MessageMetadata `json:"metadata,omitempty"`
+}
+
+// DecodeEnvelope decode MessageFormat built by BuildPayload, verify the
+// data hash and signature then decode data into out
+func (decoder *MessageDecoder) DecodeEnvelope(out interface{}, opts ...EnvelopeOption) (*MessageMetadata, error) {
+	o := envelopeOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var env rawMessageFormat
+	if err := json.Unmarshal(decoder.Body, &env); err != nil {
+		return nil, fmt.Errorf("[kafka] decode envelope got: %w", err)
+	}
+
+	// nil data is left out of the envelope, BuildPayload hashed it as null
+	raw := env.Data
+	if len(raw) == 0 {
+		raw = json.RawMessage("null")
+	}
+
+	// hash is computed on compact data, like json.Marshal produce it
+	data := new(bytes.Buffer)
+	if err := json.Compact(data, raw); err != nil {
+		return nil, fmt.Errorf("[kafka] decode envelope data got: %w", err)
+	}
+
+	if env.Metadata.Hash == "" && len(o.verifyKey) > 0 {
+		return &env.Metadata, ErrHashMissing
+	}
+	if env.Metadata.Hash != "" && env.Metadata.Hash != hashPayload(data.Bytes()) {
+		return &env.Metadata, ErrHashMismatch
+	}
+
+	if len(o.verifyKey) > 0 {
+		if env.Metadata.Signature == "" {
+			return &env.Metadata, ErrSignatureMissing
+		}
+		sig, err := base64.StdEncoding.DecodeString(env.Metadata.Signature)
+		if err != nil {
+			return &env.Metadata, ErrSignatureMismatch
+		}
+		expected, _ := base64.StdEncoding.DecodeString(signPayload(signedPayload(data.Bytes(), env.Metadata), o.verifyKey))
+		if !hmac.Equal(sig, expected) {
+			return &env.Metadata, ErrSignatureMismatch
+		}
+	}
+
+	if out != nil && len(env.Data) > 0 {
+		if err := json.Unmarshal(env.Data, out); err != nil {
+			return &env.Metadata, fmt.Errorf("[kafka] decode envelope data got: %w", err)
+		}
+	}
+
+	return &env.Metadata, nil
+}
+
+// CloudEvents 1.0 kafka protocol binding
+const (
+	cloudEventsSpecVersion    = "1.0"
+	cloudEventsContentType    = "application/cloudevents+json"
+	cloudEventsHeaderPrefix   = "ce_"
+	headerContentType         = "content-type"
+	cloudEventsDataJSON       = "application/json"
+	cloudEventsHeaderSpec     = cloudEventsHeaderPrefix + "specversion"
+	cloudEventsHeaderID       = cloudEventsHeaderPrefix + "id"
+	cloudEventsHeaderSource   = cloudEventsHeaderPrefix + "source"
+	cloudEventsHeaderType     = cloudEventsHeaderPrefix + "type"
+	cloudEventsHeaderSubject  = cloudEventsHeaderPrefix + "subject"
+	cloudEventsHeaderTime     = cloudEventsHeaderPrefix + "time"
+	cloudEventsHeaderDataType = cloudEventsHeaderPrefix + "datacontenttype"
+)
+
+// CloudEvent CloudEvents 1.0 envelope with JSON data
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+}
+
+// NewCloudEvent return event of eventType emitted by source carrying data as JSON
+func NewCloudEvent(eventType, source string, data interface{}) (*CloudEvent, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return &CloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              uuid.NewString(),
+		Source:          source,
+		Type:            eventType,
+		Time:            time.Now().UTC(),
+		DataContentType: cloudEventsDataJSON,
+		Data:            b,
+	}, nil
+}
+
+// Structured return message carrying the whole event as JSON value
+func (e *CloudEvent) Structured(topic string) (*MessageContext, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return &MessageContext{
+		Topic:   topic,
+		Value:   string(b),
+		Headers: map[string]string{headerContentType: cloudEventsContentType},
+	}, nil
+}
+
+// Binary return message carrying event attributes as `ce_` headers and data as value
+func (e *CloudEvent) Binary(topic string) *MessageContext {
+	headers := map[string]string{
+		cloudEventsHeaderSpec:   e.SpecVersion,
+		cloudEventsHeaderID:     e.ID,
+		cloudEventsHeaderSource: e.Source,
+		cloudEventsHeaderType:   e.Type,
+		cloudEventsHeaderTime:   e.Time.Format(time.RFC3339Nano),
+	}
+	if e.Subject != "" {
+		headers[cloudEventsHeaderSubject] = e.Subject
+	}
+	if e.DataContentType != "" {
+		headers[headerContentType] = e.DataContentType
+	}
+	return &MessageContext{
+		Topic:   topic,
+		Value:   string(e.Data),
+		Headers: headers,
+	}
+}
+
+// DecodeCloudEvent decode a structured or binary mode CloudEvent and its
+// JSON data into out
+func (decoder *MessageDecoder) DecodeCloudEvent(out interface{}) (*CloudEvent, error) {
+	var e CloudEvent
+
+	switch {
+	case strings.HasPrefix(decoder.Headers[headerContentType], cloudEventsContentType):
+		if err := json.Unmarshal(decoder.Body, &e); err != nil {
+			return nil, fmt.Errorf("[kafka] decode cloud event got: %w", err)
+		}
+	case decoder.Headers[cloudEventsHeaderSpec] != "":
+		e = CloudEvent{
+			SpecVersion:     decoder.Headers[cloudEventsHeaderSpec],
+			ID:              decoder.Headers[cloudEventsHeaderID],
+			Source:          decoder.Headers[cloudEventsHeaderSource],
+			Type:            decoder.Headers[cloudEventsHeaderType],
+			Subject:         decoder.Headers[cloudEventsHeaderSubject],
+			DataContentType: decoder.Headers[headerContentType],
+			Data:            decoder.Body,
+		}
+		if e.DataContentType == "" {
+			e.DataContentType = decoder.Headers[cloudEventsHeaderDataType]
+		}
+		if t := decoder.Headers[cloudEventsHeaderTime]; t != "" {
+			ts, err := time.Parse(time.RFC3339Nano, t)
+			if err != nil {
+				return nil, fmt.Errorf("[kafka] decode cloud event time got: %w", err)
+			}
+			e.Time = ts
+		}
+	default:
+		return nil, fmt.Errorf("[kafka] message is not a cloud event")
+	}
+
+	if e.SpecVersion != cloudEventsSpecVersion {
+		return nil, fmt.Errorf("[kafka] unsupported cloud event spec version %q", e.SpecVersion)
+	}
+
+	if out != nil && len(e.Data) > 0 {
+		if err := json.Unmarshal(e.Data, out); err != nil {
+			return &e, fmt.Errorf("[kafka] decode cloud event data got: %w", err)
+		}
+	}
+	return &e, nil
+}
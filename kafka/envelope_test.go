@@ -0,0 +1,94 @@
+package kafka
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeEnvelope(t *testing.T) {
+	key := []byte("shared")
+	env, err := BuildPayload(orderCreated{ID: "o-1", Amount: 2}, "order.created", WithSigningKey(key))
+	assert.Nil(t, err)
+	body, err := json.Marshal(env)
+	assert.Nil(t, err)
+
+	var out orderCreated
+	meta, err := (&MessageDecoder{Body: body}).DecodeEnvelope(&out, WithVerifyKey(key))
+	assert.Nil(t, err)
+	assert.Equal(t, orderCreated{ID: "o-1", Amount: 2}, out)
+	assert.Equal(t, "order.created", meta.Event)
+	assert.NotEmpty(t, meta.EmitHost)
+
+	_, err = (&MessageDecoder{Body: body}).DecodeEnvelope(nil, WithVerifyKey([]byte("other")))
+	assert.ErrorIs(t, err, ErrSignatureMismatch)
+
+	// tampered metadata fail the signature check
+	tampered := *env
+	tampered.Metadata.Event = "order.cancelled"
+	body, _ = json.Marshal(tampered)
+	_, err = (&MessageDecoder{Body: body}).DecodeEnvelope(nil, WithVerifyKey(key))
+	assert.ErrorIs(t, err, ErrSignatureMismatch)
+
+	// a verified envelope must carry its hash
+	tampered = *env
+	tampered.Metadata.Hash = ""
+	body, _ = json.Marshal(tampered)
+	_, err = (&MessageDecoder{Body: body}).DecodeEnvelope(nil, WithVerifyKey(key))
+	assert.ErrorIs(t, err, ErrHashMissing)
+
+	// tampered data fail the hash check
+	env.Data = orderCreated{ID: "o-1", Amount: 200}
+	body, _ = json.Marshal(env)
+	_, err = (&MessageDecoder{Body: body}).DecodeEnvelope(&out)
+	assert.ErrorIs(t, err, ErrHashMismatch)
+}
+
+func TestDecodeEnvelopeNilData(t *testing.T) {
+	key := []byte("shared")
+	env, err := BuildPayload(nil, "heartbeat", WithSigningKey(key))
+	assert.Nil(t, err)
+	body, _ := json.Marshal(env)
+
+	var out map[string]interface{}
+	meta, err := (&MessageDecoder{Body: body}).DecodeEnvelope(&out, WithVerifyKey(key))
+	assert.Nil(t, err)
+	assert.Equal(t, "heartbeat", meta.Event)
+	assert.Nil(t, out)
+}
+
+func TestDecodeEnvelopeUnsigned(t *testing.T) {
+	env, err := BuildPayload(map[string]int{"n": 1}, "counted")
+	assert.Nil(t, err)
+	body, _ := json.Marshal(env)
+
+	_, err = (&MessageDecoder{Body: body}).DecodeEnvelope(nil)
+	assert.Nil(t, err)
+
+	_, err = (&MessageDecoder{Body: body}).DecodeEnvelope(nil, WithVerifyKey([]byte("k")))
+	assert.ErrorIs(t, err, ErrSignatureMissing)
+}
+
+func TestCloudEventModes(t *testing.T) {
+	event, err := NewCloudEvent("order.created", "/orders", orderCreated{ID: "o-9"})
+	assert.Nil(t, err)
+
+	structured, err := event.Structured("orders")
+	assert.Nil(t, err)
+	binary := event.Binary("orders")
+
+	for _, msg := range []*MessageContext{structured, binary} {
+		var out orderCreated
+		decoded, err := (&MessageDecoder{Body: []byte(msg.Value), Headers: msg.Headers}).DecodeCloudEvent(&out)
+		assert.Nil(t, err)
+		assert.Equal(t, "o-9", out.ID)
+		assert.Equal(t, event.ID, decoded.ID)
+		assert.Equal(t, "order.created", decoded.Type)
+		assert.Equal(t, "/orders", decoded.Source)
+		assert.True(t, event.Time.Equal(decoded.Time))
+	}
+
+	_, err = (&MessageDecoder{Body: []byte("{}")}).DecodeCloudEvent(nil)
+	assert.NotNil(t, err)
+}
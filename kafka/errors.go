@@ -0,0 +1,50 @@
+// Package kafka messaging broker
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrInvalidConfig matched by errors.Is on every ConfigError
+	ErrInvalidConfig = errors.New("[kafka] invalid config")
+	// ErrConnection matched by errors.Is on every ConnectionError
+	ErrConnection = errors.New("[kafka] broker connection failed")
+)
+
+// ConfigError every problem found in a Config, see Config.Validate
+type ConfigError struct {
+	Problems []error
+}
+
+func (e *ConfigError) Error() string {
+	msgs := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		msgs = append(msgs, p.Error())
+	}
+	return fmt.Sprintf("%s: %s", ErrInvalidConfig.Error(), strings.Join(msgs, "; "))
+}
+
+// Unwrap expose ErrInvalidConfig and each problem to errors.Is and errors.As
+func (e *ConfigError) Unwrap() []error {
+	return append([]error{ErrInvalidConfig}, e.Problems...)
+}
+
+// ConnectionError failed attempts to connect the brokers, returned once the
+// context given to the operation waiting for the connection is done
+type ConnectionError struct {
+	Brokers  []string
+	Attempts int
+	Err      error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("%s: brokers %v after %d attempts: %v", ErrConnection.Error(), e.Brokers, e.Attempts, e.Err)
+}
+
+// Unwrap expose ErrConnection and the last attempt error to errors.Is and errors.As
+func (e *ConnectionError) Unwrap() []error {
+	return []error{ErrConnection, e.Err}
+}
@@ -0,0 +1,165 @@
+// Package kafka messaging
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"github.com/lukmanlukmin/go-lib/log"
+)
+
+const (
+	defaultBatchSize    = 100
+	defaultBatchTimeout = time.Second
+)
+
+// consumeBatch accumulate claim messages up to batchSize or batchTimeout
+// after the first message of the batch, whichever come first, and deliver
+// them to the batch handler. The last offset of a batch is marked only once
+// the handler succeed.
+func (c *consumerHandler) consumeBatch(ctx context.Context, session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	timer := time.NewTimer(c.batchTimeout)
+	timer.Stop()
+	defer timer.Stop()
+
+	batch := make([]*sarama.ConsumerMessage, 0, c.batchSize)
+	flush := func() {
+		timer.Stop()
+		if len(batch) == 0 {
+			return
+		}
+		c.handleBatch(ctx, session, batch)
+		batch = make([]*sarama.ConsumerMessage, 0, c.batchSize)
+	}
+
+	for {
+		if c.stopped() {
+			flush()
+			return nil
+		}
+
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				flush()
+				return nil
+			}
+
+			if !c.gate.wait(session.Context(), c.stopping, msg.Topic, msg.Partition) {
+				flush()
+				return nil
+			}
+
+			if c.autoCommit {
+				session.MarkMessage(msg, "")
+			}
+
+			batch = append(batch, msg)
+			if len(batch) == 1 {
+				timer.Reset(c.batchTimeout)
+			}
+			if len(batch) >= c.batchSize {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		case <-session.Context().Done():
+			return nil
+		case <-c.stopping:
+			flush()
+			return nil
+		}
+	}
+}
+
+// handleBatch decode msgs and process them within a single consumer span
+func (c *consumerHandler) handleBatch(ctx context.Context, session sarama.ConsumerGroupSession, msgs []*sarama.ConsumerMessage) {
+	headers := make([]map[string]string, len(msgs))
+	for i, msg := range msgs {
+		headers[i] = headerMap(msg.Headers)
+	}
+
+	ctx, span := startBatchSpan(ctx, msgs, c.groupID, headers)
+
+	size := 0
+	for _, msg := range msgs {
+		size += len(msg.Value)
+	}
+	recordReceive(ctx, msgs[0].Topic, c.groupID, len(msgs), size)
+
+	decoders := make([]*MessageDecoder, len(msgs))
+	for i, msg := range msgs {
+		decoders[i] = &MessageDecoder{
+			Body:      msg.Value,
+			Key:       msg.Key,
+			Headers:   headers[i],
+			Partition: msg.Partition,
+			TimeStamp: msg.Timestamp,
+			Offset:    msg.Offset,
+			Topic:     msg.Topic,
+			Commit: func(m *MessageDecoder) {
+				session.MarkOffset(m.Topic, m.Partition, m.Offset+1, "")
+			},
+			ctx:     ctx,
+			session: session.Context().Done(),
+			hold:    c.hold,
+		}
+	}
+
+	err := c.processBatch(ctx, decoders)
+	endSpan(span, err)
+
+	if err == nil && !c.autoCommit {
+		session.MarkMessage(msgs[len(msgs)-1], "")
+	}
+}
+
+// processBatch call batch handler until it succeed with the same backoff as
+// single messages. Once in-place attempts are exhausted every message of the
+// batch is forwarded to the next retry tier or dead letter topic.
+func (c *consumerHandler) processBatch(ctx context.Context, msgs []*MessageDecoder) error {
+	for _, msg := range msgs {
+		if err := c.retry.wait(ctx, c.stopping, msg); err != nil {
+			return err
+		}
+	}
+
+	backoff := c.retry.backoffInitial
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := c.batchHandler(ctx, msgs)
+		recordProcess(ctx, msgs[0].Topic, c.groupID, start, err)
+		if err == nil {
+			return nil
+		}
+
+		if c.retry.exhausted(attempt) {
+			for _, msg := range msgs {
+				if ferr := c.retry.forward(ctx, msg, err); ferr != nil {
+					return ferr
+				}
+			}
+			return nil
+		}
+
+		first, last := msgs[0], msgs[len(msgs)-1]
+		log.WithContext(ctx).WithFields(map[string]interface{}{
+			"event":     logEventEventName,
+			"topic":     first.Topic,
+			"partition": first.Partition,
+			"offset":    fmt.Sprintf("%d-%d", first.Offset, last.Offset),
+			"attempt":   attempt,
+		}).Warn(fmt.Sprintf("handle batch failed, retry in %s: %s", backoff, err.Error()))
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("handle batch cancelled after %d attempts: %w", attempt, err)
+		case <-time.After(backoff):
+		}
+
+		backoff = c.retry.nextBackoff(backoff)
+	}
+}
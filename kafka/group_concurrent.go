@@ -0,0 +1,95 @@
+// Package kafka messaging
+package kafka
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+const (
+	// workerQueueSize messages buffered per worker before dispatch blocks
+	workerQueueSize = 16
+)
+
+// consumeConcurrent process claim messages on a pool of workers. Messages
+// with the same key always go to the same worker so their order is kept,
+// and offsets are marked only up to the lowest contiguous completed offset
+// so a crash never skip an unprocessed message.
+func (c *consumerHandler) consumeConcurrent(ctx context.Context, session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	tracker := newOffsetTracker()
+	mark := func(next int64) {
+		session.MarkOffset(claim.Topic(), claim.Partition(), next, "")
+	}
+	commit := func(m *MessageDecoder) {
+		tracker.complete(m.Offset, mark)
+	}
+
+	var wg sync.WaitGroup
+	workers := make([]chan *sarama.ConsumerMessage, c.concurrency)
+	for i := range workers {
+		workers[i] = make(chan *sarama.ConsumerMessage, workerQueueSize)
+		wg.Add(1)
+		go func(queue <-chan *sarama.ConsumerMessage) {
+			defer wg.Done()
+			for msg := range queue {
+				if err := c.handle(ctx, session, msg, commit); err == nil && !c.autoCommit {
+					tracker.complete(msg.Offset, mark)
+				}
+			}
+		}(workers[i])
+	}
+
+	// wait in-flight messages before the claim is released
+	defer func() {
+		for _, w := range workers {
+			close(w)
+		}
+		wg.Wait()
+	}()
+
+	for {
+		if c.stopped() {
+			return nil
+		}
+
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+
+			if !c.gate.wait(session.Context(), c.stopping, msg.Topic, msg.Partition) {
+				return nil
+			}
+
+			if c.autoCommit {
+				session.MarkMessage(msg, "")
+			} else {
+				tracker.add(msg.Offset)
+			}
+
+			select {
+			case workers[c.worker(msg)] <- msg:
+			case <-session.Context().Done():
+				return nil
+			}
+		case <-session.Context().Done():
+			return nil
+		case <-c.stopping:
+			return nil
+		}
+	}
+}
+
+// worker pick worker index by message key, keyless messages are spread by offset
+func (c *consumerHandler) worker(msg *sarama.ConsumerMessage) int {
+	if len(msg.Key) == 0 {
+		return int(msg.Offset % int64(c.concurrency))
+	}
+	h := fnv.New32a()
+	_, _ = h.Write(msg.Key)
+	return int(h.Sum32() % uint32(c.concurrency))
+}
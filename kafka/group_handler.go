@@ -3,32 +3,82 @@
 package kafka
 
 import (
+	"context"
+	"fmt"
+	"time"
+
 	"github.com/IBM/sarama"
+
+	"github.com/lukmanlukmin/go-lib/log"
+)
+
+const (
+	// retryBackoffInitial first wait before a failed message is handled again
+	retryBackoffInitial = 100 * time.Millisecond
+	// retryBackoffMax upper bound of wait between handler attempts
+	retryBackoffMax = 10 * time.Second
 )
 
 // Consumer represents a Sarama consumer group consumer
 type consumerHandler struct {
-	msgProcessor MessageProcessorFunc
-	autoCommit   bool
-	groupID      string
+	handler Handler
+	// handlers route topics to their own handler, see ConsumerContext Handlers
+	handlers   map[string]Handler
+	autoCommit bool
+	groupID    string
+	retry      *retryPolicy
+	// concurrency number of workers per claim, 0 or 1 process sequentially
+	concurrency int
+	// batchHandler replace handler when set, see consumeBatch
+	batchHandler BatchHandler
+	batchSize    int
+	batchTimeout time.Duration
+	// stopping closed when the consumer stop gracefully, claims finish the
+	// message in hand and return
+	stopping <-chan struct{}
+	// ctx parent of handler contexts, cancelled when Stop give up waiting.
+	// Handlers use the session context when nil.
+	ctx context.Context
+	// restarting report whether the session is ended to rejoin with new topics
+	restarting func() bool
+	// gate hold paused partitions
+	gate *pauseGate
+	// hold pause fetching a partition while a retry tier message wait
+	hold holdFunc
+	// onSetup and onCleanup observe session lifecycle
+	onSetup   func(sarama.ConsumerGroupSession)
+	onCleanup func(sarama.ConsumerGroupSession)
 }
 
-// NewConsumerHandler return consumer handler
-func NewConsumerHandler(msgProcessor MessageProcessorFunc, autoCommit bool, groupID string) sarama.ConsumerGroupHandler {
+// NewConsumerHandler return consumer handler retrying failed messages in place
+func NewConsumerHandler(handler Handler, autoCommit bool, groupID string) sarama.ConsumerGroupHandler {
+	retry, _ := newRetryPolicy(RetryConfig{})
+	return newConsumerHandler(handler, autoCommit, groupID, retry)
+}
+
+func newConsumerHandler(handler Handler, autoCommit bool, groupID string, retry *retryPolicy) *consumerHandler {
 	return &consumerHandler{
-		msgProcessor: msgProcessor,
-		autoCommit:   autoCommit,
-		groupID:      groupID,
+		handler:    handler,
+		autoCommit: autoCommit,
+		groupID:    groupID,
+		retry:      retry,
 	}
 }
 
 // Setup is run at the beginning of a new session, before ConsumeClaim
-func (c *consumerHandler) Setup(sarama.ConsumerGroupSession) error {
+func (c *consumerHandler) Setup(session sarama.ConsumerGroupSession) error {
+	recordRebalance(session.Context(), c.groupID)
+	if c.onSetup != nil {
+		c.onSetup(session)
+	}
 	return nil
 }
 
 // Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
-func (c *consumerHandler) Cleanup(sarama.ConsumerGroupSession) error {
+func (c *consumerHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	if c.onCleanup != nil {
+		c.onCleanup(session)
+	}
 	return nil
 }
 
@@ -39,22 +89,171 @@ func (c *consumerHandler) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 	// Do not move the code below to a goroutine.
 	// The `ConsumeClaim` itself is called within a goroutine, see:
 	// https://github.com/IBM/sarama/blob/master/consumer_group.go#L27-L29
-	for msg := range claim.Messages() {
-		if c.autoCommit {
-			session.MarkMessage(msg, "")
+	session = newLagSession(session, claim, c.groupID)
+
+	ctx, cancel := c.handlerContext(session)
+	defer cancel()
+
+	if c.batchHandler != nil {
+		return c.consumeBatch(ctx, session, claim)
+	}
+
+	if c.concurrency > 1 {
+		return c.consumeConcurrent(ctx, session, claim)
+	}
+
+	for {
+		if c.stopped() {
+			return nil
+		}
+
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			if !c.gate.wait(session.Context(), c.stopping, msg.Topic, msg.Partition) {
+				return nil
+			}
+			c.consume(ctx, session, msg)
+		case <-session.Context().Done():
+			return nil
+		case <-c.stopping:
+			return nil
 		}
-		c.msgProcessor(&MessageDecoder{
-			Body:      msg.Value,
-			Key:       msg.Key,
-			Partition: msg.Partition,
-			TimeStamp: msg.Timestamp,
-			Offset:    msg.Offset,
-			Topic:     msg.Topic,
-			Commit: func(m *MessageDecoder) {
-				session.MarkOffset(m.Topic, m.Partition, m.Offset+1, "")
-			},
-		})
 	}
+}
 
-	return nil
+// handlerContext return the context of handlers of session. Sarama cancel
+// the session context of every claim once one claim loop return, handlers
+// of a session ended by a graceful stop keep running until Stop give up
+// waiting and those of a session restarted for new topics finish. A
+// session ended by a rebalance cancel them.
+func (c *consumerHandler) handlerContext(session sarama.ConsumerGroupSession) (context.Context, context.CancelFunc) {
+	if c.ctx == nil {
+		return context.WithCancel(session.Context())
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	go func() {
+		select {
+		case <-session.Context().Done():
+			if !c.stopped() && (c.restarting == nil || !c.restarting()) {
+				cancel()
+			}
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// stopped report whether the consumer is stopping, claims check it before
+// taking the next message so none is started once Stop is called
+func (c *consumerHandler) stopped() bool {
+	select {
+	case <-c.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// consume run handler for a single message and mark it once handled.
+// With auto commit the message is marked before processing (at-most-once),
+// otherwise only after the handler succeed (at-least-once).
+func (c *consumerHandler) consume(ctx context.Context, session sarama.ConsumerGroupSession, msg *sarama.ConsumerMessage) {
+	if c.autoCommit {
+		session.MarkMessage(msg, "")
+	}
+
+	err := c.handle(ctx, session, msg, func(m *MessageDecoder) {
+		session.MarkOffset(m.Topic, m.Partition, m.Offset+1, "")
+	})
+
+	if err == nil && !c.autoCommit {
+		session.MarkMessage(msg, "")
+	}
+}
+
+// handle decode msg and process it within a consumer span
+func (c *consumerHandler) handle(ctx context.Context, session sarama.ConsumerGroupSession, msg *sarama.ConsumerMessage, commit func(*MessageDecoder)) error {
+	headers := headerMap(msg.Headers)
+	ctx, span := startConsumerSpan(ctx, msg, c.groupID, headers)
+	recordReceive(ctx, msg.Topic, c.groupID, 1, len(msg.Value))
+
+	err := c.process(ctx, &MessageDecoder{
+		Body:      msg.Value,
+		Key:       msg.Key,
+		Headers:   headers,
+		Partition: msg.Partition,
+		TimeStamp: msg.Timestamp,
+		Offset:    msg.Offset,
+		Topic:     msg.Topic,
+		Commit:    commit,
+		ctx:       ctx,
+		session:   session.Context().Done(),
+		hold:      c.hold,
+	})
+
+	endSpan(span, err)
+	return err
+}
+
+// route return the handler of msg topic, the original topic for messages
+// of retry tiers and dead letter, fallback otherwise
+func route(handlers map[string]Handler, fallback Handler, msg *MessageDecoder) Handler {
+	topic := msg.Topic
+	if original := msg.Headers[HeaderOriginalTopic]; original != "" && forwardedTopic(topic) {
+		topic = original
+	}
+	if h, ok := handlers[topic]; ok {
+		return h
+	}
+	if fallback == nil {
+		return func(context.Context, *MessageDecoder) error {
+			return fmt.Errorf("[kafka] no handler for topic %s", topic)
+		}
+	}
+	return fallback
+}
+
+// process call handler until it succeed, retrying in place with exponential
+// backoff. Once the retry policy in-place attempts are exhausted the message
+// is forwarded to the next retry tier or dead letter topic. When ctx is done
+// the message is left uncommitted so the next owner of the partition receive
+// it again.
+func (c *consumerHandler) process(ctx context.Context, msg *MessageDecoder) error {
+	if err := c.retry.wait(ctx, c.stopping, msg); err != nil {
+		return err
+	}
+
+	backoff := c.retry.backoffInitial
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := route(c.handlers, c.handler, msg)(ctx, msg)
+		recordProcess(ctx, msg.Topic, c.groupID, start, err)
+		if err == nil {
+			return nil
+		}
+
+		if c.retry.exhausted(attempt) {
+			return c.retry.forward(ctx, msg, err)
+		}
+
+		log.WithContext(ctx).WithFields(map[string]interface{}{
+			"event":     logEventEventName,
+			"topic":     msg.Topic,
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+			"attempt":   attempt,
+		}).Warn(fmt.Sprintf("handle message failed, retry in %s: %s", backoff, err.Error()))
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("handle message cancelled after %d attempts: %w", attempt, err)
+		case <-time.After(backoff):
+		}
+
+		backoff = c.retry.nextBackoff(backoff)
+	}
 }
@@ -0,0 +1,391 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSession struct {
+	ctx    context.Context
+	mux    sync.Mutex
+	marked map[string]map[int32]int64
+}
+
+func newFakeSession(ctx context.Context) *fakeSession {
+	return &fakeSession{ctx: ctx, marked: map[string]map[int32]int64{}}
+}
+
+func (s *fakeSession) Claims() map[string][]int32 { return nil }
+func (s *fakeSession) MemberID() string           { return "member" }
+func (s *fakeSession) GenerationID() int32        { return 1 }
+func (s *fakeSession) Commit()                    {}
+func (s *fakeSession) Context() context.Context   { return s.ctx }
+
+func (s *fakeSession) MarkOffset(topic string, partition int32, offset int64, _ string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.marked[topic] == nil {
+		s.marked[topic] = map[int32]int64{}
+	}
+	if offset > s.marked[topic][partition] {
+		s.marked[topic][partition] = offset
+	}
+}
+
+func (s *fakeSession) ResetOffset(topic string, partition int32, offset int64, _ string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.marked[topic] == nil {
+		s.marked[topic] = map[int32]int64{}
+	}
+	s.marked[topic][partition] = offset
+}
+
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+func (s *fakeSession) committed(topic string, partition int32) int64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.marked[topic][partition]
+}
+
+type fakeClaim struct {
+	topic     string
+	partition int32
+	messages  chan *sarama.ConsumerMessage
+}
+
+func newFakeClaim(topic string, partition int32, msgs ...*sarama.ConsumerMessage) *fakeClaim {
+	ch := make(chan *sarama.ConsumerMessage, len(msgs))
+	for _, m := range msgs {
+		ch <- m
+	}
+	close(ch)
+	return &fakeClaim{topic: topic, partition: partition, messages: ch}
+}
+
+func (c *fakeClaim) Topic() string                            { return c.topic }
+func (c *fakeClaim) Partition() int32                         { return c.partition }
+func (c *fakeClaim) InitialOffset() int64                     { return 0 }
+func (c *fakeClaim) HighWaterMarkOffset() int64               { return 0 }
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+func consumerMessage(topic string, partition int32, offset int64, key string) *sarama.ConsumerMessage {
+	return &sarama.ConsumerMessage{
+		Topic:     topic,
+		Partition: partition,
+		Offset:    offset,
+		Key:       []byte(key),
+		Value:     []byte("value"),
+	}
+}
+
+func TestConsumeClaimMarkAfterSuccess(t *testing.T) {
+	session := newFakeSession(context.Background())
+	claim := newFakeClaim("orders", 0,
+		consumerMessage("orders", 0, 0, "a"),
+		consumerMessage("orders", 0, 1, "b"),
+	)
+
+	var seen []int64
+	h := NewConsumerHandler(func(ctx context.Context, msg *MessageDecoder) error {
+		assert.NotNil(t, ctx)
+		seen = append(seen, msg.Offset)
+		return nil
+	}, false, "group")
+
+	assert.Nil(t, h.ConsumeClaim(session, claim))
+	assert.Equal(t, []int64{0, 1}, seen)
+	assert.Equal(t, int64(2), session.committed("orders", 0))
+}
+
+func TestConsumeClaimRetryFailedMessage(t *testing.T) {
+	session := newFakeSession(context.Background())
+	claim := newFakeClaim("orders", 0, consumerMessage("orders", 0, 0, "a"))
+
+	attempts := 0
+	h := NewConsumerHandler(func(_ context.Context, _ *MessageDecoder) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("temporary failure")
+		}
+		return nil
+	}, false, "group")
+
+	assert.Nil(t, h.ConsumeClaim(session, claim))
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, int64(1), session.committed("orders", 0))
+}
+
+func TestConsumeClaimCancelledSessionLeaveMessageUncommitted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	session := newFakeSession(ctx)
+	claim := newFakeClaim("orders", 0, consumerMessage("orders", 0, 0, "a"))
+
+	h := NewConsumerHandler(func(_ context.Context, _ *MessageDecoder) error {
+		cancel()
+		return errors.New("permanent failure")
+	}, false, "group")
+
+	done := make(chan struct{})
+	go func() {
+		assert.Nil(t, h.ConsumeClaim(session, claim))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("consume claim did not stop on cancelled session")
+	}
+	assert.Equal(t, int64(0), session.committed("orders", 0))
+}
+
+type fakeProducer struct {
+	mux       sync.Mutex
+	published []*MessageContext
+}
+
+func (p *fakeProducer) Publish(_ context.Context, msg *MessageContext) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.published = append(p.published, msg)
+	return nil
+}
+
+func TestConsumeClaimForwardToRetryTopicThenDeadLetter(t *testing.T) {
+	retry, err := newRetryPolicy(RetryConfig{
+		Attempts:         2,
+		InitialBackoffMs: 1,
+		Delays:           []string{"1m"},
+		DeadLetter:       true,
+	})
+	assert.Nil(t, err)
+	producer := &fakeProducer{}
+	retry.producer = producer
+
+	assert.Equal(t, []string{"orders", "orders.retry.1m"}, retry.topics([]string{"orders"}))
+
+	h := newConsumerHandler(func(_ context.Context, _ *MessageDecoder) error {
+		return errors.New("boom")
+	}, false, "group", retry)
+
+	session := newFakeSession(context.Background())
+	assert.Nil(t, h.ConsumeClaim(session, newFakeClaim("orders", 3, consumerMessage("orders", 3, 7, "a"))))
+	assert.Equal(t, int64(8), session.committed("orders", 3))
+	assert.Len(t, producer.published, 1)
+
+	forwarded := producer.published[0]
+	assert.Equal(t, "orders.retry.1m", forwarded.Topic)
+	assert.Equal(t, "orders", forwarded.Headers[HeaderOriginalTopic])
+	assert.Equal(t, "3", forwarded.Headers[HeaderOriginalPartition])
+	assert.Equal(t, "7", forwarded.Headers[HeaderOriginalOffset])
+	assert.Equal(t, "1", forwarded.Headers[HeaderRetryTier])
+	assert.Equal(t, "boom", forwarded.Headers[HeaderError])
+	assert.NotEmpty(t, forwarded.Headers[HeaderDeliverAt])
+
+	// due retry message is handled right away and dead lettered on failure
+	forwarded.Headers[HeaderDeliverAt] = "0"
+	retryMsg := consumerMessage("orders.retry.1m", 0, 0, "a")
+	for k, v := range forwarded.Headers {
+		retryMsg.Headers = append(retryMsg.Headers, &sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
+	}
+	assert.Nil(t, h.ConsumeClaim(session, newFakeClaim("orders.retry.1m", 0, retryMsg)))
+	assert.Equal(t, int64(1), session.committed("orders.retry.1m", 0))
+	assert.Len(t, producer.published, 2)
+
+	dead := producer.published[1]
+	assert.Equal(t, "orders.dlq", dead.Topic)
+	assert.Equal(t, "orders", dead.Headers[HeaderOriginalTopic])
+	assert.Equal(t, "7", dead.Headers[HeaderOriginalOffset])
+	assert.Empty(t, dead.Headers[HeaderDeliverAt])
+}
+
+func TestConsumeClaimConcurrentKeepKeyOrder(t *testing.T) {
+	var msgs []*sarama.ConsumerMessage
+	for i := int64(0); i < 40; i++ {
+		msgs = append(msgs, consumerMessage("orders", 0, i, []string{"a", "b", "c", "d"}[i%4]))
+	}
+
+	var mux sync.Mutex
+	seen := map[string][]int64{}
+	release := make(chan struct{})
+
+	h := NewConsumerHandler(func(_ context.Context, msg *MessageDecoder) error {
+		// first message is the slowest, nothing may be committed past it
+		if msg.Offset == 0 {
+			<-release
+		}
+		mux.Lock()
+		seen[string(msg.Key)] = append(seen[string(msg.Key)], msg.Offset)
+		mux.Unlock()
+		return nil
+	}, false, "group").(*consumerHandler)
+	h.concurrency = 4
+
+	session := newFakeSession(context.Background())
+	done := make(chan struct{})
+	go func() {
+		assert.Nil(t, h.ConsumeClaim(session, newFakeClaim("orders", 0, msgs...)))
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int64(0), session.committed("orders", 0))
+	close(release)
+	<-done
+
+	assert.Equal(t, int64(40), session.committed("orders", 0))
+	for key, offsets := range seen {
+		assert.Len(t, offsets, 10, key)
+		for i := 1; i < len(offsets); i++ {
+			assert.Less(t, offsets[i-1], offsets[i], key)
+		}
+	}
+}
+
+func TestConsumeClaimBatch(t *testing.T) {
+	var msgs []*sarama.ConsumerMessage
+	for i := int64(0); i < 5; i++ {
+		msgs = append(msgs, consumerMessage("orders", 0, i, "a"))
+	}
+
+	var sizes []int
+	h := NewConsumerHandler(nil, false, "group").(*consumerHandler)
+	h.batchSize = 2
+	h.batchTimeout = time.Minute
+	h.batchHandler = func(_ context.Context, batch []*MessageDecoder) error {
+		sizes = append(sizes, len(batch))
+		return nil
+	}
+
+	session := newFakeSession(context.Background())
+	assert.Nil(t, h.ConsumeClaim(session, newFakeClaim("orders", 0, msgs...)))
+	assert.Equal(t, []int{2, 2, 1}, sizes)
+	assert.Equal(t, int64(5), session.committed("orders", 0))
+}
+
+func TestConsumeClaimBatchFlushOnTimeout(t *testing.T) {
+	claim := &fakeClaim{topic: "orders", messages: make(chan *sarama.ConsumerMessage, 1)}
+	claim.messages <- consumerMessage("orders", 0, 0, "a")
+
+	delivered := make(chan int, 1)
+	h := NewConsumerHandler(nil, false, "group").(*consumerHandler)
+	h.batchSize = 10
+	h.batchTimeout = 20 * time.Millisecond
+	h.batchHandler = func(_ context.Context, batch []*MessageDecoder) error {
+		delivered <- len(batch)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	session := newFakeSession(ctx)
+	go func() {
+		_ = h.ConsumeClaim(session, claim)
+	}()
+
+	select {
+	case n := <-delivered:
+		assert.Equal(t, 1, n)
+	case <-time.After(time.Second):
+		t.Fatal("batch was not flushed on timeout")
+	}
+}
+
+func TestConsumeClaimHoldRetryTierMessage(t *testing.T) {
+	retry, err := newRetryPolicy(RetryConfig{Delays: []string{"1m"}, DeadLetter: true})
+	assert.Nil(t, err)
+	// forwarding need attempts to be exhausted
+	assert.Equal(t, defaultRetryAttempts, retry.attempts)
+
+	var handled []int64
+	h := newConsumerHandler(func(_ context.Context, msg *MessageDecoder) error {
+		handled = append(handled, msg.Offset)
+		return nil
+	}, false, "group", retry)
+
+	stopping := make(chan struct{})
+	h.stopping = stopping
+	var calls []string
+	h.hold = func(topic string, partition int32) func() {
+		calls = append(calls, fmt.Sprintf("pause %s/%d", topic, partition))
+		return func() { calls = append(calls, fmt.Sprintf("resume %s/%d", topic, partition)) }
+	}
+
+	retryMsg := func(offset int64, at time.Time) *sarama.ConsumerMessage {
+		msg := consumerMessage("orders.retry.1m", 2, offset, "a")
+		msg.Headers = []*sarama.RecordHeader{{Key: []byte(HeaderDeliverAt), Value: []byte(strconv.FormatInt(at.UnixMilli(), 10))}}
+		return msg
+	}
+
+	// the partition is paused until the message is due
+	session := newFakeSession(context.Background())
+	start := time.Now()
+	assert.Nil(t, h.ConsumeClaim(session, newFakeClaim("orders.retry.1m", 2, retryMsg(0, time.Now().Add(30*time.Millisecond)))))
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	assert.Equal(t, []string{"pause orders.retry.1m/2", "resume orders.retry.1m/2"}, calls)
+	assert.Equal(t, []int64{0}, handled)
+	assert.Equal(t, int64(1), session.committed("orders.retry.1m", 2))
+
+	// stopping end the wait, the message stay uncommitted for the next owner
+	h.hold = func(string, int32) func() {
+		close(stopping)
+		return func() {}
+	}
+	assert.Nil(t, h.ConsumeClaim(session, newFakeClaim("orders.retry.1m", 2, retryMsg(1, time.Now().Add(time.Hour)))))
+	assert.Equal(t, []int64{0}, handled)
+	assert.Equal(t, int64(1), session.committed("orders.retry.1m", 2))
+}
+
+func TestConsumeClaimRestartWhileRetryTierMessageWait(t *testing.T) {
+	retry, err := newRetryPolicy(RetryConfig{Delays: []string{"1m"}})
+	assert.Nil(t, err)
+
+	var handled []int64
+	h := newConsumerHandler(func(_ context.Context, msg *MessageDecoder) error {
+		handled = append(handled, msg.Offset)
+		return nil
+	}, false, "group", retry)
+	// handlers of a restarted session are not cancelled
+	h.ctx = context.Background()
+	h.restarting = func() bool { return true }
+
+	sessionCtx, endSession := context.WithCancel(context.Background())
+	session := newFakeSession(sessionCtx)
+	waiting := make(chan struct{})
+	h.hold = func(string, int32) func() {
+		close(waiting)
+		return func() {}
+	}
+
+	msg := consumerMessage("orders.retry.1m", 0, 0, "a")
+	msg.Headers = []*sarama.RecordHeader{{Key: []byte(HeaderDeliverAt), Value: []byte(strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10))}}
+
+	done := make(chan struct{})
+	go func() {
+		assert.Nil(t, h.ConsumeClaim(session, newFakeClaim("orders.retry.1m", 0, msg)))
+		close(done)
+	}()
+	<-waiting
+	endSession()
+
+	// the restart end the wait, the next session receive the message again
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("restart waited for the retry tier message")
+	}
+	assert.Empty(t, handled)
+	assert.Equal(t, int64(0), session.committed("orders.retry.1m", 0))
+}
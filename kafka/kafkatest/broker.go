@@ -0,0 +1,481 @@
+// Package kafkatest in-memory kafka broker implementing kafka.Producer and
+// kafka.Consumer for unit tests of services, without a running cluster.
+package kafkatest
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lukmanlukmin/go-lib/kafka"
+)
+
+const (
+	defaultPartitions = 1
+	defaultBatchSize  = 100
+	// retryBackoff wait before a failed message is delivered again
+	retryBackoff = 10 * time.Millisecond
+)
+
+// Option configure Broker
+type Option func(*Broker)
+
+// WithPartitions number of partitions of topics created on first publish (defaults to 1)
+func WithPartitions(n int) Option {
+	return func(b *Broker) {
+		if n > 0 {
+			b.partitions = n
+		}
+	}
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+type publishFault struct {
+	topic string
+	err   error
+	times int
+}
+
+// Broker in-memory broker. Published messages are kept for the broker
+// lifetime, each consumer group consume them from its committed offsets.
+// Members of the same group share the partitions of their topics.
+type Broker struct {
+	mux        sync.Mutex
+	partitions int
+	topics     map[string][][]*kafka.MessageDecoder
+	committed  map[string]map[topicPartition]int64
+	owners     map[string]map[topicPartition]int
+	groups     map[string]map[int]bool
+	members    int
+	faults     []*publishFault
+	errors     []error
+	roundRobin uint32
+	// changed closed and replaced whenever messages or offsets change
+	changed chan struct{}
+}
+
+// NewBroker return empty broker
+func NewBroker(opts ...Option) *Broker {
+	b := &Broker{
+		partitions: defaultPartitions,
+		topics:     map[string][][]*kafka.MessageDecoder{},
+		committed:  map[string]map[topicPartition]int64{},
+		owners:     map[string]map[topicPartition]int{},
+		groups:     map[string]map[int]bool{},
+		changed:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// notify wake up members waiting for changes, mux must be held
+func (b *Broker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// CreateTopic create topic with partitions, existing topics are left untouched
+func (b *Broker) CreateTopic(topic string, partitions int) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.createTopic(topic, partitions)
+}
+
+func (b *Broker) createTopic(topic string, partitions int) [][]*kafka.MessageDecoder {
+	if p, ok := b.topics[topic]; ok {
+		return p
+	}
+	if partitions < 1 {
+		partitions = b.partitions
+	}
+	p := make([][]*kafka.MessageDecoder, partitions)
+	b.topics[topic] = p
+	return p
+}
+
+// FailPublish make the next times publish to topic return err, any topic when topic is empty
+func (b *Broker) FailPublish(topic string, err error, times int) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.faults = append(b.faults, &publishFault{topic: topic, err: err, times: times})
+}
+
+// Publish append msg to its topic, the partition is chosen by hashing the
+// key or round robin for keyless messages
+func (b *Broker) Publish(_ context.Context, msg *kafka.MessageContext) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	for i, f := range b.faults {
+		if f.topic != "" && f.topic != msg.Topic {
+			continue
+		}
+		f.times--
+		if f.times <= 0 {
+			b.faults = append(b.faults[:i], b.faults[i+1:]...)
+		}
+		return fmt.Errorf("[kafka-publisher] topic: %s, got: %w", msg.Topic, f.err)
+	}
+
+	partitions := b.createTopic(msg.Topic, 0)
+
+	var partition int32
+	if len(msg.Key) > 0 {
+		h := fnv.New32a()
+		_, _ = h.Write(msg.Key)
+		partition = int32(h.Sum32() % uint32(len(partitions)))
+	} else {
+		partition = int32(b.roundRobin % uint32(len(partitions)))
+		b.roundRobin++
+	}
+
+	headers := make(map[string]string, len(msg.Headers))
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+
+	ts := msg.TimeStamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	partitions[partition] = append(partitions[partition], &kafka.MessageDecoder{
+		Body:      []byte(msg.Value),
+		Key:       msg.Key,
+		Headers:   headers,
+		Topic:     msg.Topic,
+		Partition: partition,
+		Offset:    int64(len(partitions[partition])),
+		TimeStamp: ts,
+	})
+	b.notify()
+	return nil
+}
+
+// Messages return messages published to topic ordered by partition and offset
+func (b *Broker) Messages(topic string) []*kafka.MessageDecoder {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	var out []*kafka.MessageDecoder
+	for _, msgs := range b.topics[topic] {
+		out = append(out, msgs...)
+	}
+	return out
+}
+
+// Committed return the next offset groupID consume from topic partition
+func (b *Broker) Committed(groupID, topic string, partition int32) int64 {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return b.committed[groupID][topicPartition{topic, partition}]
+}
+
+// Redeliver move the committed offset of groupID back to offset, messages
+// after it are delivered again as after a crash or rebalance
+func (b *Broker) Redeliver(groupID, topic string, partition int32, offset int64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.commit(groupID, topicPartition{topic, partition}, offset, true)
+}
+
+// commit set the group offset, only forward unless force, mux must be held
+func (b *Broker) commit(groupID string, tp topicPartition, offset int64, force bool) {
+	offsets, ok := b.committed[groupID]
+	if !ok {
+		offsets = map[topicPartition]int64{}
+		b.committed[groupID] = offsets
+	}
+	if force || offset > offsets[tp] {
+		offsets[tp] = offset
+		b.notify()
+	}
+}
+
+// HandlerErrors return errors returned by handlers, failed messages are delivered again
+func (b *Broker) HandlerErrors() []error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return append([]error(nil), b.errors...)
+}
+
+// WaitConsumed block until groupID committed every message of topics or
+// timeout elapse, it report whether the group caught up
+func (b *Broker) WaitConsumed(groupID string, timeout time.Duration, topics ...string) bool {
+	deadline := time.After(timeout)
+	for {
+		b.mux.Lock()
+		done := true
+		for _, topic := range topics {
+			for p, msgs := range b.topics[topic] {
+				if b.committed[groupID][topicPartition{topic, int32(p)}] < int64(len(msgs)) {
+					done = false
+				}
+			}
+		}
+		changed := b.changed
+		b.mux.Unlock()
+
+		if done {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// Subscribe consume ctx.Topics and topics matching ctx.TopicPattern as a
+// member of ctx.GroupID until ctx.Context is done. Offsets are committed
+// once the handler succeed, failed messages are delivered again. OnAssigned
+// and OnRevoked are called whenever the partitions of the member change.
+func (b *Broker) Subscribe(ctx *kafka.ConsumerContext) {
+	b.mux.Lock()
+	b.members++
+	member := b.members
+	if b.groups[ctx.GroupID] == nil {
+		b.groups[ctx.GroupID] = map[int]bool{}
+	}
+	b.groups[ctx.GroupID][member] = true
+	for _, topic := range ctx.Topics {
+		b.createTopic(topic, 0)
+	}
+	// members of the group release partitions above their new share
+	b.notify()
+	b.mux.Unlock()
+
+	var assigned map[string][]int32
+	defer func() {
+		b.release(ctx.GroupID, member)
+		if assigned != nil && ctx.OnRevoked != nil {
+			ctx.OnRevoked(ctx.Context, assigned)
+		}
+	}()
+
+	for {
+		b.mux.Lock()
+		changed := b.changed
+		b.mux.Unlock()
+
+		claims := b.claim(ctx.GroupID, member, b.subscribed(ctx))
+		if current := claimMap(claims); assigned == nil || !reflect.DeepEqual(current, assigned) {
+			if assigned != nil && ctx.OnRevoked != nil {
+				ctx.OnRevoked(ctx.Context, assigned)
+			}
+			assigned = current
+			if ctx.OnAssigned != nil {
+				ctx.OnAssigned(ctx.Context, assigned)
+			}
+		}
+
+		delivered := false
+		for _, tp := range claims {
+			if b.deliver(ctx, tp) {
+				delivered = true
+			}
+			if ctx.Context.Err() != nil {
+				return
+			}
+		}
+
+		if delivered {
+			continue
+		}
+		select {
+		case <-ctx.Context.Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+// claim return partitions of topics owned by member. Members of a group
+// own an equal share of partitions, extra ones are released to new members
+// and free ones taken up to the share.
+func (b *Broker) claim(groupID string, member int, topics []string) []topicPartition {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	owners, ok := b.owners[groupID]
+	if !ok {
+		owners = map[topicPartition]int{}
+		b.owners[groupID] = owners
+	}
+
+	var all []topicPartition
+	for _, topic := range topics {
+		for p := range b.topics[topic] {
+			all = append(all, topicPartition{topic, int32(p)})
+		}
+	}
+	members := len(b.groups[groupID])
+	share := (len(all) + members - 1) / members
+
+	var claims []topicPartition
+	for _, tp := range all {
+		if owners[tp] == member {
+			if len(claims) < share {
+				claims = append(claims, tp)
+				continue
+			}
+			delete(owners, tp)
+			b.notify()
+		}
+	}
+	for _, tp := range all {
+		if _, owned := owners[tp]; owned || len(claims) >= share {
+			continue
+		}
+		owners[tp] = member
+		claims = append(claims, tp)
+	}
+	return claims
+}
+
+// subscribed return ctx.Topics and the existing topics matching ctx.TopicPattern
+func (b *Broker) subscribed(ctx *kafka.ConsumerContext) []string {
+	if ctx.TopicPattern == nil {
+		return ctx.Topics
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	topics := append([]string{}, ctx.Topics...)
+	for topic := range b.topics {
+		if ctx.TopicPattern.MatchString(topic) && !slices.Contains(topics, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// claimMap group claims partitions by topic
+func claimMap(claims []topicPartition) map[string][]int32 {
+	m := make(map[string][]int32, len(claims))
+	for _, tp := range claims {
+		m[tp.topic] = append(m[tp.topic], tp.partition)
+	}
+	for _, partitions := range m {
+		sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+	}
+	return m
+}
+
+// release free partitions of member so other members of the group take them
+func (b *Broker) release(groupID string, member int) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	for tp, owner := range b.owners[groupID] {
+		if owner == member {
+			delete(b.owners[groupID], tp)
+		}
+	}
+	delete(b.groups[groupID], member)
+	b.notify()
+}
+
+// pending return messages of tp after the group committed offset
+func (b *Broker) pending(groupID string, tp topicPartition, max int) []*kafka.MessageDecoder {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	msgs := b.topics[tp.topic][tp.partition]
+	offset := b.committed[groupID][tp]
+	if offset >= int64(len(msgs)) {
+		return nil
+	}
+
+	end := int64(len(msgs))
+	if end-offset > int64(max) {
+		end = offset + int64(max)
+	}
+
+	out := make([]*kafka.MessageDecoder, 0, end-offset)
+	for _, m := range msgs[offset:end] {
+		out = append(out, b.decoder(groupID, m))
+	}
+	return out
+}
+
+// decoder return copy of m committing to groupID, the stored message is never handed out
+func (b *Broker) decoder(groupID string, m *kafka.MessageDecoder) *kafka.MessageDecoder {
+	headers := make(map[string]string, len(m.Headers))
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	return &kafka.MessageDecoder{
+		Body:      append([]byte(nil), m.Body...),
+		Key:       m.Key,
+		Headers:   headers,
+		Topic:     m.Topic,
+		Partition: m.Partition,
+		Offset:    m.Offset,
+		TimeStamp: m.TimeStamp,
+		Commit: func(d *kafka.MessageDecoder) {
+			b.mux.Lock()
+			defer b.mux.Unlock()
+			b.commit(groupID, topicPartition{d.Topic, d.Partition}, d.Offset+1, false)
+		},
+	}
+}
+
+// deliver hand pending messages of tp to the handler, it report whether any was handled
+func (b *Broker) deliver(ctx *kafka.ConsumerContext, tp topicPartition) bool {
+	if ctx.BatchHandler != nil {
+		msgs := b.pending(ctx.GroupID, tp, defaultBatchSize)
+		if len(msgs) == 0 {
+			return false
+		}
+		b.handle(ctx, msgs[len(msgs)-1], func(c context.Context) error {
+			return ctx.BatchHandler(c, msgs)
+		})
+		return true
+	}
+
+	msgs := b.pending(ctx.GroupID, tp, 1)
+	if len(msgs) == 0 {
+		return false
+	}
+	b.handle(ctx, msgs[0], func(c context.Context) error {
+		return ctx.HandlerFor(msgs[0])(c, msgs[0])
+	})
+	return true
+}
+
+// handle run fn and commit last once it succeed, errors are recorded and
+// the messages delivered again after a short backoff
+func (b *Broker) handle(ctx *kafka.ConsumerContext, last *kafka.MessageDecoder, fn func(context.Context) error) {
+	if err := fn(ctx.Context); err != nil {
+		b.mux.Lock()
+		b.errors = append(b.errors, err)
+		b.mux.Unlock()
+
+		select {
+		case <-ctx.Context.Done():
+		case <-time.After(retryBackoff):
+		}
+		return
+	}
+	last.Commit(last)
+}
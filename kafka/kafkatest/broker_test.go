@@ -0,0 +1,164 @@
+package kafkatest
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lukmanlukmin/go-lib/kafka"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	_ kafka.Producer = (*Broker)(nil)
+	_ kafka.Consumer = (*Broker)(nil)
+)
+
+func TestBrokerPublishAndExpect(t *testing.T) {
+	b := NewBroker(WithPartitions(3))
+	ctx := context.Background()
+
+	boom := errors.New("broker down")
+	b.FailPublish("orders", boom, 1)
+	assert.ErrorIs(t, b.Publish(ctx, &kafka.MessageContext{Topic: "orders", Value: `{"id":"o-1"}`}), boom)
+
+	assert.Nil(t, b.Publish(ctx, &kafka.MessageContext{
+		Topic:   "orders",
+		Key:     []byte("o-1"),
+		Value:   `{"id": "o-1", "total": 10}`,
+		Headers: map[string]string{"source": "checkout"},
+	}))
+
+	msg := b.ExpectPublished(t, "orders", All(
+		Key("o-1"),
+		Header("source", "checkout"),
+		JSON(map[string]interface{}{"id": "o-1", "total": 10}),
+	))
+	assert.NotNil(t, msg)
+	b.ExpectNotPublished(t, "orders", Key("o-2"))
+
+	// messages with the same key stay on one partition
+	assert.Nil(t, b.Publish(ctx, &kafka.MessageContext{Topic: "orders", Key: []byte("o-1"), Value: "{}"}))
+	msgs := b.Messages("orders")
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, msgs[0].Partition, msgs[1].Partition)
+	assert.Equal(t, int64(1), msgs[1].Offset)
+}
+
+func TestBrokerConsumerGroup(t *testing.T) {
+	b := NewBroker(WithPartitions(4))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mux sync.Mutex
+	seen := map[string]int{}
+	failed := false
+	handler := func(_ context.Context, msg *kafka.MessageDecoder) error {
+		mux.Lock()
+		defer mux.Unlock()
+		if string(msg.Key) == "k3" && !failed {
+			failed = true
+			return errors.New("temporary failure")
+		}
+		seen[string(msg.Key)]++
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.Subscribe(&kafka.ConsumerContext{Handler: handler, Topics: []string{"orders"}, GroupID: "billing", Context: ctx})
+		}()
+	}
+
+	keys := []string{"k0", "k1", "k2", "k3", "k4", "k5"}
+	for _, k := range keys {
+		assert.Nil(t, b.Publish(ctx, &kafka.MessageContext{Topic: "orders", Key: []byte(k), Value: k}))
+	}
+
+	assert.True(t, b.WaitConsumed("billing", time.Second, "orders"))
+	assert.Len(t, b.HandlerErrors(), 1)
+
+	mux.Lock()
+	for _, k := range keys {
+		assert.Equal(t, 1, seen[k], k)
+	}
+	mux.Unlock()
+
+	// redelivery after the group rewind its offset
+	msg := b.ExpectPublished(t, "orders", Key("k0"))
+	b.Redeliver("billing", "orders", msg.Partition, msg.Offset)
+	assert.True(t, b.WaitConsumed("billing", time.Second, "orders"))
+
+	mux.Lock()
+	assert.Equal(t, 2, seen["k0"])
+	mux.Unlock()
+
+	cancel()
+	wg.Wait()
+}
+
+func TestBrokerBatchHandler(t *testing.T) {
+	b := NewBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, b.Publish(ctx, &kafka.MessageContext{Topic: "orders", Value: "v"}))
+	}
+
+	batches := make(chan int, 5)
+	go b.Subscribe(&kafka.ConsumerContext{
+		BatchHandler: func(_ context.Context, msgs []*kafka.MessageDecoder) error {
+			batches <- len(msgs)
+			return nil
+		},
+		Topics:  []string{"orders"},
+		GroupID: "audit",
+		Context: ctx,
+	})
+
+	assert.True(t, b.WaitConsumed("audit", time.Second, "orders"))
+	assert.Equal(t, 5, <-batches)
+	assert.Equal(t, int64(5), b.Committed("audit", "orders", 0))
+}
+
+func TestBrokerTopicPattern(t *testing.T) {
+	b := NewBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mux sync.Mutex
+	routed := map[string]string{}
+	record := func(name string) kafka.Handler {
+		return func(_ context.Context, msg *kafka.MessageDecoder) error {
+			mux.Lock()
+			defer mux.Unlock()
+			routed[msg.Topic] = name
+			return nil
+		}
+	}
+
+	go b.Subscribe(&kafka.ConsumerContext{
+		Handler:      record("default"),
+		Handlers:     map[string]kafka.Handler{"orders.eu": record("eu")},
+		TopicPattern: regexp.MustCompile(`^orders\.`),
+		GroupID:      "billing",
+		Context:      ctx,
+	})
+
+	// topics created after the subscription are picked up
+	assert.Nil(t, b.Publish(ctx, &kafka.MessageContext{Topic: "orders.eu", Value: "v"}))
+	assert.Nil(t, b.Publish(ctx, &kafka.MessageContext{Topic: "orders.us", Value: "v"}))
+	assert.Nil(t, b.Publish(ctx, &kafka.MessageContext{Topic: "payments", Value: "v"}))
+	assert.True(t, b.WaitConsumed("billing", time.Second, "orders.eu", "orders.us"))
+
+	mux.Lock()
+	assert.Equal(t, map[string]string{"orders.eu": "eu", "orders.us": "default"}, routed)
+	mux.Unlock()
+}
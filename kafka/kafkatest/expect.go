@@ -0,0 +1,99 @@
+package kafkatest
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"github.com/lukmanlukmin/go-lib/kafka"
+)
+
+// TestingT subset of testing.T used by assertions
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// Matcher report whether a published message is the expected one
+type Matcher func(msg *kafka.MessageDecoder) bool
+
+// Any match every message
+func Any() Matcher {
+	return func(*kafka.MessageDecoder) bool { return true }
+}
+
+// Key match messages with key
+func Key(key string) Matcher {
+	return func(msg *kafka.MessageDecoder) bool {
+		return string(msg.Key) == key
+	}
+}
+
+// Header match messages carrying header name with value
+func Header(name, value string) Matcher {
+	return func(msg *kafka.MessageDecoder) bool {
+		v, ok := msg.Headers[name]
+		return ok && v == value
+	}
+}
+
+// Value match messages with value
+func Value(value string) Matcher {
+	return func(msg *kafka.MessageDecoder) bool {
+		return bytes.Equal(msg.Body, []byte(value))
+	}
+}
+
+// JSON match messages whose JSON value equal v once both are decoded
+func JSON(v interface{}) Matcher {
+	want, err := json.Marshal(v)
+	return func(msg *kafka.MessageDecoder) bool {
+		if err != nil {
+			return false
+		}
+		var a, b interface{}
+		if json.Unmarshal(want, &a) != nil || json.Unmarshal(msg.Body, &b) != nil {
+			return false
+		}
+		return reflect.DeepEqual(a, b)
+	}
+}
+
+// All match messages matching every matcher
+func All(matchers ...Matcher) Matcher {
+	return func(msg *kafka.MessageDecoder) bool {
+		for _, m := range matchers {
+			if !m(msg) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// ExpectPublished fail t unless a message matching matcher was published
+// to topic, it return the first match
+func (b *Broker) ExpectPublished(t TestingT, topic string, matcher Matcher) *kafka.MessageDecoder {
+	t.Helper()
+
+	msgs := b.Messages(topic)
+	for _, msg := range msgs {
+		if matcher(msg) {
+			return msg
+		}
+	}
+	t.Errorf("no message matching on topic %q out of %d published", topic, len(msgs))
+	return nil
+}
+
+// ExpectNotPublished fail t when a message matching matcher was published to topic
+func (b *Broker) ExpectNotPublished(t TestingT, topic string, matcher Matcher) {
+	t.Helper()
+
+	for _, msg := range b.Messages(topic) {
+		if matcher(msg) {
+			t.Errorf("unexpected message on topic %q partition %d offset %d", topic, msg.Partition, msg.Offset)
+			return
+		}
+	}
+}
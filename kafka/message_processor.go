@@ -3,28 +3,72 @@
 package kafka
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"reflect"
 	"time"
 )
 
+// Handler process a consumed message. Returning nil marks the message as
+// consumed, returning an error makes the consumer retry it with backoff until
+// it succeeds or ctx is cancelled by a rebalance or shutdown.
+type Handler func(ctx context.Context, msg *MessageDecoder) error
+
+// BatchHandler process messages of a partition in bulk. Returning nil marks
+// the whole batch as consumed, an error retries the batch the same way
+// Handler errors are retried.
+type BatchHandler func(ctx context.Context, msgs []*MessageDecoder) error
+
+// MessageProcessorFunc message processor without context and error result
+//
+// Deprecated: use Handler, adapt existing functions with MessageProcessorFunc.Handle
 type MessageProcessorFunc func(*MessageDecoder)
 
+// Handle call fn and report success, so it can be used as Handler
+func (fn MessageProcessorFunc) Handle(_ context.Context, msg *MessageDecoder) error {
+	fn(msg)
+	return nil
+}
+
 // MessageProcessor contract message consumer processor
 type MessageProcessor interface {
 	Processor(decoder *MessageDecoder) error
 }
 
+// ProcessorHandler return Handler calling MessageProcessor
+func ProcessorHandler(p MessageProcessor) Handler {
+	return func(_ context.Context, msg *MessageDecoder) error {
+		return p.Processor(msg)
+	}
+}
+
 // MessageDecoder decoder message data  on topic
 type MessageDecoder struct {
 	Body      []byte
 	Key       []byte
+	Headers   map[string]string
 	Topic     string
 	Partition int32
 	TimeStamp time.Time
 	Offset    int64
 	Commit    func(*MessageDecoder)
+
+	ctx context.Context
+	// session done when the group session delivering the message end
+	session <-chan struct{}
+	// hold pause fetching the partition of the message, nil when the
+	// consumer can't
+	hold holdFunc
+}
+
+// Context return message context carrying the trace extracted from headers,
+// it is never nil
+func (decoder *MessageDecoder) Context() context.Context {
+	if decoder.ctx != nil {
+		return decoder.ctx
+	}
+	return context.Background()
 }
 
 // DecodeJSON decode kafka message byte to struct
@@ -36,6 +80,11 @@ func (decoder *MessageDecoder) DecodeJSON(out interface{}) error {
 	return json.Unmarshal(decoder.Body, out)
 }
 
+// Decode decode kafka message byte to out with deserializer
+func (decoder *MessageDecoder) Decode(d Deserializer, out interface{}) error {
+	return d.Deserialize(decoder.Context(), decoder.Topic, decoder.Body, out)
+}
+
 // MessageEncoder message encoder  publish message to kafka
 type MessageEncoder interface {
 	Encode() ([]byte, error)
@@ -0,0 +1,260 @@
+// Package kafka messaging broker
+package kafka
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	gometrics "github.com/rcrowley/go-metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const (
+	// saramaMetricName gauge carrying every sarama go-metrics value
+	saramaMetricName = "kafka.sarama.metric"
+)
+
+// instruments recorded by producers and consumers. They are created from
+// the global meter provider, measurements are dropped until one is set.
+type instruments struct {
+	published       metric.Int64Counter
+	publishedBytes  metric.Int64Counter
+	publishDuration metric.Float64Histogram
+	publishErrors   metric.Int64Counter
+	received        metric.Int64Counter
+	receivedBytes   metric.Int64Counter
+	processDuration metric.Float64Histogram
+	processErrors   metric.Int64Counter
+	lag             metric.Int64Gauge
+	rebalances      metric.Int64Counter
+	handlerDuration metric.Float64Histogram
+}
+
+var (
+	metricsOnce sync.Once
+	metricsInst *instruments
+)
+
+func meter() metric.Meter {
+	return otel.Meter(instrumentationName)
+}
+
+// kafkaMetrics return instruments, creating them on first use
+func kafkaMetrics() *instruments {
+	metricsOnce.Do(func() {
+		m := meter()
+		i := &instruments{}
+		var errs []error
+		collect := func(err error) {
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		var err error
+		i.published, err = m.Int64Counter(semconv.MessagingPublishMessagesName,
+			metric.WithUnit(semconv.MessagingPublishMessagesUnit),
+			metric.WithDescription(semconv.MessagingPublishMessagesDescription))
+		collect(err)
+		i.publishedBytes, err = m.Int64Counter("messaging.publish.bytes",
+			metric.WithUnit("By"),
+			metric.WithDescription("Measures the size of published message values."))
+		collect(err)
+		i.publishDuration, err = m.Float64Histogram(semconv.MessagingPublishDurationName,
+			metric.WithUnit(semconv.MessagingPublishDurationUnit),
+			metric.WithDescription(semconv.MessagingPublishDurationDescription))
+		collect(err)
+		i.publishErrors, err = m.Int64Counter("kafka.publish.errors",
+			metric.WithUnit("{error}"),
+			metric.WithDescription("Measures the number of failed publish."))
+		collect(err)
+		i.received, err = m.Int64Counter(semconv.MessagingReceiveMessagesName,
+			metric.WithUnit(semconv.MessagingReceiveMessagesUnit),
+			metric.WithDescription(semconv.MessagingReceiveMessagesDescription))
+		collect(err)
+		i.receivedBytes, err = m.Int64Counter("messaging.receive.bytes",
+			metric.WithUnit("By"),
+			metric.WithDescription("Measures the size of received message values."))
+		collect(err)
+		i.processDuration, err = m.Float64Histogram(semconv.MessagingProcessDurationName,
+			metric.WithUnit(semconv.MessagingProcessDurationUnit),
+			metric.WithDescription(semconv.MessagingProcessDurationDescription))
+		collect(err)
+		i.processErrors, err = m.Int64Counter("kafka.process.errors",
+			metric.WithUnit("{error}"),
+			metric.WithDescription("Measures the number of failed handler calls."))
+		collect(err)
+		i.lag, err = m.Int64Gauge("kafka.consumer.lag",
+			metric.WithUnit("{message}"),
+			metric.WithDescription("Messages between the partition high water mark and the committed offset."))
+		collect(err)
+		i.rebalances, err = m.Int64Counter("kafka.consumer.rebalances",
+			metric.WithUnit("{rebalance}"),
+			metric.WithDescription("Measures the number of sessions started by consumer group rebalances."))
+		collect(err)
+
+		i.handlerDuration, err = m.Float64Histogram("kafka.handler.duration",
+			metric.WithUnit("s"),
+			metric.WithDescription("Measures the duration of handlers wrapped by the Metrics middleware."))
+		collect(err)
+
+		for _, err := range errs {
+			otel.Handle(err)
+		}
+		metricsInst = i
+	})
+	return metricsInst
+}
+
+// recordPublish record a publish of msg started at start
+func recordPublish(ctx context.Context, msg *MessageContext, start time.Time, err error) {
+	m := kafkaMetrics()
+	attrs := metric.WithAttributes(
+		semconv.MessagingSystemKafka,
+		semconv.MessagingDestinationName(msg.Topic),
+	)
+
+	m.publishDuration.Record(ctx, time.Since(start).Seconds(), attrs)
+	if err != nil {
+		m.publishErrors.Add(ctx, 1, attrs)
+		return
+	}
+	m.published.Add(ctx, 1, attrs)
+	m.publishedBytes.Add(ctx, int64(len(msg.Value)), attrs)
+}
+
+// recordReceive record consumed messages of topic and their value size
+func recordReceive(ctx context.Context, topic, groupID string, count, size int) {
+	m := kafkaMetrics()
+	attrs := metric.WithAttributes(
+		semconv.MessagingSystemKafka,
+		semconv.MessagingDestinationName(topic),
+		semconv.MessagingKafkaConsumerGroup(groupID),
+	)
+	m.received.Add(ctx, int64(count), attrs)
+	m.receivedBytes.Add(ctx, int64(size), attrs)
+}
+
+// recordProcess record a handler call started at start
+func recordProcess(ctx context.Context, topic, groupID string, start time.Time, err error) {
+	m := kafkaMetrics()
+	attrs := metric.WithAttributes(
+		semconv.MessagingSystemKafka,
+		semconv.MessagingDestinationName(topic),
+		semconv.MessagingKafkaConsumerGroup(groupID),
+	)
+
+	m.processDuration.Record(ctx, time.Since(start).Seconds(), attrs)
+	if err != nil {
+		m.processErrors.Add(ctx, 1, attrs)
+	}
+}
+
+// recordHandler record a call of the handler name started at start
+func recordHandler(ctx context.Context, name, topic string, start time.Time, err error) {
+	kafkaMetrics().handlerDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+		semconv.MessagingSystemKafka,
+		semconv.MessagingDestinationName(topic),
+		attribute.String("handler", name),
+		attribute.Bool("error", err != nil),
+	))
+}
+
+// recordRebalance record a new session of groupID
+func recordRebalance(ctx context.Context, groupID string) {
+	kafkaMetrics().rebalances.Add(ctx, 1, metric.WithAttributes(
+		semconv.MessagingSystemKafka,
+		semconv.MessagingKafkaConsumerGroup(groupID),
+	))
+}
+
+// lagSession record partition lag each time an offset is marked, the lag
+// is the claim high water mark minus the next offset to commit
+type lagSession struct {
+	sarama.ConsumerGroupSession
+	claim   sarama.ConsumerGroupClaim
+	groupID string
+}
+
+func newLagSession(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim, groupID string) sarama.ConsumerGroupSession {
+	return &lagSession{
+		ConsumerGroupSession: session,
+		claim:                claim,
+		groupID:              groupID,
+	}
+}
+
+func (s *lagSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.ConsumerGroupSession.MarkOffset(topic, partition, offset, metadata)
+	s.record(topic, partition, offset)
+}
+
+func (s *lagSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.ConsumerGroupSession.MarkMessage(msg, metadata)
+	s.record(msg.Topic, msg.Partition, msg.Offset+1)
+}
+
+func (s *lagSession) record(topic string, partition int32, next int64) {
+	lag := s.claim.HighWaterMarkOffset() - next
+	if lag < 0 {
+		lag = 0
+	}
+	kafkaMetrics().lag.Record(s.Context(), lag, metric.WithAttributes(
+		semconv.MessagingSystemKafka,
+		semconv.MessagingDestinationName(topic),
+		semconv.MessagingDestinationPartitionID(strconv.Itoa(int(partition))),
+		semconv.MessagingKafkaConsumerGroup(s.groupID),
+	))
+}
+
+// BridgeSaramaMetrics report every metric of a sarama go-metrics registry,
+// e.g. sarama.Config MetricRegistry, as the kafka.sarama.metric gauge. The
+// sarama name is set as the name attribute and each statistic of meters and
+// histograms as the stat attribute. Unregister the returned registration
+// once the client is closed.
+func BridgeSaramaMetrics(registry gometrics.Registry, attrs ...attribute.KeyValue) (metric.Registration, error) {
+	gauge, err := meter().Float64ObservableGauge(saramaMetricName,
+		metric.WithDescription("Sarama client metrics, see sarama documentation for each name."))
+	if err != nil {
+		return nil, err
+	}
+
+	return meter().RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		registry.Each(func(name string, v interface{}) {
+			observe := func(stat string, value float64) {
+				kv := append([]attribute.KeyValue{
+					attribute.String("name", name),
+					attribute.String("stat", stat),
+				}, attrs...)
+				o.ObserveFloat64(gauge, value, metric.WithAttributes(kv...))
+			}
+
+			switch m := v.(type) {
+			case gometrics.Counter:
+				observe("count", float64(m.Count()))
+			case gometrics.Gauge:
+				observe("value", float64(m.Value()))
+			case gometrics.GaugeFloat64:
+				observe("value", m.Value())
+			case gometrics.Meter:
+				s := m.Snapshot()
+				observe("count", float64(s.Count()))
+				observe("rate1", s.Rate1())
+				observe("rate_mean", s.RateMean())
+			case gometrics.Histogram:
+				s := m.Snapshot()
+				observe("count", float64(s.Count()))
+				observe("mean", s.Mean())
+				observe("max", float64(s.Max()))
+				observe("p99", s.Percentile(0.99))
+			}
+		})
+		return nil
+	}, gauge)
+}
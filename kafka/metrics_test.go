@@ -0,0 +1,98 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func collectMetrics(t *testing.T, reader sdkmetric.Reader) map[string]metricdata.Aggregation {
+	var rm metricdata.ResourceMetrics
+	assert.Nil(t, reader.Collect(context.Background(), &rm))
+
+	out := map[string]metricdata.Aggregation{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			out[m.Name] = m.Data
+		}
+	}
+	return out
+}
+
+func useMetricReader(t *testing.T) sdkmetric.Reader {
+	reader := sdkmetric.NewManualReader()
+	prev := otel.GetMeterProvider()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	t.Cleanup(func() { otel.SetMeterProvider(prev) })
+	return reader
+}
+
+func TestConsumerMetrics(t *testing.T) {
+	reader := useMetricReader(t)
+
+	session := newFakeSession(context.Background())
+	claim := &hwmClaim{
+		fakeClaim: newFakeClaim("orders", 0,
+			consumerMessage("orders", 0, 0, "a"),
+			consumerMessage("orders", 0, 1, "b"),
+		),
+		hwm: 5,
+	}
+
+	h := NewConsumerHandler(func(_ context.Context, _ *MessageDecoder) error {
+		return nil
+	}, false, "group")
+	assert.Nil(t, h.Setup(session))
+	assert.Nil(t, h.ConsumeClaim(session, claim))
+
+	registry := gometrics.NewRegistry()
+	gometrics.GetOrRegisterCounter("requests-in-flight", registry).Inc(3)
+	reg, err := BridgeSaramaMetrics(registry, attribute.String("client", "test"))
+	assert.Nil(t, err)
+	defer func() { _ = reg.Unregister() }()
+
+	data := collectMetrics(t, reader)
+
+	received := data["messaging.receive.messages"].(metricdata.Sum[int64])
+	assert.Equal(t, int64(2), received.DataPoints[0].Value)
+
+	processed := data["messaging.process.duration"].(metricdata.Histogram[float64])
+	assert.Equal(t, uint64(2), processed.DataPoints[0].Count)
+
+	rebalances := data["kafka.consumer.rebalances"].(metricdata.Sum[int64])
+	assert.Equal(t, int64(1), rebalances.DataPoints[0].Value)
+
+	lag := data["kafka.consumer.lag"].(metricdata.Gauge[int64])
+	assert.Equal(t, int64(3), lag.DataPoints[0].Value)
+
+	sarama := data[saramaMetricName].(metricdata.Gauge[float64])
+	assert.Equal(t, float64(3), sarama.DataPoints[0].Value)
+}
+
+func TestProducerCloseUnregisterMetrics(t *testing.T) {
+	reader := useMetricReader(t)
+
+	cfg := &Config{Brokers: []string{"localhost:9092"}}
+	config, err := newProducerConfig(cfg)
+	assert.Nil(t, err)
+	gometrics.GetOrRegisterCounter("requests-in-flight", config.MetricRegistry).Inc(1)
+
+	p := newProducer(cfg, config)
+	assert.Contains(t, collectMetrics(t, reader), saramaMetricName)
+
+	assert.Nil(t, p.Close())
+	assert.NotContains(t, collectMetrics(t, reader), saramaMetricName)
+}
+
+type hwmClaim struct {
+	*fakeClaim
+	hwm int64
+}
+
+func (c *hwmClaim) HighWaterMarkOffset() int64 { return c.hwm }
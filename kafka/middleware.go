@@ -0,0 +1,101 @@
+// Package kafka messaging broker
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/lukmanlukmin/go-lib/log"
+)
+
+// ErrHandlerPanic matched by errors.Is on errors of handlers recovered by Recover
+var ErrHandlerPanic = errors.New("[kafka] handler panic")
+
+// Middleware wrap a Handler with behaviour shared across handlers
+type Middleware func(next Handler) Handler
+
+// Chain return h wrapped by middlewares, the first middleware is the
+// outermost one and see the message first
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Recover turn handler panics into errors, the message is then retried or
+// forwarded like any failed message instead of crashing the consumer
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *MessageDecoder) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.WithContext(ctx).WithFields(map[string]interface{}{
+						"event":     logEventEventName,
+						"topic":     msg.Topic,
+						"partition": msg.Partition,
+						"offset":    msg.Offset,
+						"stack":     string(debug.Stack()),
+					}).Error(fmt.Sprintf("handler panic: %v", r))
+					err = fmt.Errorf("%w: %v", ErrHandlerPanic, r)
+				}
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Logging log every handled message with its duration, failures at warning
+// level and successes at debug level
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *MessageDecoder) error {
+			start := time.Now()
+			err := next(ctx, msg)
+
+			entry := log.WithContext(ctx).WithFields(map[string]interface{}{
+				"event":       logEventEventName,
+				"topic":       msg.Topic,
+				"partition":   msg.Partition,
+				"offset":      msg.Offset,
+				"key":         string(msg.Key),
+				"duration_ms": time.Since(start).Milliseconds(),
+			})
+			if err != nil {
+				entry.Warn(fmt.Sprintf("handle message failed: %s", err.Error()))
+			} else {
+				entry.Debug("message handled")
+			}
+			return err
+		}
+	}
+}
+
+// Timeout cancel the handler context after d, the handler must watch its
+// context for the timeout to take effect
+func Timeout(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *MessageDecoder) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Metrics record the duration of handler calls as kafka.handler.duration,
+// with name telling handlers of the same topic apart
+func Metrics(name string) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *MessageDecoder) error {
+			start := time.Now()
+			err := next(ctx, msg)
+			recordHandler(ctx, name, msg.Topic, start, err)
+			return err
+		}
+	}
+}
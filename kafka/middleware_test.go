@@ -0,0 +1,67 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, msg *MessageDecoder) error {
+				calls = append(calls, name)
+				return next(ctx, msg)
+			}
+		}
+	}
+
+	h := Chain(func(context.Context, *MessageDecoder) error {
+		calls = append(calls, "handler")
+		return nil
+	}, trace("outer"), trace("inner"), Logging(), Metrics("orders"))
+
+	assert.Nil(t, h(context.Background(), &MessageDecoder{Topic: "orders"}))
+	assert.Equal(t, []string{"outer", "inner", "handler"}, calls)
+}
+
+func TestRecoverKeepClaimLoop(t *testing.T) {
+	session := newFakeSession(context.Background())
+	claim := newFakeClaim("orders", 0,
+		consumerMessage("orders", 0, 0, "a"),
+		consumerMessage("orders", 0, 1, "b"),
+	)
+
+	panicked := false
+	var seen []int64
+	h := NewConsumerHandler(Chain(func(_ context.Context, msg *MessageDecoder) error {
+		if msg.Offset == 0 && !panicked {
+			panicked = true
+			panic("nil map")
+		}
+		seen = append(seen, msg.Offset)
+		return nil
+	}, Recover()), false, "group")
+
+	// the panicking message is retried like a failed one
+	assert.Nil(t, h.ConsumeClaim(session, claim))
+	assert.Equal(t, []int64{0, 1}, seen)
+	assert.Equal(t, int64(2), session.committed("orders", 0))
+
+	err := Chain(func(context.Context, *MessageDecoder) error { panic("boom") }, Recover())(context.Background(), &MessageDecoder{})
+	assert.ErrorIs(t, err, ErrHandlerPanic)
+}
+
+func TestTimeout(t *testing.T) {
+	h := Chain(func(ctx context.Context, _ *MessageDecoder) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, Timeout(10*time.Millisecond))
+
+	err := h(context.Background(), &MessageDecoder{})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
@@ -0,0 +1,53 @@
+// Package kafka messaging
+package kafka
+
+import (
+	"sync"
+)
+
+// offsetTracker track in-flight offsets of a partition processed out of order
+// and report the offset safe to commit, that is the one after the highest
+// offset whose predecessors are all completed.
+type offsetTracker struct {
+	mux       sync.Mutex
+	inflight  []int64
+	completed map[int64]bool
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		completed: make(map[int64]bool),
+	}
+}
+
+// add register offset as in-flight, offsets must be added in increasing order
+func (t *offsetTracker) add(offset int64) {
+	t.mux.Lock()
+	t.inflight = append(t.inflight, offset)
+	t.completed[offset] = false
+	t.mux.Unlock()
+}
+
+// complete mark offset as processed and call commit with the next offset to
+// consume when the lowest contiguous completed offset moved forward. commit
+// is called while holding the tracker lock so committed offsets never go back.
+func (t *offsetTracker) complete(offset int64, commit func(next int64)) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if _, ok := t.completed[offset]; !ok {
+		return
+	}
+	t.completed[offset] = true
+
+	last := int64(-1)
+	for len(t.inflight) > 0 && t.completed[t.inflight[0]] {
+		last = t.inflight[0]
+		delete(t.completed, last)
+		t.inflight = t.inflight[1:]
+	}
+
+	if last >= 0 {
+		commit(last + 1)
+	}
+}
@@ -0,0 +1,34 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffsetTrackerCommitLowestContiguous(t *testing.T) {
+	tracker := newOffsetTracker()
+	for _, o := range []int64{3, 4, 6, 7} {
+		tracker.add(o)
+	}
+
+	var commits []int64
+	commit := func(next int64) {
+		commits = append(commits, next)
+	}
+
+	tracker.complete(6, commit)
+	tracker.complete(4, commit)
+	assert.Empty(t, commits)
+
+	tracker.complete(3, commit)
+	assert.Equal(t, []int64{7}, commits)
+
+	// unknown or repeated offsets are ignored
+	tracker.complete(3, commit)
+	tracker.complete(42, commit)
+	assert.Equal(t, []int64{7}, commits)
+
+	tracker.complete(7, commit)
+	assert.Equal(t, []int64{7, 8}, commits)
+}
@@ -0,0 +1,126 @@
+// Package outbox publish kafka messages atomically with database changes.
+// Messages are written to an outbox table inside the caller transaction and
+// a Relay publish them to kafka once the transaction is committed.
+package outbox
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lukmanlukmin/go-lib/database"
+	"github.com/lukmanlukmin/go-lib/database/connection"
+	"github.com/lukmanlukmin/go-lib/kafka"
+)
+
+const (
+	// DefaultTable default outbox table name
+	DefaultTable = "kafka_outbox"
+	// MaxKeyBytes largest message key the outbox table hold
+	MaxKeyBytes = 1024
+)
+
+var (
+	// ErrNoTransaction returned when Publish is called outside database.BeginTransaction
+	ErrNoTransaction = errors.New("[outbox] publish require a transaction in context")
+	// ErrKeyTooLong returned by Publish for keys over MaxKeyBytes
+	ErrKeyTooLong = errors.New("[outbox] message key too long")
+)
+
+// Outbox write messages into the outbox table, it implements kafka.Producer
+// so it can replace a producer where messages must follow a transaction.
+type Outbox struct {
+	table string
+}
+
+// New return outbox writing to table, DefaultTable when empty
+func New(table string) *Outbox {
+	if table == "" {
+		table = DefaultTable
+	}
+	return &Outbox{table: table}
+}
+
+// Publish insert msg into the outbox using the transaction in ctx. Messages
+// sharing the same key are relayed in insertion order, keyless messages
+// are relayed independently of each other.
+func (o *Outbox) Publish(ctx context.Context, msg *kafka.MessageContext) error {
+	tx := database.GetTxFromContext(ctx)
+	if tx == nil {
+		return ErrNoTransaction
+	}
+	if len(msg.Key) > MaxKeyBytes {
+		return fmt.Errorf("%w: topic %s key of %d bytes", ErrKeyTooLong, msg.Topic, len(msg.Key))
+	}
+
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return err
+	}
+
+	query := tx.Rebind(fmt.Sprintf(
+		`INSERT INTO %s (aggregate_key, topic, message_key, payload, headers, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		o.table,
+	))
+
+	if _, err := tx.ExecContext(ctx, query, aggregateKey(msg.Key), msg.Topic, msg.Key, msg.Value, string(headers), time.Now().UTC()); err != nil {
+		return fmt.Errorf("[outbox] insert message topic %s got: %w", msg.Topic, err)
+	}
+	return nil
+}
+
+// aggregateKey return the key rows are ordered by, a digest of the message
+// key so keys of any size and bytes fit the indexed column
+func aggregateKey(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
+
+// Schema return CREATE TABLE statement of the outbox table for driver,
+// connection.DriverMySQL or connection.DriverPostgres
+func Schema(driver, table string) (string, error) {
+	if table == "" {
+		table = DefaultTable
+	}
+
+	switch driver {
+	case connection.DriverMySQL:
+		return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	aggregate_key CHAR(64) NOT NULL,
+	topic VARCHAR(255) NOT NULL,
+	message_key VARBINARY(1024) NULL,
+	payload LONGTEXT NOT NULL,
+	headers TEXT NULL,
+	created_at DATETIME(6) NOT NULL,
+	published_at DATETIME(6) NULL,
+	failed_at DATETIME(6) NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	last_error TEXT NULL,
+	INDEX %[1]s_pending_idx (published_at, failed_at, id),
+	INDEX %[1]s_aggregate_idx (aggregate_key, id)
+)`, table), nil
+	case connection.DriverPostgres:
+		return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+	id BIGSERIAL PRIMARY KEY,
+	aggregate_key CHAR(64) NOT NULL,
+	topic VARCHAR(255) NOT NULL,
+	message_key BYTEA NULL,
+	payload TEXT NOT NULL,
+	headers TEXT NULL,
+	created_at TIMESTAMP NOT NULL,
+	published_at TIMESTAMP NULL,
+	failed_at TIMESTAMP NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	last_error TEXT NULL
+);
+CREATE INDEX IF NOT EXISTS %[1]s_pending_idx ON %[1]s (id) WHERE published_at IS NULL AND failed_at IS NULL;
+CREATE INDEX IF NOT EXISTS %[1]s_aggregate_idx ON %[1]s (aggregate_key, id)`, table), nil
+	default:
+		return "", fmt.Errorf("[outbox] unsupported driver %q", driver)
+	}
+}
@@ -0,0 +1,327 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lukmanlukmin/go-lib/database"
+	"github.com/lukmanlukmin/go-lib/kafka"
+	"github.com/lukmanlukmin/go-lib/log"
+)
+
+const (
+	logEventName = "KafkaOutboxRelay"
+
+	defaultPollInterval    = time.Second
+	defaultBatchSize       = 100
+	defaultCleanupInterval = time.Hour
+
+	// keylessAggregate prefix of the row id aggregate of keyless rows
+	keylessAggregate = "id:"
+)
+
+//go:generate easytags $GOFILE json,yaml
+
+// RelayConfig entity of outbox relay
+type RelayConfig struct {
+	// Table outbox table name (defaults to kafka_outbox)
+	Table string `json:"table" yaml:"table"`
+	// PollIntervalMs wait between polls when the outbox is drained (defaults to 1000)
+	PollIntervalMs int `json:"poll_interval_ms" yaml:"poll_interval_ms"`
+	// BatchSize maximum rows locked and published per poll (defaults to 100)
+	BatchSize int `json:"batch_size" yaml:"batch_size"`
+	// SkipLocked lock rows with FOR UPDATE SKIP LOCKED so several relays
+	// share the outbox, otherwise relays wait on each other's lock
+	SkipLocked bool `json:"skip_locked" yaml:"skip_locked"`
+	// MaxAttempts publish attempts before a row is marked failed and skipped,
+	// 0 retries forever and holds back later messages of the same key
+	MaxAttempts int `json:"max_attempts" yaml:"max_attempts"`
+	// RetentionHours keep published rows this long, 0 keeps them forever
+	RetentionHours int `json:"retention_hours" yaml:"retention_hours"`
+}
+
+// Relay publish pending outbox rows to kafka
+type Relay struct {
+	db       *sqlx.DB
+	producer kafka.Producer
+	cfg      RelayConfig
+}
+
+type row struct {
+	ID           int64  `db:"id"`
+	AggregateKey string `db:"aggregate_key"`
+	Topic        string `db:"topic"`
+	MessageKey   []byte `db:"message_key"`
+	Payload      string `db:"payload"`
+	Headers      string `db:"headers"`
+	Attempts     int    `db:"attempts"`
+}
+
+// rowUpdateError failed update of a row status, the relay transaction
+// can't go on after it
+type rowUpdateError struct {
+	error
+}
+
+func (e *rowUpdateError) Unwrap() error {
+	return e.error
+}
+
+type pendingRow struct {
+	ID           int64  `db:"id"`
+	AggregateKey string `db:"aggregate_key"`
+}
+
+// NewRelay return relay publishing rows of db outbox through producer
+func NewRelay(db *sqlx.DB, producer kafka.Producer, cfg RelayConfig) *Relay {
+	if cfg.Table == "" {
+		cfg.Table = DefaultTable
+	}
+	if cfg.PollIntervalMs < 1 {
+		cfg.PollIntervalMs = int(defaultPollInterval / time.Millisecond)
+	}
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	return &Relay{
+		db:       db,
+		producer: producer,
+		cfg:      cfg,
+	}
+}
+
+// Run relay pending rows until ctx is done. A full batch is followed by the
+// next one right away, otherwise the relay wait for the poll interval.
+func (r *Relay) Run(ctx context.Context) error {
+	lf := map[string]interface{}{
+		"event": logEventName,
+		"table": r.cfg.Table,
+	}
+
+	poll := time.Duration(r.cfg.PollIntervalMs) * time.Millisecond
+	lastCleanup := time.Now()
+
+	for {
+		n, err := r.RelayBatch(ctx)
+		if err != nil {
+			log.WithFields(lf).Error(err.Error())
+		}
+
+		if r.cfg.RetentionHours > 0 && time.Since(lastCleanup) >= defaultCleanupInterval {
+			if err := r.Cleanup(ctx); err != nil {
+				log.WithFields(lf).Error(err.Error())
+			}
+			lastCleanup = time.Now()
+		}
+
+		wait := poll
+		if err == nil && n >= r.cfg.BatchSize {
+			wait = 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// RelayBatch lock and publish one batch of pending rows, it return the
+// number of rows locked. A failed row status update end the batch with its
+// error, the whole batch is then rolled back and relayed again.
+func (r *Relay) RelayBatch(ctx context.Context) (int, error) {
+	var locked int
+	err := database.BeginTransaction(ctx, r.db, func(ctx context.Context) error {
+		tx := database.GetTxFromContext(ctx)
+
+		lock := "FOR UPDATE"
+		if r.cfg.SkipLocked {
+			lock = "FOR UPDATE SKIP LOCKED"
+		}
+
+		var rows []row
+		err := tx.SelectContext(ctx, &rows, tx.Rebind(fmt.Sprintf(
+			`SELECT id, aggregate_key, topic, message_key, payload, headers, attempts FROM %s
+			WHERE published_at IS NULL AND failed_at IS NULL ORDER BY id LIMIT %d %s`,
+			r.cfg.Table, r.cfg.BatchSize, lock,
+		)))
+		if err != nil {
+			return fmt.Errorf("[outbox] select pending rows got: %w", err)
+		}
+		locked = len(rows)
+		if locked == 0 {
+			return nil
+		}
+		// keyless messages have no order to keep, each row is an
+		// aggregate of its own so a stuck row block no other
+		for i := range rows {
+			if len(rows[i].MessageKey) == 0 {
+				rows[i].AggregateKey = keylessAggregate + strconv.FormatInt(rows[i].ID, 10)
+			}
+		}
+
+		pending, err := r.pending(ctx, tx, rows)
+		if err != nil {
+			return err
+		}
+
+		blocked := map[string]bool{}
+		for _, rw := range publishable(rows, pending) {
+			if blocked[rw.AggregateKey] {
+				continue
+			}
+			if err := r.publish(ctx, tx, rw); err != nil {
+				// the transaction is unusable after a failed update, on
+				// Postgres it is aborted, the batch end there and roll back
+				var uerr *rowUpdateError
+				if errors.As(err, &uerr) {
+					return err
+				}
+				// later rows of the key wait so ordering is kept
+				blocked[rw.AggregateKey] = true
+				log.WithContext(ctx).WithFields(map[string]interface{}{
+					"event": logEventName,
+					"id":    rw.ID,
+					"topic": rw.Topic,
+				}).Warn(err.Error())
+			}
+		}
+		return nil
+	})
+	return locked, err
+}
+
+// pending return ids of all unpublished rows of the locked rows keys,
+// including rows locked by other relays
+func (r *Relay) pending(ctx context.Context, tx *sqlx.Tx, rows []row) (map[string][]int64, error) {
+	pending := map[string][]int64{}
+	keys := make([]string, 0, len(rows))
+	seen := map[string]bool{}
+	for _, rw := range rows {
+		if len(rw.MessageKey) == 0 {
+			pending[rw.AggregateKey] = []int64{rw.ID}
+			continue
+		}
+		if !seen[rw.AggregateKey] {
+			seen[rw.AggregateKey] = true
+			keys = append(keys, rw.AggregateKey)
+		}
+	}
+
+	if len(keys) == 0 {
+		return pending, nil
+	}
+
+	query, args, err := sqlx.In(fmt.Sprintf(
+		`SELECT id, aggregate_key FROM %s WHERE published_at IS NULL AND failed_at IS NULL AND aggregate_key IN (?) ORDER BY id`,
+		r.cfg.Table,
+	), keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []pendingRow
+	if err := tx.SelectContext(ctx, &ids, tx.Rebind(query), args...); err != nil {
+		return nil, fmt.Errorf("[outbox] select pending keys got: %w", err)
+	}
+
+	for _, p := range ids {
+		pending[p.AggregateKey] = append(pending[p.AggregateKey], p.ID)
+	}
+	return pending, nil
+}
+
+// publishable return locked rows that can be published without breaking
+// the order of their key: for every key only the locked rows matching the
+// head of its pending rows, stopping at the first row held by someone else.
+func publishable(rows []row, pending map[string][]int64) []row {
+	next := map[string]int{}
+	stopped := map[string]bool{}
+	out := make([]row, 0, len(rows))
+
+	for _, rw := range rows {
+		key := rw.AggregateKey
+		if stopped[key] {
+			continue
+		}
+
+		ids := pending[key]
+		i := next[key]
+		if i >= len(ids) || ids[i] != rw.ID {
+			stopped[key] = true
+			continue
+		}
+
+		next[key] = i + 1
+		out = append(out, rw)
+	}
+	return out
+}
+
+// publish send rw to kafka and record the outcome on the row
+func (r *Relay) publish(ctx context.Context, tx *sqlx.Tx, rw row) error {
+	msg := &kafka.MessageContext{
+		Topic: rw.Topic,
+		Key:   rw.MessageKey,
+		Value: rw.Payload,
+	}
+	if rw.Headers != "" {
+		if err := json.Unmarshal([]byte(rw.Headers), &msg.Headers); err != nil {
+			return r.fail(ctx, tx, rw, err)
+		}
+	}
+
+	if err := r.producer.Publish(ctx, msg); err != nil {
+		return r.fail(ctx, tx, rw, err)
+	}
+
+	_, err := tx.ExecContext(ctx, tx.Rebind(fmt.Sprintf(
+		`UPDATE %s SET published_at = ?, attempts = attempts + 1, last_error = NULL WHERE id = ?`, r.cfg.Table,
+	)), time.Now().UTC(), rw.ID)
+	if err != nil {
+		return &rowUpdateError{fmt.Errorf("[outbox] mark row %d published got: %w", rw.ID, err)}
+	}
+	return nil
+}
+
+// fail record publish error, marking the row failed once attempts are exhausted
+func (r *Relay) fail(ctx context.Context, tx *sqlx.Tx, rw row, cause error) error {
+	var failedAt interface{}
+	if r.cfg.MaxAttempts > 0 && rw.Attempts+1 >= r.cfg.MaxAttempts {
+		failedAt = time.Now().UTC()
+	}
+
+	_, err := tx.ExecContext(ctx, tx.Rebind(fmt.Sprintf(
+		`UPDATE %s SET attempts = attempts + 1, last_error = ?, failed_at = ? WHERE id = ?`, r.cfg.Table,
+	)), cause.Error(), failedAt, rw.ID)
+	if err != nil {
+		return &rowUpdateError{fmt.Errorf("[outbox] record row %d failure got: %w", rw.ID, err)}
+	}
+
+	if failedAt != nil {
+		return fmt.Errorf("[outbox] row %d failed after %d attempts: %w", rw.ID, rw.Attempts+1, cause)
+	}
+	return fmt.Errorf("[outbox] publish row %d got: %w", rw.ID, cause)
+}
+
+// Cleanup delete rows published before the retention period
+func (r *Relay) Cleanup(ctx context.Context) error {
+	if r.cfg.RetentionHours < 1 {
+		return nil
+	}
+
+	before := time.Now().UTC().Add(-time.Duration(r.cfg.RetentionHours) * time.Hour)
+	_, err := r.db.ExecContext(ctx, r.db.Rebind(fmt.Sprintf(
+		`DELETE FROM %s WHERE published_at IS NOT NULL AND published_at < ?`, r.cfg.Table,
+	)), before)
+	if err != nil {
+		return fmt.Errorf("[outbox] cleanup got: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/lukmanlukmin/go-lib/database"
+	"github.com/lukmanlukmin/go-lib/database/connection"
+	"github.com/lukmanlukmin/go-lib/kafka"
+	"github.com/stretchr/testify/assert"
+)
+
+func ids(rows []row) []int64 {
+	out := make([]int64, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, r.ID)
+	}
+	return out
+}
+
+func TestPublishableKeepKeyOrder(t *testing.T) {
+	locked := []row{
+		{ID: 1, AggregateKey: "a"},
+		{ID: 2, AggregateKey: "a"},
+		{ID: 4, AggregateKey: "a"},
+		{ID: 5, AggregateKey: "b"},
+		{ID: 7, AggregateKey: "c"},
+	}
+	pending := map[string][]int64{
+		// row 3 is locked by another relay, 4 must wait for it
+		"a": {1, 2, 3, 4},
+		"b": {5},
+		// row 6 is held elsewhere, nothing of c can go first
+		"c": {6, 7},
+	}
+
+	assert.Equal(t, []int64{1, 2, 5}, ids(publishable(locked, pending)))
+}
+
+func TestSchema(t *testing.T) {
+	for _, driver := range []string{connection.DriverMySQL, connection.DriverPostgres} {
+		ddl, err := Schema(driver, "")
+		assert.Nil(t, err)
+		assert.Contains(t, ddl, "CREATE TABLE IF NOT EXISTS kafka_outbox")
+	}
+
+	_, err := Schema("sqlite3", "")
+	assert.NotNil(t, err)
+}
+
+// fakeProducer fail messages of the failing topics
+type fakeProducer struct {
+	failing   map[string]bool
+	published []*kafka.MessageContext
+}
+
+func (p *fakeProducer) Publish(_ context.Context, msg *kafka.MessageContext) error {
+	if p.failing[msg.Topic] {
+		return errors.New("broker down")
+	}
+	p.published = append(p.published, msg)
+	return nil
+}
+
+func newMockDB(t *testing.T) (*sqlx.DB, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	return sqlx.NewDb(db, "mysql"), mock
+}
+
+func TestPublish(t *testing.T) {
+	db, mock := newMockDB(t)
+	ctx := context.Background()
+	msg := &kafka.MessageContext{Topic: "orders", Key: []byte("o-1"), Value: "v", Headers: map[string]string{"a": "b"}}
+
+	assert.ErrorIs(t, New("").Publish(ctx, msg), ErrNoTransaction)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO kafka_outbox").
+		WithArgs(aggregateKey([]byte("o-1")), "orders", []byte("o-1"), "v", `{"a":"b"}`, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	// the too long key roll the transaction back
+	mock.ExpectRollback()
+
+	err := database.BeginTransaction(ctx, db, func(ctx context.Context) error {
+		if err := New("").Publish(ctx, msg); err != nil {
+			return err
+		}
+		return New("").Publish(ctx, &kafka.MessageContext{Topic: "orders", Key: make([]byte, MaxKeyBytes+1)})
+	})
+	assert.ErrorIs(t, err, ErrKeyTooLong)
+	assert.Len(t, aggregateKey(make([]byte, MaxKeyBytes)), 64)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func expectBatch(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, aggregate_key, topic, message_key, payload, headers, attempts FROM kafka_outbox").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "aggregate_key", "topic", "message_key", "payload", "headers", "attempts"}).
+			AddRow(1, "a", "orders", []byte("a"), "v1", `{"h":"1"}`, 0).
+			AddRow(2, "b", "payments", []byte("b"), "v2", "", 2).
+			AddRow(3, "c", "orders", []byte("c"), "v3", "", 0))
+	mock.ExpectQuery("SELECT id, aggregate_key FROM kafka_outbox").
+		WithArgs("a", "b", "c").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "aggregate_key"}).AddRow(1, "a").AddRow(2, "b").AddRow(3, "c"))
+}
+
+func TestRelayBatch(t *testing.T) {
+	db, mock := newMockDB(t)
+	producer := &fakeProducer{failing: map[string]bool{"payments": true}}
+	relay := NewRelay(db, producer, RelayConfig{MaxAttempts: 3})
+
+	expectBatch(mock)
+	mock.ExpectExec("UPDATE kafka_outbox SET published_at").WithArgs(sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	// third attempt of row 2 mark it failed
+	mock.ExpectExec("UPDATE kafka_outbox SET attempts").WithArgs("broker down", sqlmock.AnyArg(), 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE kafka_outbox SET published_at").WithArgs(sqlmock.AnyArg(), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	n, err := relay.RelayBatch(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	if assert.Len(t, producer.published, 2) {
+		assert.Equal(t, map[string]string{"h": "1"}, producer.published[0].Headers)
+		assert.Equal(t, "a", string(producer.published[0].Key))
+		assert.Equal(t, "v3", producer.published[1].Value)
+	}
+}
+
+func TestRelayBatchKeylessRows(t *testing.T) {
+	db, mock := newMockDB(t)
+	producer := &fakeProducer{failing: map[string]bool{"payments": true}}
+	relay := NewRelay(db, producer, RelayConfig{MaxAttempts: 3})
+
+	// keyless rows share the digest of an empty key
+	keyless := aggregateKey(nil)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, aggregate_key, topic, message_key, payload, headers, attempts FROM kafka_outbox").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "aggregate_key", "topic", "message_key", "payload", "headers", "attempts"}).
+			AddRow(1, keyless, "payments", nil, "v1", "", 0).
+			AddRow(2, keyless, "orders", nil, "v2", "", 0).
+			AddRow(3, "a", "orders", []byte("a"), "v3", "", 0))
+	// only keyed rows are looked up
+	mock.ExpectQuery("SELECT id, aggregate_key FROM kafka_outbox").
+		WithArgs("a").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "aggregate_key"}).AddRow(3, "a"))
+	mock.ExpectExec("UPDATE kafka_outbox SET attempts").WithArgs("broker down", nil, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE kafka_outbox SET published_at").WithArgs(sqlmock.AnyArg(), 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE kafka_outbox SET published_at").WithArgs(sqlmock.AnyArg(), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	n, err := relay.RelayBatch(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// the failed keyless row don't hold the next one
+	if assert.Len(t, producer.published, 2) {
+		assert.Equal(t, "v2", producer.published[0].Value)
+		assert.Equal(t, "v3", producer.published[1].Value)
+	}
+}
+
+func TestRelayBatchStopOnUpdateFailure(t *testing.T) {
+	db, mock := newMockDB(t)
+	producer := &fakeProducer{}
+	relay := NewRelay(db, producer, RelayConfig{})
+
+	expectBatch(mock)
+	mock.ExpectExec("UPDATE kafka_outbox SET published_at").WithArgs(sqlmock.AnyArg(), 1).WillReturnError(errors.New("current transaction is aborted"))
+	mock.ExpectRollback()
+
+	_, err := relay.RelayBatch(context.Background())
+	assert.ErrorContains(t, err, "mark row 1 published")
+	assert.Nil(t, mock.ExpectationsWereMet())
+	// rows after the failed update are left for the next batch
+	assert.Len(t, producer.published, 1)
+}
+
+func TestRelayFailRecordAttempts(t *testing.T) {
+	db, mock := newMockDB(t)
+	relay := NewRelay(db, &fakeProducer{}, RelayConfig{MaxAttempts: 5})
+	cause := errors.New("broker down")
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE kafka_outbox SET attempts").WithArgs("broker down", nil, 7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE kafka_outbox SET attempts").WithArgs("broker down", sqlmock.AnyArg(), 8).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE kafka_outbox SET attempts").WithArgs("broker down", nil, 9).WillReturnError(errors.New("deadlock"))
+	mock.ExpectRollback()
+
+	err := database.BeginTransaction(context.Background(), db, func(ctx context.Context) error {
+		tx := database.GetTxFromContext(ctx)
+
+		err := relay.fail(ctx, tx, row{ID: 7, Attempts: 1}, cause)
+		assert.ErrorIs(t, err, cause)
+		assert.NotContains(t, err.Error(), "failed after")
+
+		err = relay.fail(ctx, tx, row{ID: 8, Attempts: 4}, cause)
+		assert.ErrorIs(t, err, cause)
+		assert.Contains(t, err.Error(), "failed after 5 attempts")
+
+		return relay.fail(ctx, tx, row{ID: 9}, cause)
+	})
+	var uerr *rowUpdateError
+	assert.ErrorAs(t, err, &uerr)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRelayCleanup(t *testing.T) {
+	db, mock := newMockDB(t)
+
+	// without retention nothing is deleted
+	assert.Nil(t, NewRelay(db, &fakeProducer{}, RelayConfig{}).Cleanup(context.Background()))
+
+	relay := NewRelay(db, &fakeProducer{}, RelayConfig{RetentionHours: 24})
+	mock.ExpectExec("DELETE FROM kafka_outbox WHERE published_at IS NOT NULL").WithArgs(sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 4))
+	assert.Nil(t, relay.Cleanup(context.Background()))
+
+	mock.ExpectExec("DELETE FROM kafka_outbox").WillReturnError(errors.New("lock wait timeout"))
+	assert.ErrorContains(t, relay.Cleanup(context.Background()), "[outbox] cleanup got")
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
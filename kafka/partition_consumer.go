@@ -0,0 +1,239 @@
+// Package kafka messaging broker
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/lukmanlukmin/go-lib/log"
+)
+
+// ErrIncompleteRange returned by PartitionConsumer Consume when it can't
+// confirm the messages before StopOffset were all read
+var ErrIncompleteRange = errors.New("[kafka] partition range incomplete")
+
+// Position where a PartitionConsumer start reading, see FromOffset,
+// FromLast and FromTime
+type Position struct {
+	offset int64
+	last   int64
+	at     time.Time
+}
+
+// FromOffset start at offset, sarama.OffsetOldest or sarama.OffsetNewest
+func FromOffset(offset int64) Position {
+	return Position{offset: offset}
+}
+
+// FromLast start n messages before the end of the partition, or at its
+// oldest message when it hold fewer
+func FromLast(n int64) Position {
+	return Position{offset: sarama.OffsetNewest, last: n}
+}
+
+// FromTime start at the first message produced at or after t
+func FromTime(t time.Time) Position {
+	return Position{at: t}
+}
+
+// PartitionContext partition read by PartitionConsumer Consume
+type PartitionContext struct {
+	Handler   Handler
+	Topic     string
+	Partition int32
+	Start     Position
+	// StopOffset stop once the messages before StopOffset are handled,
+	// sarama.OffsetNewest stop at the end of the partition when Consume
+	// start, right away when it is empty, and 0 consume until Context is
+	// done
+	StopOffset int64
+	Context    context.Context
+}
+
+type partitionConsumer struct {
+	client   sarama.Client
+	consumer sarama.Consumer
+}
+
+// NewPartitionConsumer return consumer reading single partitions without
+// joining a group, no offset is committed
+func NewPartitionConsumer(cfg *Config) (PartitionConsumer, error) {
+	config, err := newConsumerConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sarama.NewClient(cfg.Brokers, config)
+	if err != nil {
+		return nil, &ConnectionError{Brokers: cfg.Brokers, Attempts: 1, Err: err}
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("[kafka] create partition consumer got: %w", err)
+	}
+
+	return &partitionConsumer{client: client, consumer: consumer}, nil
+}
+
+// Consume pass every message of the partition from ctx.Start to ctx.Handler
+// in order. It block until StopOffset is reached, ctx.Context is done or
+// the handler return an error, which is returned. ErrIncompleteRange is
+// returned when fetching fail before StopOffset is confirmed.
+func (k *partitionConsumer) Consume(ctx *PartitionContext) error {
+	nCtx := ctx.Context
+	if nCtx == nil {
+		nCtx = context.Background()
+	}
+
+	start, err := k.startOffset(ctx.Topic, ctx.Partition, ctx.Start)
+	if err != nil {
+		return err
+	}
+
+	stop, bounded := ctx.StopOffset, ctx.StopOffset != 0
+	if stop == sarama.OffsetNewest {
+		if stop, err = k.offset(ctx.Topic, ctx.Partition, sarama.OffsetNewest); err != nil {
+			return err
+		}
+	}
+	if bounded && start >= stop {
+		return nil
+	}
+
+	pc, err := k.consumer.ConsumePartition(ctx.Topic, ctx.Partition, start)
+	if err != nil {
+		return fmt.Errorf("[kafka] consume topic %s partition %d from %d got: %w", ctx.Topic, ctx.Partition, start, err)
+	}
+	defer pc.Close()
+
+	// the offsets before stop may end with transaction markers or aborted
+	// messages which are never delivered, the end is then reached once the
+	// high water mark passed stop and fetches at the end returned nothing.
+	// A failed fetch back off longer than the quiet period, which then
+	// prove nothing: the range is incomplete unless a message came after
+	// the last error.
+	endWait := 2 * k.client.Config().Consumer.MaxWaitTime
+	end := time.NewTimer(endWait)
+	defer end.Stop()
+	if !bounded {
+		end.Stop()
+	}
+
+	next, failed := start, false
+	incomplete := func() error {
+		return fmt.Errorf("%w: topic %s partition %d read up to %d before %d", ErrIncompleteRange, ctx.Topic, ctx.Partition, next, stop)
+	}
+	for {
+		select {
+		case <-nCtx.Done():
+			return nil
+		case <-end.C:
+			if failed {
+				return incomplete()
+			}
+			if pc.HighWaterMarkOffset() >= stop {
+				return nil
+			}
+			end.Reset(endWait)
+		case err := <-pc.Errors():
+			failed = true
+			log.WithFields(map[string]interface{}{
+				"event":     logEventEventName,
+				"topic":     ctx.Topic,
+				"partition": ctx.Partition,
+			}).Warn(fmt.Sprintf("consume partition got: %s", err.Error()))
+		case msg, ok := <-pc.Messages():
+			if !ok {
+				if bounded {
+					return incomplete()
+				}
+				return nil
+			}
+			next, failed = msg.Offset+1, false
+			if err := k.handle(nCtx, ctx.Handler, msg); err != nil {
+				return fmt.Errorf("[kafka] handle topic %s partition %d offset %d got: %w", msg.Topic, msg.Partition, msg.Offset, err)
+			}
+			if bounded {
+				if msg.Offset+1 >= stop {
+					return nil
+				}
+				end.Reset(endWait)
+			}
+		}
+	}
+}
+
+// handle decode msg and pass it to handler within a consumer span
+func (k *partitionConsumer) handle(ctx context.Context, handler Handler, msg *sarama.ConsumerMessage) error {
+	headers := headerMap(msg.Headers)
+	ctx, span := startConsumerSpan(ctx, msg, "", headers)
+	recordReceive(ctx, msg.Topic, "", 1, len(msg.Value))
+
+	start := time.Now()
+	err := handler(ctx, &MessageDecoder{
+		Body:      msg.Value,
+		Key:       msg.Key,
+		Headers:   headers,
+		Partition: msg.Partition,
+		TimeStamp: msg.Timestamp,
+		Offset:    msg.Offset,
+		Topic:     msg.Topic,
+		// there is no group offset to commit
+		Commit: func(*MessageDecoder) {},
+		ctx:    ctx,
+	})
+	recordProcess(ctx, msg.Topic, "", start, err)
+
+	endSpan(span, err)
+	return err
+}
+
+// startOffset resolve p to the offset of the first message to read
+func (k *partitionConsumer) startOffset(topic string, partition int32, p Position) (int64, error) {
+	if !p.at.IsZero() {
+		offset, err := k.offset(topic, partition, p.at.UnixMilli())
+		if err != nil {
+			return 0, err
+		}
+		// no message produced since p.at
+		if offset == sarama.OffsetNewest {
+			return k.offset(topic, partition, sarama.OffsetNewest)
+		}
+		return offset, nil
+	}
+
+	if p.offset >= 0 {
+		return p.offset, nil
+	}
+
+	offset, err := k.offset(topic, partition, p.offset)
+	if err != nil || p.last <= 0 {
+		return offset, err
+	}
+
+	oldest, err := k.offset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, err
+	}
+	return max(offset-p.last, oldest), nil
+}
+
+// offset lookup the offset of partition at a time in milliseconds,
+// sarama.OffsetOldest or sarama.OffsetNewest
+func (k *partitionConsumer) offset(topic string, partition int32, at int64) (int64, error) {
+	offset, err := k.client.GetOffset(topic, partition, at)
+	if err != nil {
+		return 0, fmt.Errorf("[kafka] get offset of topic %s partition %d got: %w", topic, partition, err)
+	}
+	return offset, nil
+}
+
+// Close release the broker connections
+func (k *partitionConsumer) Close() error {
+	return errors.Join(k.consumer.Close(), k.client.Close())
+}
@@ -0,0 +1,171 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func newMockPartitionConsumer(t *testing.T, fetch *sarama.MockFetchResponse, offsets *sarama.MockOffsetResponse) PartitionConsumer {
+	broker := sarama.NewMockBroker(t, 1)
+	t.Cleanup(broker.Close)
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("orders", 0, broker.BrokerID()),
+		"OffsetRequest": offsets,
+		"FetchRequest":  fetch,
+	})
+
+	c, err := NewPartitionConsumer(&Config{Brokers: []string{broker.Addr()}})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func TestPartitionConsumerFromLastUntilEnd(t *testing.T) {
+	fetch := sarama.NewMockFetchResponse(t, 10).SetHighWaterMark("orders", 0, 10)
+	for i := int64(0); i < 10; i++ {
+		fetch.SetMessage("orders", 0, i, sarama.StringEncoder("v"))
+	}
+	offsets := sarama.NewMockOffsetResponse(t).
+		SetOffset("orders", 0, sarama.OffsetOldest, 0).
+		SetOffset("orders", 0, sarama.OffsetNewest, 10)
+	c := newMockPartitionConsumer(t, fetch, offsets)
+
+	var seen []int64
+	err := c.Consume(&PartitionContext{
+		Topic:      "orders",
+		Start:      FromLast(3),
+		StopOffset: sarama.OffsetNewest,
+		Handler: func(_ context.Context, msg *MessageDecoder) error {
+			seen = append(seen, msg.Offset)
+			msg.Commit(msg)
+			return nil
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{7, 8, 9}, seen)
+}
+
+func TestPartitionConsumerFromTimeStopOnHandlerError(t *testing.T) {
+	at := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	fetch := sarama.NewMockFetchResponse(t, 10).SetHighWaterMark("orders", 0, 10)
+	for i := int64(0); i < 10; i++ {
+		fetch.SetMessage("orders", 0, i, sarama.StringEncoder("v"))
+	}
+	offsets := sarama.NewMockOffsetResponse(t).
+		SetOffset("orders", 0, sarama.OffsetOldest, 0).
+		SetOffset("orders", 0, sarama.OffsetNewest, 10).
+		SetOffset("orders", 0, at.UnixMilli(), 4)
+	c := newMockPartitionConsumer(t, fetch, offsets)
+
+	boom := errors.New("boom")
+	var seen []int64
+	err := c.Consume(&PartitionContext{
+		Topic: "orders",
+		Start: FromTime(at),
+		Handler: func(_ context.Context, msg *MessageDecoder) error {
+			seen = append(seen, msg.Offset)
+			if msg.Offset == 5 {
+				return boom
+			}
+			return nil
+		},
+	})
+	assert.ErrorIs(t, err, boom)
+	assert.Equal(t, []int64{4, 5}, seen)
+}
+
+func TestPartitionConsumerStopAtEnd(t *testing.T) {
+	for name, tc := range map[string]struct {
+		messages int64
+		hwm      int64
+		want     []int64
+	}{
+		"empty partition": {messages: 0, hwm: 0},
+		// offsets 8 and 9 are transaction markers never delivered
+		"gap before end": {messages: 8, hwm: 10, want: []int64{5, 6, 7}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fetch := sarama.NewMockFetchResponse(t, 10).SetHighWaterMark("orders", 0, tc.hwm)
+			for i := int64(0); i < tc.messages; i++ {
+				fetch.SetMessage("orders", 0, i, sarama.StringEncoder("v"))
+			}
+			offsets := sarama.NewMockOffsetResponse(t).
+				SetOffset("orders", 0, sarama.OffsetOldest, 0).
+				SetOffset("orders", 0, sarama.OffsetNewest, tc.hwm)
+			c := newMockPartitionConsumer(t, fetch, offsets)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var seen []int64
+			err := c.Consume(&PartitionContext{
+				Topic:      "orders",
+				Start:      FromLast(5),
+				StopOffset: sarama.OffsetNewest,
+				Context:    ctx,
+				Handler: func(_ context.Context, msg *MessageDecoder) error {
+					seen = append(seen, msg.Offset)
+					return nil
+				},
+			})
+			assert.Nil(t, err)
+			assert.Nil(t, ctx.Err())
+			assert.Equal(t, tc.want, seen)
+		})
+	}
+}
+
+func TestPartitionConsumerFetchErrorIncomplete(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	fetch := sarama.NewMockFetchResponse(t, 10).SetHighWaterMark("orders", 0, 10)
+	for i := int64(0); i < 5; i++ {
+		fetch.SetMessage("orders", 0, i, sarama.StringEncoder("v"))
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("orders", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("orders", 0, sarama.OffsetOldest, 0).
+			SetOffset("orders", 0, sarama.OffsetNewest, 10),
+		"FetchRequest": fetch,
+	})
+	c, err := NewPartitionConsumer(&Config{Brokers: []string{broker.Addr()}})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer func() { _ = c.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the broker is gone once offset 4 is read, the high water mark
+	// already passed the stop offset
+	var seen []int64
+	err = c.Consume(&PartitionContext{
+		Topic:      "orders",
+		Start:      FromOffset(sarama.OffsetOldest),
+		StopOffset: 10,
+		Context:    ctx,
+		Handler: func(_ context.Context, msg *MessageDecoder) error {
+			seen = append(seen, msg.Offset)
+			if msg.Offset == 4 {
+				broker.Close()
+			}
+			return nil
+		},
+	})
+	assert.ErrorIs(t, err, ErrIncompleteRange)
+	assert.Nil(t, ctx.Err())
+	assert.Equal(t, []int64{0, 1, 2, 3, 4}, seen)
+}
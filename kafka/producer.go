@@ -4,13 +4,19 @@ package kafka
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/google/uuid"
 	"github.com/lukmanlukmin/go-lib/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 const (
@@ -28,21 +34,47 @@ var (
 )
 
 type producer struct {
-	config   *sarama.Config
-	brokers  []string
+	cfg     *Config
+	config  *sarama.Config
+	brokers []string
+	// metrics bridge sarama metrics until Close
+	metrics metric.Registration
+
+	mux      sync.RWMutex
 	producer sarama.SyncProducer
+	// connecting serialize connection attempts, held while an attempt is
+	// made or a failed one is backing off
+	connecting chan struct{}
+	backoff    *backoff
+	retryAt    time.Time
+	attempts   int
+	lastErr    error
 }
 
 // SyncPublisher publish message  synchronously
-func (k *producer) Publish(_ context.Context, msg *MessageContext) error {
+func (k *producer) Publish(ctx context.Context, msg *MessageContext) (err error) {
 
 	key, err := uuid.NewUUID()
 	if err != nil {
 		return fmt.Errorf("fail to create producer key")
 	}
+
+	headers := make(map[string]string, len(msg.Headers))
+	for hk, hv := range msg.Headers {
+		headers[hk] = hv
+	}
+
+	start := time.Now()
+	_, span := startProducerSpan(ctx, msg, headers)
+	defer func() {
+		endSpan(span, err)
+		recordPublish(ctx, msg, start, err)
+	}()
+
 	param := &sarama.ProducerMessage{
 		Topic:     msg.Topic,
 		Value:     sarama.StringEncoder(msg.Value),
+		Headers:   recordHeaders(headers),
 		Partition: msg.Partition,
 		Offset:    msg.Offset,
 		Timestamp: msg.TimeStamp,
@@ -53,12 +85,22 @@ func (k *producer) Publish(_ context.Context, msg *MessageContext) error {
 		param.Key = sarama.ByteEncoder(msg.Key)
 	}
 
-	partition, offset, err := k.producer.SendMessage(param)
+	client, err := k.client(ctx)
+	if err != nil {
+		return err
+	}
+
+	partition, offset, err := client.SendMessage(param)
 
 	if err != nil {
 		return fmt.Errorf("[kafka-publisher] topic: %s, partition %d, offset %d, id %v, got: %w", msg.Topic, partition, offset, msg.LogId, err)
 	}
 
+	span.SetAttributes(
+		semconv.MessagingDestinationPartitionID(strconv.Itoa(int(partition))),
+		semconv.MessagingKafkaMessageOffset(int(offset)),
+	)
+
 	if msg.Verbose {
 		lf := map[string]interface{}{}
 		lf["msg"] = msg.Value
@@ -67,23 +109,143 @@ func (k *producer) Publish(_ context.Context, msg *MessageContext) error {
 	return nil
 }
 
-// NewProducer return message producer
-func NewProducer(cfg *Config) Producer {
+// NewProducer return message producer. The brokers are connected on the
+// first publish, failed connections are retried with backoff until the
+// publish context is done.
+func NewProducer(cfg *Config) (ProducerCloser, error) {
+	config, err := newProducerConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newProducer(cfg, config), nil
+}
+
+// newProducer return producer connecting lazily with config
+func newProducer(cfg *Config, config *sarama.Config) *producer {
+	m := &producer{
+		cfg:        cfg,
+		config:     config,
+		brokers:    cfg.Brokers,
+		connecting: make(chan struct{}, 1),
+		backoff:    newConnectBackoff(cfg),
+	}
 
-	m := &producer{}
-	/**
-	 * Construct a new Sarama configuration.
-	 * The Kafka cluster version has to be defined before the consumer/producer is initialized.
-	 */
-	config := sarama.NewConfig()
+	reg, err := BridgeSaramaMetrics(config.MetricRegistry, attribute.String("client", "producer"))
+	if err != nil {
+		log.Warn(fmt.Sprintf("bridge sarama producer metrics got: %s", err.Error()))
+	}
+	m.metrics = reg
 
-	if cfg.Version == "" {
-		cfg.Version = defaultVersion
+	return m
+}
+
+// Close close the brokers connection and stop reporting sarama metrics,
+// the producer must not be used afterwards
+func (k *producer) Close() error {
+	k.mux.Lock()
+	p, reg := k.producer, k.metrics
+	k.producer, k.metrics = nil, nil
+	k.mux.Unlock()
+
+	var errs []error
+	if reg != nil {
+		if err := reg.Unregister(); err != nil {
+			errs = append(errs, fmt.Errorf("[kafka-publisher] unregister metrics got: %w", err))
+		}
+	}
+	if p != nil {
+		if err := p.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("[kafka-publisher] close producer got: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// client return the sync producer, connecting it when needed
+func (k *producer) client(ctx context.Context) (sarama.SyncProducer, error) {
+	k.mux.RLock()
+	p := k.producer
+	k.mux.RUnlock()
+	if p != nil {
+		return p, nil
 	}
 
-	version, err := sarama.ParseKafkaVersion(cfg.Version)
+	select {
+	case k.connecting <- struct{}{}:
+	case <-ctx.Done():
+		return nil, k.connectionError(ctx.Err())
+	}
+	defer func() {
+		<-k.connecting
+	}()
+
+	for {
+		k.mux.RLock()
+		p, retryAt := k.producer, k.retryAt
+		k.mux.RUnlock()
+		if p != nil {
+			return p, nil
+		}
+
+		if !sleep(ctx, time.Until(retryAt)) {
+			return nil, k.connectionError(ctx.Err())
+		}
+
+		p, err := k.connect()
+
+		k.mux.Lock()
+		k.attempts++
+		if err == nil {
+			k.producer = p
+			k.attempts, k.lastErr = 0, nil
+			k.backoff.reset()
+			k.mux.Unlock()
+			return p, nil
+		}
+		wait := k.backoff.next()
+		k.lastErr = err
+		k.retryAt = time.Now().Add(wait)
+		k.mux.Unlock()
+
+		log.Warn(fmt.Sprintf("[kafka-publisher] connect brokers %v got: %s, retry in %s", k.brokers, err.Error(), wait))
+	}
+}
+
+// connect ensure configured topics and open the sync producer
+func (k *producer) connect() (sarama.SyncProducer, error) {
+	if err := ensureTopics(k.cfg); err != nil {
+		return nil, err
+	}
+	return sarama.NewSyncProducer(k.brokers, k.config)
+}
+
+// connectionError return the last connection failure, ctxErr when no attempt was made yet
+func (k *producer) connectionError(ctxErr error) error {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+
+	if k.lastErr == nil {
+		return &ConnectionError{Brokers: k.brokers, Err: ctxErr}
+	}
+	return &ConnectionError{Brokers: k.brokers, Attempts: k.attempts, Err: k.lastErr}
+}
+
+// newProducerConfig return sarama producer configuration from cfg, a
+// *ConfigError when cfg is invalid
+func newProducerConfig(cfg *Config) (*sarama.Config, error) {
+	config, err := producerConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return validClientConfig(config)
+}
+
+// producerConfig return sarama producer configuration from cfg before
+// sarama validate it
+func producerConfig(cfg *Config) (*sarama.Config, error) {
+	config, err := newClientConfig(cfg)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("parse kafka version got: %v", err))
+		return nil, err
 	}
 
 	config.Producer.Idempotent = cfg.Producer.IdemPotent
@@ -94,8 +256,6 @@ func NewProducer(cfg *Config) Producer {
 		config.Net.MaxOpenRequests = 1
 	}
 
-	config.Version = version
-
 	if len(strings.Trim(cfg.Producer.PartitionStrategy, " ")) == 0 {
 		cfg.Producer.PartitionStrategy = "hash"
 	}
@@ -103,24 +263,7 @@ func NewProducer(cfg *Config) Producer {
 	strategy, ok := partitiions[cfg.Producer.PartitionStrategy]
 
 	if !ok {
-		log.Fatal(fmt.Sprintf("[kafka] invalid producer partition strategy %s", cfg.Producer.PartitionStrategy))
-	}
-
-	if cfg.SASL.Enable {
-		config.Net.SASL.Enable = true
-		config.Net.SASL.User = cfg.SASL.User
-		config.Net.SASL.Password = cfg.SASL.Password
-		config.Net.SASL.Version = cfg.SASL.Version
-		config.Net.SASL.Handshake = cfg.SASL.Handshake
-		config.Net.SASL.Mechanism = sarama.SASLMechanism(cfg.SASL.Mechanism)
-		config.Net.TLS.Enable = true
-	}
-
-	// The TLS configuration to use for secure connections if
-	// enabled (defaults to nil).
-	if config.Net.TLS.Enable || cfg.TLS.Enable {
-		config.Net.TLS.Config = createTlsConfig(cfg.TLS)
-		config.Net.TLS.Enable = true
+		return nil, &ConfigError{Problems: []error{fmt.Errorf("producer partition strategy %q not supported", cfg.Producer.PartitionStrategy)}}
 	}
 
 	config.Producer.Partitioner = strategy
@@ -134,20 +277,23 @@ func NewProducer(cfg *Config) Producer {
 		config.Producer.Timeout = defaultTimeout * time.Second
 	}
 
-	if cfg.ChannelBufferSize > 0 {
-		config.ChannelBufferSize = cfg.ChannelBufferSize
+	if cfg.Producer.Compression != "" {
+		if err := config.Producer.Compression.UnmarshalText([]byte(cfg.Producer.Compression)); err != nil {
+			return nil, &ConfigError{Problems: []error{fmt.Errorf("producer compression: %w", err)}}
+		}
+		if cfg.Producer.CompressionLevel != 0 {
+			config.Producer.CompressionLevel = cfg.Producer.CompressionLevel
+		}
 	}
-
-	m.brokers = cfg.Brokers
-	m.config = config
-
-	producer, err := sarama.NewSyncProducer(cfg.Brokers, config)
-
-	if err != nil {
-		log.Fatal(fmt.Sprintf("failed to start Sarama producer:%s", err.Error()))
+	if cfg.Producer.MaxMessageBytes > 0 {
+		config.Producer.MaxMessageBytes = cfg.Producer.MaxMessageBytes
+	}
+	if cfg.Producer.RetryMax > 0 {
+		config.Producer.Retry.Max = cfg.Producer.RetryMax
+	}
+	if cfg.Producer.RetryBackoffMs > 0 {
+		config.Producer.Retry.Backoff = time.Duration(cfg.Producer.RetryBackoffMs) * time.Millisecond
 	}
 
-	m.producer = producer
-
-	return m
+	return config, nil
 }
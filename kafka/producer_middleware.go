@@ -0,0 +1,204 @@
+// Package kafka messaging broker
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lukmanlukmin/go-lib/log"
+)
+
+const redactedValue = "[REDACTED]"
+
+// ErrInvalidMessage matched by errors.Is on messages rejected by PublishValidate
+var ErrInvalidMessage = errors.New("[kafka-publisher] invalid message")
+
+// PublishFunc publish msg, see Producer
+type PublishFunc func(ctx context.Context, msg *MessageContext) error
+
+// ProducerMiddleware wrap a PublishFunc with behaviour shared across producers
+type ProducerMiddleware func(next PublishFunc) PublishFunc
+
+// Redactor return value with sensitive data masked, used before logging
+type Redactor func(value string) string
+
+type wrappedProducer struct {
+	publish PublishFunc
+	inner   Producer
+}
+
+// WrapProducer return producer publishing through p wrapped by middlewares,
+// the first middleware is the outermost one. Middlewares receive a copy of
+// the published message and may change it. Close close p when it has a
+// Close method and does nothing otherwise.
+func WrapProducer(p Producer, middlewares ...ProducerMiddleware) ProducerCloser {
+	publish := PublishFunc(p.Publish)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		publish = middlewares[i](publish)
+	}
+	return &wrappedProducer{publish: publish, inner: p}
+}
+
+func (w *wrappedProducer) Publish(ctx context.Context, msg *MessageContext) error {
+	out := *msg
+	out.Headers = make(map[string]string, len(msg.Headers))
+	for k, v := range msg.Headers {
+		out.Headers[k] = v
+	}
+	return w.publish(ctx, &out)
+}
+
+func (w *wrappedProducer) Close() error {
+	if c, ok := w.inner.(interface{ Close() error }); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// PublishHeaders set headers on every message, headers already set on the
+// message are kept
+func PublishHeaders(headers map[string]string) ProducerMiddleware {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, msg *MessageContext) error {
+			for k, v := range headers {
+				if _, ok := msg.Headers[k]; !ok {
+					msg.Headers[k] = v
+				}
+			}
+			return next(ctx, msg)
+		}
+	}
+}
+
+// PublishKey set the key of messages published without one to fn result,
+// instead of the random key the kafka producer use
+func PublishKey(fn func(msg *MessageContext) []byte) ProducerMiddleware {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, msg *MessageContext) error {
+			if len(msg.Key) == 0 {
+				msg.Key = fn(msg)
+			}
+			return next(ctx, msg)
+		}
+	}
+}
+
+// PublishEnrich call fn to change messages before they are published, e.g.
+// to add a tenant header from ctx. A fn error fail the publish.
+func PublishEnrich(fn func(ctx context.Context, msg *MessageContext) error) ProducerMiddleware {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, msg *MessageContext) error {
+			if err := fn(ctx, msg); err != nil {
+				return fmt.Errorf("[kafka-publisher] enrich topic %s got: %w", msg.Topic, err)
+			}
+			return next(ctx, msg)
+		}
+	}
+}
+
+// PublishValidate reject messages fn return an error for, they are not
+// published and the error match ErrInvalidMessage
+func PublishValidate(fn func(ctx context.Context, msg *MessageContext) error) ProducerMiddleware {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, msg *MessageContext) error {
+			if err := fn(ctx, msg); err != nil {
+				return fmt.Errorf("%w: topic %s: %w", ErrInvalidMessage, msg.Topic, err)
+			}
+			return next(ctx, msg)
+		}
+	}
+}
+
+// PublishLogging log every published message, its value masked by redact
+// when not nil. Failures are logged at warning level and successes at
+// debug level, or info level for Verbose messages which the producer
+// then don't log unmasked.
+func PublishLogging(redact Redactor) ProducerMiddleware {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, msg *MessageContext) error {
+			verbose := msg.Verbose
+			msg.Verbose = false
+
+			start := time.Now()
+			err := next(ctx, msg)
+
+			value := msg.Value
+			if redact != nil {
+				value = redact(value)
+			}
+			entry := log.WithContext(ctx).WithFields(map[string]interface{}{
+				"event":       logEventEventName,
+				"topic":       msg.Topic,
+				"key":         string(msg.Key),
+				"msg":         value,
+				"duration_ms": time.Since(start).Milliseconds(),
+			})
+			switch {
+			case err != nil:
+				entry.Warn(fmt.Sprintf("publish message failed: %s", err.Error()))
+			case verbose:
+				entry.Info("message published")
+			default:
+				entry.Debug("message published")
+			}
+			return err
+		}
+	}
+}
+
+// PublishMetrics record publish count, size, duration and errors like the
+// kafka producer does, for producers that don't record them such as
+// outbox.Outbox
+func PublishMetrics() ProducerMiddleware {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, msg *MessageContext) error {
+			start := time.Now()
+			err := next(ctx, msg)
+			recordPublish(ctx, msg, start, err)
+			return err
+		}
+	}
+}
+
+// RedactJSON return Redactor masking fields of JSON object values at any
+// depth, values that aren't JSON are masked entirely
+func RedactJSON(fields ...string) Redactor {
+	redacted := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		redacted[f] = true
+	}
+
+	var walk func(v interface{}) interface{}
+	walk = func(v interface{}) interface{} {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for k, fv := range t {
+				if redacted[k] {
+					t[k] = redactedValue
+				} else {
+					t[k] = walk(fv)
+				}
+			}
+		case []interface{}:
+			for i, iv := range t {
+				t[i] = walk(iv)
+			}
+		}
+		return v
+	}
+
+	return func(value string) string {
+		var v interface{}
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			return redactedValue
+		}
+		b, err := json.Marshal(walk(v))
+		if err != nil {
+			return redactedValue
+		}
+		return string(b)
+	}
+}
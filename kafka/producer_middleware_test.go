@@ -0,0 +1,78 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrapProducer(t *testing.T) {
+	inner := &fakeProducer{}
+	p := WrapProducer(inner,
+		PublishHeaders(map[string]string{"source": "billing", "tenant": "default"}),
+		PublishKey(func(msg *MessageContext) []byte { return []byte("key-" + msg.Value) }),
+		PublishEnrich(func(_ context.Context, msg *MessageContext) error {
+			msg.Value = `{"id":"` + msg.Value + `"}`
+			return nil
+		}),
+		PublishValidate(func(_ context.Context, msg *MessageContext) error {
+			if msg.Topic == "" {
+				return errors.New("missing topic")
+			}
+			return nil
+		}),
+		PublishLogging(RedactJSON("card")),
+		PublishMetrics(),
+	)
+
+	msg := &MessageContext{Topic: "invoices", Value: "i-1", Headers: map[string]string{"tenant": "acme"}, Verbose: true}
+	assert.Nil(t, p.Publish(context.Background(), msg))
+
+	if assert.Len(t, inner.published, 1) {
+		out := inner.published[0]
+		assert.Equal(t, map[string]string{"source": "billing", "tenant": "acme"}, out.Headers)
+		assert.Equal(t, "key-i-1", string(out.Key))
+		assert.Equal(t, `{"id":"i-1"}`, out.Value)
+		// logged masked by PublishLogging instead of the producer
+		assert.False(t, out.Verbose)
+	}
+	// the caller message is left untouched
+	assert.Equal(t, map[string]string{"tenant": "acme"}, msg.Headers)
+	assert.Equal(t, "i-1", msg.Value)
+	assert.True(t, msg.Verbose)
+
+	err := p.Publish(context.Background(), &MessageContext{Value: "i-2"})
+	assert.ErrorIs(t, err, ErrInvalidMessage)
+	assert.Len(t, inner.published, 1)
+}
+
+// closingProducer count Close calls
+type closingProducer struct {
+	fakeProducer
+	closed int
+}
+
+func (p *closingProducer) Close() error {
+	p.closed++
+	return nil
+}
+
+func TestWrapProducerClose(t *testing.T) {
+	inner := &closingProducer{}
+	assert.Nil(t, WrapProducer(inner, PublishMetrics()).Close())
+	assert.Equal(t, 1, inner.closed)
+
+	// producers without Close have nothing to release
+	assert.Nil(t, WrapProducer(&fakeProducer{}).Close())
+}
+
+func TestRedactJSON(t *testing.T) {
+	redact := RedactJSON("card", "password")
+
+	assert.Equal(t,
+		`{"items":[{"card":"[REDACTED]"}],"name":"a","user":{"password":"[REDACTED]"}}`,
+		redact(`{"name":"a","user":{"password":"secret"},"items":[{"card":"4111"}]}`))
+	assert.Equal(t, "[REDACTED]", redact("card=4111"))
+}
@@ -0,0 +1,264 @@
+// Package replay republish a range of a kafka topic, e.g. to re-drive a
+// dead letter topic or copy a time window to another topic or cluster.
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/lukmanlukmin/go-lib/kafka"
+	"github.com/lukmanlukmin/go-lib/log"
+)
+
+const (
+	logEventName = "KafkaReplay"
+
+	// HeaderSource header added to republished messages, `<topic>/<partition>/<offset>`
+	// of the original message
+	HeaderSource = "x-replay-source"
+)
+
+var (
+	// ErrStopOffset returned by Run when Options.StopOffset is set for
+	// several partitions, use Options.StopOffsets
+	ErrStopOffset = errors.New("[replay] stop offset require a single partition")
+
+	// errUntil stop a partition once messages are past Options.Until
+	errUntil = errors.New("[replay] until reached")
+)
+
+// Filter report whether msg is replayed
+type Filter func(msg *kafka.MessageDecoder) bool
+
+// Transform return the message republished for msg, nil skip msg
+type Transform func(msg *kafka.MessageDecoder) (*kafka.MessageContext, error)
+
+// Options range and processing of a replay
+type Options struct {
+	Topic string
+	// Partitions replayed in order, one after the other
+	Partitions []int32
+	// Start first message of every partition, e.g. kafka.FromTime
+	Start kafka.Position
+	// StopOffset stop the partition before this offset, 0 stop at the end
+	// of the partition when the replay start. Offsets of partitions are
+	// unrelated, it require a single partition, see StopOffsets
+	StopOffset int64
+	// StopOffsets stop offset of each partition, partitions not listed use
+	// StopOffset
+	StopOffsets map[int32]int64
+	// Until stop a partition at its first message produced after Until
+	Until time.Time
+	// Follow keep replaying new messages until the context is done,
+	// StopOffset and StopOffsets are ignored
+	Follow bool
+
+	// TargetTopic topic messages are republished to (defaults to Topic)
+	TargetTopic string
+	// Filter replay matching messages only, nil replay every message
+	Filter Filter
+	// Transform change messages before they are republished, nil copy
+	// key, value and headers
+	Transform Transform
+	// RatePerSecond maximum messages republished per second, 0 is unlimited
+	RatePerSecond float64
+	// DryRun log messages instead of publishing them
+	DryRun bool
+}
+
+// Stats count messages of a replay, Published count the messages logged
+// on dry run
+type Stats struct {
+	Read      int64
+	Skipped   int64
+	Published int64
+}
+
+// Key match messages with key
+func Key(key string) Filter {
+	return func(msg *kafka.MessageDecoder) bool {
+		return string(msg.Key) == key
+	}
+}
+
+// Header match messages carrying header name with value
+func Header(name, value string) Filter {
+	return func(msg *kafka.MessageDecoder) bool {
+		v, ok := msg.Headers[name]
+		return ok && v == value
+	}
+}
+
+// All match messages matching every filter
+func All(filters ...Filter) Filter {
+	return func(msg *kafka.MessageDecoder) bool {
+		for _, f := range filters {
+			if !f(msg) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Copy return msg key, value and headers to publish on topic
+func Copy(msg *kafka.MessageDecoder, topic string) *kafka.MessageContext {
+	headers := make(map[string]string, len(msg.Headers))
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	return &kafka.MessageContext{
+		Topic:   topic,
+		Key:     msg.Key,
+		Value:   string(msg.Body),
+		Headers: headers,
+	}
+}
+
+// Run read opts range from src and republish it through dst. It return
+// once every partition is replayed, ctx is done or publishing fail. A done
+// ctx is not a failure, the messages replayed so far are counted in Stats.
+func Run(ctx context.Context, src kafka.PartitionConsumer, dst kafka.Producer, opts Options) (Stats, error) {
+	if opts.StopOffset != 0 && len(opts.Partitions) > 1 {
+		return Stats{}, ErrStopOffset
+	}
+	if opts.TargetTopic == "" {
+		opts.TargetTopic = opts.Topic
+	}
+
+	r := &replayer{dst: dst, opts: opts, limiter: newLimiter(opts.RatePerSecond)}
+
+	for _, partition := range opts.Partitions {
+		stop, ok := opts.StopOffsets[partition]
+		if !ok {
+			stop = opts.StopOffset
+		}
+		if stop == 0 {
+			stop = sarama.OffsetNewest
+		}
+		if opts.Follow {
+			stop = 0
+		}
+
+		err := src.Consume(&kafka.PartitionContext{
+			Handler:    r.handle,
+			Topic:      opts.Topic,
+			Partition:  partition,
+			Start:      opts.Start,
+			StopOffset: stop,
+			Context:    ctx,
+		})
+		// handlers interrupted waiting for the limiter or publishing
+		// return the ctx error, Consume interrupted return nil
+		if ctx.Err() != nil && (err == nil || errors.Is(err, ctx.Err())) {
+			break
+		}
+		if err != nil && !errors.Is(err, errUntil) {
+			return r.stats, err
+		}
+	}
+	return r.stats, nil
+}
+
+type replayer struct {
+	dst     kafka.Producer
+	opts    Options
+	limiter *limiter
+	stats   Stats
+}
+
+func (r *replayer) handle(ctx context.Context, msg *kafka.MessageDecoder) error {
+	if !r.opts.Until.IsZero() && msg.TimeStamp.After(r.opts.Until) {
+		return errUntil
+	}
+	r.stats.Read++
+
+	if r.opts.Filter != nil && !r.opts.Filter(msg) {
+		r.stats.Skipped++
+		return nil
+	}
+
+	out := Copy(msg, r.opts.TargetTopic)
+	if r.opts.Transform != nil {
+		var err error
+		if out, err = r.opts.Transform(msg); err != nil {
+			return fmt.Errorf("[replay] transform got: %w", err)
+		}
+		if out == nil {
+			r.stats.Skipped++
+			return nil
+		}
+		if out.Topic == "" {
+			out.Topic = r.opts.TargetTopic
+		}
+	}
+	if out.Headers == nil {
+		out.Headers = map[string]string{}
+	}
+	out.Headers[HeaderSource] = msg.Topic + "/" + strconv.Itoa(int(msg.Partition)) + "/" + strconv.FormatInt(msg.Offset, 10)
+
+	if r.opts.DryRun {
+		log.WithFields(map[string]interface{}{
+			"event":   logEventName,
+			"source":  out.Headers[HeaderSource],
+			"topic":   out.Topic,
+			"key":     string(out.Key),
+			"headers": out.Headers,
+		}).Info(out.Value)
+		r.stats.Published++
+		return nil
+	}
+
+	if err := r.limiter.wait(ctx); err != nil {
+		return err
+	}
+	if err := r.dst.Publish(ctx, out); err != nil {
+		return err
+	}
+	r.stats.Published++
+	return nil
+}
+
+// limiter space calls evenly to a rate per second
+type limiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newLimiter(perSecond float64) *limiter {
+	l := &limiter{}
+	if perSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return l
+}
+
+// wait block until the next call is allowed
+func (l *limiter) wait(ctx context.Context) error {
+	if l.interval == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	if wait == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,167 @@
+package replay
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/lukmanlukmin/go-lib/kafka"
+	"github.com/lukmanlukmin/go-lib/kafka/kafkatest"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSource deliver msgs of the requested partition
+type fakeSource struct {
+	msgs []*kafka.MessageDecoder
+}
+
+func (s *fakeSource) Consume(ctx *kafka.PartitionContext) error {
+	for _, msg := range s.msgs {
+		if msg.Partition != ctx.Partition {
+			continue
+		}
+		if err := ctx.Handler(ctx.Context, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakeSource) Close() error {
+	return nil
+}
+
+func TestRunFilterAndRepublish(t *testing.T) {
+	base := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	src := &fakeSource{msgs: []*kafka.MessageDecoder{
+		{Topic: "orders.dlq", Partition: 0, Offset: 0, Key: []byte("o-1"), Body: []byte("a"), TimeStamp: base, Headers: map[string]string{"error": "timeout"}},
+		{Topic: "orders.dlq", Partition: 0, Offset: 1, Key: []byte("o-2"), Body: []byte("b"), TimeStamp: base, Headers: map[string]string{"error": "invalid"}},
+		{Topic: "orders.dlq", Partition: 1, Offset: 0, Key: []byte("o-3"), Body: []byte("c"), TimeStamp: base, Headers: map[string]string{"error": "timeout"}},
+		{Topic: "orders.dlq", Partition: 1, Offset: 1, Key: []byte("o-4"), Body: []byte("d"), TimeStamp: base.Add(time.Hour), Headers: map[string]string{"error": "timeout"}},
+	}}
+	dst := kafkatest.NewBroker()
+
+	stats, err := Run(context.Background(), src, dst, Options{
+		Topic:       "orders.dlq",
+		TargetTopic: "orders",
+		Partitions:  []int32{0, 1},
+		Until:       base.Add(time.Minute),
+		Filter:      Header("error", "timeout"),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, Stats{Read: 3, Skipped: 1, Published: 2}, stats)
+
+	dst.ExpectPublished(t, "orders", kafkatest.All(kafkatest.Key("o-1"), kafkatest.Header(HeaderSource, "orders.dlq/0/0")))
+	dst.ExpectPublished(t, "orders", kafkatest.All(kafkatest.Key("o-3"), kafkatest.Value("c")))
+	dst.ExpectNotPublished(t, "orders", kafkatest.Key("o-4"))
+}
+
+func TestRunDryRunAndRate(t *testing.T) {
+	src := &fakeSource{msgs: []*kafka.MessageDecoder{
+		{Topic: "orders", Offset: 0, Body: []byte("a")},
+		{Topic: "orders", Offset: 1, Body: []byte("b")},
+		{Topic: "orders", Offset: 2, Body: []byte("c")},
+	}}
+	dst := kafkatest.NewBroker()
+
+	stats, err := Run(context.Background(), src, dst, Options{Topic: "orders", Partitions: []int32{0}, DryRun: true})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), stats.Published)
+	assert.Empty(t, dst.Messages("orders"))
+
+	start := time.Now()
+	_, err = Run(context.Background(), src, dst, Options{Topic: "orders", TargetTopic: "copy", Partitions: []int32{0}, RatePerSecond: 50})
+	assert.Nil(t, err)
+	assert.Len(t, dst.Messages("copy"), 3)
+	// the first message go right away, the next two wait 20ms each
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+}
+
+func TestRunPartitionConsumerSource(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	// partition 1 is empty
+	fetch := sarama.NewMockFetchResponse(t, 10).
+		SetHighWaterMark("orders", 0, 3).
+		SetHighWaterMark("orders", 1, 0)
+	for i := int64(0); i < 3; i++ {
+		fetch.SetMessage("orders", 0, i, sarama.StringEncoder("v"))
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("orders", 0, broker.BrokerID()).
+			SetLeader("orders", 1, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("orders", 0, sarama.OffsetOldest, 0).
+			SetOffset("orders", 0, sarama.OffsetNewest, 3).
+			SetOffset("orders", 1, sarama.OffsetOldest, 0).
+			SetOffset("orders", 1, sarama.OffsetNewest, 0),
+		"FetchRequest": fetch,
+	})
+
+	src, err := kafka.NewPartitionConsumer(&kafka.Config{Brokers: []string{broker.Addr()}})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer src.Close()
+	dst := kafkatest.NewBroker()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stats, err := Run(ctx, src, dst, Options{Topic: "orders", TargetTopic: "copy", Partitions: []int32{0, 1}})
+	assert.Nil(t, err)
+	assert.Nil(t, ctx.Err())
+	assert.Equal(t, Stats{Read: 3, Published: 3}, stats)
+	assert.Len(t, dst.Messages("copy"), 3)
+}
+
+func TestRunStopOffsets(t *testing.T) {
+	src := &stopSource{stops: map[int32]int64{}}
+
+	_, err := Run(context.Background(), src, kafkatest.NewBroker(), Options{Topic: "orders", Partitions: []int32{0, 1}, StopOffset: 5})
+	assert.ErrorIs(t, err, ErrStopOffset)
+	assert.Empty(t, src.stops)
+
+	_, err = Run(context.Background(), src, kafkatest.NewBroker(), Options{Topic: "orders", Partitions: []int32{0, 1, 2}, StopOffsets: map[int32]int64{0: 5, 2: 9}})
+	assert.Nil(t, err)
+	assert.Equal(t, map[int32]int64{0: 5, 1: sarama.OffsetNewest, 2: 9}, src.stops)
+
+	_, err = Run(context.Background(), src, kafkatest.NewBroker(), Options{Topic: "orders", Partitions: []int32{3}, StopOffset: 7})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), src.stops[3])
+}
+
+// stopSource record the stop offset of every partition
+type stopSource struct {
+	stops map[int32]int64
+}
+
+func (s *stopSource) Consume(ctx *kafka.PartitionContext) error {
+	s.stops[ctx.Partition] = ctx.StopOffset
+	return nil
+}
+
+func (s *stopSource) Close() error {
+	return nil
+}
+
+func TestRunCancelledWhileRateLimited(t *testing.T) {
+	src := &fakeSource{msgs: []*kafka.MessageDecoder{
+		{Topic: "orders", Offset: 0, Body: []byte("a")},
+		{Topic: "orders", Offset: 1, Body: []byte("b")},
+	}}
+	dst := kafkatest.NewBroker()
+
+	// the second message wait a second for the limiter
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	stats, err := Run(ctx, src, dst, Options{Topic: "orders", TargetTopic: "copy", Partitions: []int32{0, 1}, RatePerSecond: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, Stats{Read: 2, Published: 1}, stats)
+	assert.Len(t, dst.Messages("copy"), 1)
+}
@@ -0,0 +1,186 @@
+// Package kafka messaging broker
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/IBM/sarama"
+	"github.com/google/uuid"
+	"github.com/lukmanlukmin/go-lib/log"
+)
+
+const (
+	// HeaderCorrelationID header matching a reply with its request
+	HeaderCorrelationID = "correlation-id"
+	// HeaderReplyTo header naming the topic replies of a request are published to
+	HeaderReplyTo = "reply-to"
+	// HeaderReplyError header carrying the error of a failed request
+	HeaderReplyError = "reply-error"
+)
+
+var (
+	// ErrReply matched by errors.Is when the responder failed the request
+	ErrReply = errors.New("[kafka] request failed")
+	// ErrRequesterStopped returned by Request once Run returned
+	ErrRequesterStopped = errors.New("[kafka] requester stopped")
+)
+
+// ReplyFunc return the reply to a request, its Topic is ignored
+type ReplyFunc func(ctx context.Context, msg *MessageDecoder) (*MessageContext, error)
+
+// Requester publish requests and wait for their reply. Replies are consumed
+// from the reply topic by a group of its own, every requester instance
+// receive every reply and ignore those of other instances.
+type Requester struct {
+	producer   Producer
+	consumer   Consumer
+	replyTopic string
+	groupID    string
+
+	mux     sync.Mutex
+	pending map[string]chan *MessageDecoder
+	ready   chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewRequester return requester publishing through producer and receiving
+// replies on replyTopic with consumer. groupID must be unique to the
+// requester instance, e.g. suffixed with the host name.
+func NewRequester(producer Producer, consumer Consumer, replyTopic, groupID string) *Requester {
+	return &Requester{
+		producer:   producer,
+		consumer:   consumer,
+		replyTopic: replyTopic,
+		groupID:    groupID,
+		pending:    map[string]chan *MessageDecoder{},
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Run consume replies until ctx is done, requests wait for the reply
+// partitions to be assigned before they are published. The reply group
+// start at the oldest offset, partitions resolving their offset after a
+// request was published still receive its reply.
+func (r *Requester) Run(ctx context.Context) {
+	defer close(r.done)
+
+	r.consumer.Subscribe(&ConsumerContext{
+		Handler:       r.handleReply,
+		Topics:        []string{r.replyTopic},
+		GroupID:       r.groupID,
+		Context:       ctx,
+		OffsetInitial: sarama.OffsetOldest,
+		OnAssigned: func(context.Context, map[string][]int32) {
+			r.once.Do(func() { close(r.ready) })
+		},
+	})
+}
+
+// Request publish msg with a correlation id and the reply topic, then wait
+// for the reply until ctx is done. A request failed by the responder
+// return an error matching ErrReply.
+func (r *Requester) Request(ctx context.Context, msg *MessageContext) (*MessageDecoder, error) {
+	select {
+	case <-r.ready:
+	case <-r.done:
+		return nil, ErrRequesterStopped
+	case <-ctx.Done():
+		return nil, fmt.Errorf("[kafka] request topic %s waiting reply consumer: %w", msg.Topic, ctx.Err())
+	}
+
+	id := uuid.NewString()
+	reply := make(chan *MessageDecoder, 1)
+
+	r.mux.Lock()
+	r.pending[id] = reply
+	r.mux.Unlock()
+	defer func() {
+		r.mux.Lock()
+		delete(r.pending, id)
+		r.mux.Unlock()
+	}()
+
+	req := *msg
+	req.Headers = make(map[string]string, len(msg.Headers)+2)
+	for k, v := range msg.Headers {
+		req.Headers[k] = v
+	}
+	req.Headers[HeaderCorrelationID] = id
+	req.Headers[HeaderReplyTo] = r.replyTopic
+
+	if err := r.producer.Publish(ctx, &req); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-reply:
+		if e, ok := res.Headers[HeaderReplyError]; ok {
+			return res, fmt.Errorf("%w: %s", ErrReply, e)
+		}
+		return res, nil
+	case <-r.done:
+		return nil, ErrRequesterStopped
+	case <-ctx.Done():
+		return nil, fmt.Errorf("[kafka] request topic %s correlation id %s: %w", msg.Topic, id, ctx.Err())
+	}
+}
+
+// handleReply route msg to the request waiting for it
+func (r *Requester) handleReply(_ context.Context, msg *MessageDecoder) error {
+	id := msg.Headers[HeaderCorrelationID]
+
+	r.mux.Lock()
+	reply, ok := r.pending[id]
+	r.mux.Unlock()
+
+	// replies of other instances or of requests timed out
+	if ok {
+		select {
+		case reply <- msg:
+		default:
+		}
+	}
+	return nil
+}
+
+// ReplyHandler return handler answering requests with fn. The reply is
+// published through producer to the request reply topic, a fn error is
+// sent back to the requester instead. Messages without reply topic are
+// passed to fn and the reply dropped.
+func ReplyHandler(producer Producer, fn ReplyFunc) Handler {
+	return func(ctx context.Context, msg *MessageDecoder) error {
+		res, err := fn(ctx, msg)
+
+		replyTo := msg.Headers[HeaderReplyTo]
+		if replyTo == "" {
+			return err
+		}
+
+		if err != nil {
+			log.WithContext(ctx).WithFields(map[string]interface{}{
+				"event":          logEventEventName,
+				"topic":          msg.Topic,
+				"correlation_id": msg.Headers[HeaderCorrelationID],
+			}).Warn(fmt.Sprintf("reply request failed: %s", err.Error()))
+			res = &MessageContext{Headers: map[string]string{HeaderReplyError: err.Error()}}
+		}
+		if res == nil {
+			res = &MessageContext{}
+		}
+
+		out := *res
+		out.Topic = replyTo
+		out.Headers = make(map[string]string, len(res.Headers)+1)
+		for k, v := range res.Headers {
+			out.Headers[k] = v
+		}
+		out.Headers[HeaderCorrelationID] = msg.Headers[HeaderCorrelationID]
+
+		return producer.Publish(ctx, &out)
+	}
+}
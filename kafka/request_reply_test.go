@@ -0,0 +1,70 @@
+package kafka_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/lukmanlukmin/go-lib/kafka"
+	"github.com/lukmanlukmin/go-lib/kafka/kafkatest"
+	"github.com/stretchr/testify/assert"
+)
+
+// replyConsumer record the subscription of the requester
+type replyConsumer struct {
+	*kafkatest.Broker
+	offsetInitial int64
+}
+
+func (c *replyConsumer) Subscribe(ctx *kafka.ConsumerContext) {
+	c.offsetInitial = ctx.OffsetInitial
+	c.Broker.Subscribe(ctx)
+}
+
+func TestRequestReply(t *testing.T) {
+	broker := kafkatest.NewBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// nobody answer requests on orders
+	go broker.Subscribe(&kafka.ConsumerContext{
+		Topics:  []string{"prices"},
+		GroupID: "pricing",
+		Context: ctx,
+		Handler: kafka.ReplyHandler(broker, func(_ context.Context, msg *kafka.MessageDecoder) (*kafka.MessageContext, error) {
+			if string(msg.Body) == "unknown" {
+				return nil, errors.New("no price")
+			}
+			return &kafka.MessageContext{Value: "price of " + string(msg.Body)}, nil
+		}),
+	})
+
+	consumer := &replyConsumer{Broker: broker}
+	r := kafka.NewRequester(broker, consumer, "prices.reply", "pricing-client-1")
+	go r.Run(ctx)
+
+	reqCtx, reqCancel := context.WithTimeout(ctx, time.Second)
+	defer reqCancel()
+
+	res, err := r.Request(reqCtx, &kafka.MessageContext{Topic: "prices", Value: "sku-1"})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "price of sku-1", string(res.Body))
+		assert.NotEmpty(t, res.Headers[kafka.HeaderCorrelationID])
+	}
+	// replies published before the reply partitions resolve their offset
+	// are not skipped
+	assert.Equal(t, sarama.OffsetOldest, consumer.offsetInitial)
+
+	_, err = r.Request(reqCtx, &kafka.MessageContext{Topic: "prices", Value: "unknown"})
+	assert.ErrorIs(t, err, kafka.ErrReply)
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer timeoutCancel()
+	_, err = r.Request(timeoutCtx, &kafka.MessageContext{Topic: "orders", Value: "o-1"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	assert.True(t, broker.WaitConsumed("pricing-client-1", time.Second, "prices.reply"))
+	assert.Empty(t, broker.HandlerErrors())
+}
@@ -0,0 +1,235 @@
+// Package kafka messaging
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lukmanlukmin/go-lib/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Header keys set on messages forwarded to retry and dead letter topics
+const (
+	HeaderOriginalTopic     = "x-original-topic"
+	HeaderOriginalPartition = "x-original-partition"
+	HeaderOriginalOffset    = "x-original-offset"
+	HeaderRetryTier         = "x-retry-tier"
+	HeaderDeliverAt         = "x-deliver-at"
+	HeaderError             = "x-error"
+)
+
+const (
+	retryTopicInfix       = ".retry."
+	deadLetterTopicSuffix = ".dlq"
+	// defaultRetryAttempts in-place attempts before forwarding when
+	// RetryConfig Attempts is 0 and retry topics or dead letter are set
+	defaultRetryAttempts = 3
+)
+
+// forwardedTopic report whether topic is a retry tier or dead letter topic
+func forwardedTopic(topic string) bool {
+	return strings.Contains(topic, retryTopicInfix) || strings.HasSuffix(topic, deadLetterTopicSuffix)
+}
+
+var (
+	// errConsumerStopping returned by waits ended because the consumer stop
+	errConsumerStopping = errors.New("[kafka] consumer stopping")
+	// errSessionEnded returned by waits ended because the group session
+	// of the message ended, e.g. to restart with new topics
+	errSessionEnded = errors.New("[kafka] consumer session ended")
+)
+
+// holdFunc pause fetching partition of topic and return the func resuming it
+type holdFunc func(topic string, partition int32) (resume func())
+
+// retryPolicy decide what happen to a message the handler failed to process
+type retryPolicy struct {
+	attempts       int
+	backoffInitial time.Duration
+	backoffMax     time.Duration
+	delays         []time.Duration
+	suffixes       []string
+	deadLetter     bool
+	producer       Producer
+}
+
+func newRetryPolicy(cfg RetryConfig) (*retryPolicy, error) {
+	p := &retryPolicy{
+		attempts:       cfg.Attempts,
+		backoffInitial: retryBackoffInitial,
+		backoffMax:     retryBackoffMax,
+		deadLetter:     cfg.DeadLetter,
+	}
+
+	if cfg.InitialBackoffMs > 0 {
+		p.backoffInitial = time.Duration(cfg.InitialBackoffMs) * time.Millisecond
+	}
+	if cfg.MaxBackoffMs > 0 {
+		p.backoffMax = time.Duration(cfg.MaxBackoffMs) * time.Millisecond
+	}
+
+	for _, d := range cfg.Delays {
+		delay, err := time.ParseDuration(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retry delay %q: %w", d, err)
+		}
+		p.delays = append(p.delays, delay)
+		p.suffixes = append(p.suffixes, retryTopicInfix+d)
+	}
+
+	if p.attempts == 0 && p.forwarding() {
+		p.attempts = defaultRetryAttempts
+	}
+	return p, nil
+}
+
+// forwarding report whether failed messages are republished to another topic
+func (p *retryPolicy) forwarding() bool {
+	return len(p.delays) > 0 || p.deadLetter
+}
+
+// topics return subscribed topics including their retry tiers
+func (p *retryPolicy) topics(topics []string) []string {
+	all := make([]string, 0, len(topics)*(len(p.suffixes)+1))
+	all = append(all, topics...)
+	for _, t := range topics {
+		for _, s := range p.suffixes {
+			all = append(all, t+s)
+		}
+	}
+	return all
+}
+
+// tier return the retry tier index of topic, -1 for a main topic
+func (p *retryPolicy) tier(topic string) int {
+	for i, s := range p.suffixes {
+		if strings.HasSuffix(topic, s) {
+			return i
+		}
+	}
+	return -1
+}
+
+// exhausted report whether in-place attempts are used up
+func (p *retryPolicy) exhausted(attempt int) bool {
+	return p.attempts > 0 && attempt >= p.attempts
+}
+
+// nextBackoff double the backoff up to the configured maximum
+func (p *retryPolicy) nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > p.backoffMax {
+		return p.backoffMax
+	}
+	return backoff
+}
+
+// wait hold a retry tier message until its deliver-at time with the fetch
+// of its partition paused by the message hold. The message is left
+// unprocessed when ctx is done, the consumer is stopping or its session
+// end first, the next owner of the partition hold it again.
+func (p *retryPolicy) wait(ctx context.Context, stopping <-chan struct{}, msg *MessageDecoder) error {
+	if p.tier(msg.Topic) < 0 {
+		return nil
+	}
+
+	deliverAt, err := strconv.ParseInt(msg.Headers[HeaderDeliverAt], 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	delay := time.Until(time.UnixMilli(deliverAt))
+	if delay <= 0 {
+		return nil
+	}
+
+	if msg.hold != nil {
+		defer msg.hold(msg.Topic, msg.Partition)()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-stopping:
+		return errConsumerStopping
+	case <-msg.session:
+		return errSessionEnded
+	case <-timer.C:
+		return nil
+	}
+}
+
+// forward republish msg to its next retry tier or to the dead letter topic.
+// A message without destination left is dropped and logged.
+func (p *retryPolicy) forward(ctx context.Context, msg *MessageDecoder, cause error) error {
+	trace.SpanFromContext(ctx).RecordError(cause)
+
+	lf := map[string]interface{}{
+		"event":     logEventEventName,
+		"topic":     msg.Topic,
+		"partition": msg.Partition,
+		"offset":    msg.Offset,
+	}
+
+	tier := p.tier(msg.Topic)
+	origin := msg.Topic
+	if tier >= 0 {
+		origin = strings.TrimSuffix(msg.Topic, p.suffixes[tier])
+	}
+
+	headers := make(map[string]string, len(msg.Headers)+6)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	if tier < 0 {
+		headers[HeaderOriginalTopic] = msg.Topic
+		headers[HeaderOriginalPartition] = strconv.Itoa(int(msg.Partition))
+		headers[HeaderOriginalOffset] = strconv.FormatInt(msg.Offset, 10)
+	}
+	headers[HeaderError] = cause.Error()
+
+	var topic string
+	switch next := tier + 1; {
+	case next < len(p.delays):
+		topic = origin + p.suffixes[next]
+		headers[HeaderRetryTier] = strconv.Itoa(next + 1)
+		headers[HeaderDeliverAt] = strconv.FormatInt(time.Now().Add(p.delays[next]).UnixMilli(), 10)
+	case p.deadLetter:
+		topic = origin + deadLetterTopicSuffix
+		delete(headers, HeaderDeliverAt)
+	default:
+		log.WithContext(ctx).WithFields(lf).Error(fmt.Sprintf("drop message after retries exhausted: %s", cause.Error()))
+		return nil
+	}
+
+	backoff := p.backoffInitial
+	for {
+		err := p.producer.Publish(ctx, &MessageContext{
+			Value:   string(msg.Body),
+			Key:     msg.Key,
+			Headers: headers,
+			Topic:   topic,
+		})
+		if err == nil {
+			log.WithContext(ctx).WithFields(lf).Warn(fmt.Sprintf("message forwarded to %s: %s", topic, cause.Error()))
+			return nil
+		}
+
+		log.WithContext(ctx).WithFields(lf).Error(fmt.Sprintf("forward message to %s failed, retry in %s: %s", topic, backoff, err.Error()))
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("forward message to %s cancelled: %w", topic, err)
+		case <-time.After(backoff):
+		}
+		backoff = p.nextBackoff(backoff)
+	}
+}
@@ -0,0 +1,144 @@
+// Package kafka messaging broker
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+const (
+	// tokenExpiryMargin refresh OAUTHBEARER tokens this long before they expire
+	tokenExpiryMargin   = 30 * time.Second
+	defaultTokenTimeout = 10 * time.Second
+)
+
+// TokenProvider supply the access token sent on SASL/OAUTHBEARER
+// authentication, it is called on every new broker connection
+type TokenProvider interface {
+	Token() (*sarama.AccessToken, error)
+}
+
+// saslConfig apply cfg SASL mechanism and credentials to config
+func saslConfig(config *sarama.Config, cfg *Config) error {
+	mechanism := cfg.SASL.Mechanism
+	if mechanism == "" {
+		mechanism = sarama.SASLTypePlaintext
+	}
+
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Mechanism = sarama.SASLMechanism(mechanism)
+
+	switch mechanism {
+	case sarama.SASLTypeSCRAMSHA256:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &XDGSCRAMClient{HashGeneratorFcn: SHA256}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &XDGSCRAMClient{HashGeneratorFcn: SHA512}
+		}
+	case sarama.SASLTypeOAuth:
+		provider := cfg.SASL.TokenProvider
+		if provider == nil {
+			if cfg.SASL.OAuth.TokenURL == "" {
+				return errors.New("sasl oauthbearer require a token provider or oauth token_url")
+			}
+			provider = NewClientCredentialsProvider(cfg.SASL.OAuth)
+		}
+		config.Net.SASL.TokenProvider = provider
+		return nil
+	}
+
+	config.Net.SASL.User = cfg.SASL.User
+	config.Net.SASL.Password = cfg.SASL.Password
+	config.Net.SASL.SCRAMAuthzID = cfg.SASL.AuthzID
+	return nil
+}
+
+// clientCredentialsProvider fetch OAUTHBEARER tokens with the OAuth 2.0
+// client credentials grant and cache them until they expire
+type clientCredentialsProvider struct {
+	cfg    OAuthConfig
+	client *http.Client
+
+	mux     sync.Mutex
+	token   *sarama.AccessToken
+	expires time.Time
+}
+
+// NewClientCredentialsProvider return TokenProvider requesting tokens from
+// cfg.TokenURL with the client credentials grant
+func NewClientCredentialsProvider(cfg OAuthConfig) TokenProvider {
+	return &clientCredentialsProvider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: defaultTokenTimeout},
+	}
+}
+
+// Token return the cached token, a new one is requested when it expire soon
+func (p *clientCredentialsProvider) Token() (*sarama.AccessToken, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.token != nil && time.Now().Before(p.expires) {
+		return p.token, nil
+	}
+
+	token, ttl, err := p.fetch(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("[kafka] fetch oauth token from %s got: %w", p.cfg.TokenURL, err)
+	}
+
+	p.token = token
+	p.expires = time.Now().Add(ttl - tokenExpiryMargin)
+	return token, nil
+}
+
+func (p *clientCredentialsProvider) fetch(ctx context.Context) (*sarama.AccessToken, time.Duration, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(p.cfg.Scopes) > 0 {
+		form.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, 0, fmt.Errorf("decode token response got: %w", err)
+	}
+	if body.AccessToken == "" {
+		return nil, 0, errors.New("token response has no access_token")
+	}
+
+	// tokens without expiry are refreshed on the next connection
+	ttl := time.Duration(body.ExpiresIn) * time.Second
+	return &sarama.AccessToken{Token: body.AccessToken, Extensions: p.cfg.Extensions}, ttl, nil
+}
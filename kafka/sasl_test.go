@@ -0,0 +1,77 @@
+package kafka
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSASLSCRAMConfig(t *testing.T) {
+	cfg := &Config{
+		Brokers: []string{"localhost:9092"},
+		SASL:    SASL{Enable: true, Mechanism: sarama.SASLTypeSCRAMSHA512, User: "svc", Password: "secret"},
+	}
+
+	for _, build := range []func(*Config) (*sarama.Config, error){newProducerConfig, newConsumerConfig} {
+		config, err := build(cfg)
+		if !assert.Nil(t, err) {
+			continue
+		}
+		assert.Equal(t, sarama.SASLMechanism(sarama.SASLTypeSCRAMSHA512), config.Net.SASL.Mechanism)
+		assert.Equal(t, sarama.SASLHandshakeV1, config.Net.SASL.Version)
+		if assert.NotNil(t, config.Net.SASL.SCRAMClientGeneratorFunc) {
+			assert.IsType(t, &XDGSCRAMClient{}, config.Net.SASL.SCRAMClientGeneratorFunc())
+		}
+		// SASL_PLAINTEXT listeners don't use TLS
+		assert.False(t, config.Net.TLS.Enable)
+	}
+}
+
+func TestClientCredentialsProvider(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		user, pass, _ := r.BasicAuth()
+		assert.Equal(t, "svc", user)
+		assert.Equal(t, "secret", pass)
+		assert.Nil(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.Form.Get("grant_type"))
+		assert.Equal(t, "kafka read", r.Form.Get("scope"))
+		_, _ = w.Write([]byte(`{"access_token":"tok-1","token_type":"bearer","expires_in":3600}`))
+	}))
+	defer srv.Close()
+
+	cfg := &Config{
+		Brokers: []string{"localhost:9092"},
+		SASL: SASL{Enable: true, Mechanism: sarama.SASLTypeOAuth, OAuth: OAuthConfig{
+			TokenURL: srv.URL, ClientID: "svc", ClientSecret: "secret", Scopes: []string{"kafka", "read"},
+		}},
+	}
+	config, err := newProducerConfig(cfg)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, sarama.SASLHandshakeV1, config.Net.SASL.Version)
+
+	for i := 0; i < 2; i++ {
+		token, err := config.Net.SASL.TokenProvider.Token()
+		assert.Nil(t, err)
+		assert.Equal(t, "tok-1", token.Token)
+	}
+	// the token is cached until it expire
+	assert.Equal(t, 1, calls)
+
+	// V0 has no OAUTHBEARER
+	cfg.SASL.Version, cfg.SASL.VersionSet = sarama.SASLHandshakeV0, true
+	assert.ErrorIs(t, cfg.Validate(), ErrInvalidConfig)
+
+	// V0 unless set is left to the V1 default
+	cfg.SASL.VersionSet = false
+	assert.Nil(t, cfg.Validate())
+
+	cfg.SASL.OAuth = OAuthConfig{}
+	assert.ErrorIs(t, cfg.Validate(), ErrInvalidConfig)
+}
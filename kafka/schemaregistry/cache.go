@@ -0,0 +1,80 @@
+package schemaregistry
+
+import (
+	"context"
+	"sync"
+)
+
+type subjectSchema struct {
+	subject string
+	schema  Schema
+}
+
+type cachedClient struct {
+	client Client
+	mux    sync.RWMutex
+	ids    map[subjectSchema]int
+	byID   map[int]Schema
+}
+
+// NewCachedClient wrap client caching registered IDs and schemas, both are
+// immutable in the registry so entries never expire.
+func NewCachedClient(client Client) Client {
+	return &cachedClient{
+		client: client,
+		ids:    make(map[subjectSchema]int),
+		byID:   make(map[int]Schema),
+	}
+}
+
+// Register register schema under subject
+func (c *cachedClient) Register(ctx context.Context, subject string, schema Schema) (int, error) {
+	return c.id(ctx, subject, schema, c.client.Register)
+}
+
+// Lookup return ID of schema registered under subject
+func (c *cachedClient) Lookup(ctx context.Context, subject string, schema Schema) (int, error) {
+	return c.id(ctx, subject, schema, c.client.Lookup)
+}
+
+func (c *cachedClient) id(ctx context.Context, subject string, schema Schema, fetch func(context.Context, string, Schema) (int, error)) (int, error) {
+	key := subjectSchema{subject: subject, schema: schema}
+
+	c.mux.RLock()
+	id, ok := c.ids[key]
+	c.mux.RUnlock()
+	if ok {
+		return id, nil
+	}
+
+	id, err := fetch(ctx, subject, schema)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mux.Lock()
+	c.ids[key] = id
+	c.byID[id] = schema
+	c.mux.Unlock()
+	return id, nil
+}
+
+// GetByID return schema registered with id
+func (c *cachedClient) GetByID(ctx context.Context, id int) (Schema, error) {
+	c.mux.RLock()
+	schema, ok := c.byID[id]
+	c.mux.RUnlock()
+	if ok {
+		return schema, nil
+	}
+
+	schema, err := c.client.GetByID(ctx, id)
+	if err != nil {
+		return Schema{}, err
+	}
+
+	c.mux.Lock()
+	c.byID[id] = schema
+	c.mux.Unlock()
+	return schema, nil
+}
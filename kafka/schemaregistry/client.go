@@ -0,0 +1,134 @@
+package schemaregistry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	contentType    = "application/vnd.schemaregistry.v1+json"
+	defaultTimeout = 10 * time.Second
+)
+
+type httpClient struct {
+	baseURL  string
+	username string
+	password string
+	client   *http.Client
+}
+
+// NewClient return Confluent schema registry REST client, responses are
+// cached so a schema is fetched or registered once per process.
+func NewClient(cfg Config) Client {
+	timeout := time.Duration(cfg.TimeoutSecond) * time.Second
+	if cfg.TimeoutSecond < 1 {
+		timeout = defaultTimeout
+	}
+
+	return NewCachedClient(&httpClient{
+		baseURL:  strings.TrimSuffix(cfg.URL, "/"),
+		username: cfg.Username,
+		password: cfg.Password,
+		client:   &http.Client{Timeout: timeout},
+	})
+}
+
+type registerResponse struct {
+	ID int `json:"id"`
+}
+
+type errorResponse struct {
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+// Register register schema under subject
+func (c *httpClient) Register(ctx context.Context, subject string, schema Schema) (int, error) {
+	var resp registerResponse
+	err := c.do(ctx, http.MethodPost, "/subjects/"+url.PathEscape(subject)+"/versions", requestSchema(schema), &resp)
+	if err != nil {
+		return 0, fmt.Errorf("[schema-registry] register subject %s got: %w", subject, err)
+	}
+	return resp.ID, nil
+}
+
+// Lookup return ID of schema registered under subject
+func (c *httpClient) Lookup(ctx context.Context, subject string, schema Schema) (int, error) {
+	var resp registerResponse
+	err := c.do(ctx, http.MethodPost, "/subjects/"+url.PathEscape(subject), requestSchema(schema), &resp)
+	if err != nil {
+		return 0, fmt.Errorf("[schema-registry] lookup subject %s got: %w", subject, err)
+	}
+	return resp.ID, nil
+}
+
+// GetByID return schema registered with id
+func (c *httpClient) GetByID(ctx context.Context, id int) (Schema, error) {
+	var resp Schema
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &resp); err != nil {
+		return Schema{}, fmt.Errorf("[schema-registry] get schema id %d got: %w", id, err)
+	}
+	// the registry omit schemaType for Avro schemas
+	if resp.Type == "" {
+		resp.Type = Avro
+	}
+	return resp, nil
+}
+
+// requestSchema omit schemaType for Avro as older registries reject it
+func requestSchema(schema Schema) Schema {
+	if schema.Type == Avro {
+		schema.Type = ""
+	}
+	return schema
+}
+
+func (c *httpClient) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", contentType)
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var e errorResponse
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("status %d, error code %d: %s", resp.StatusCode, e.ErrorCode, e.Message)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,133 @@
+package schemaregistry
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/hamba/avro/v2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Format encode payloads of one schema type
+type Format interface {
+	Type() SchemaType
+	// Marshal encode v with schema, the result follow the schema ID
+	Marshal(schema Schema, v interface{}) ([]byte, error)
+	// Unmarshal decode data following the schema ID into out
+	Unmarshal(schema Schema, data []byte, out interface{}) error
+}
+
+type avroFormat struct {
+	schemas sync.Map
+}
+
+// NewAvroFormat return Avro binary format, values are mapped to schema
+// fields with the `avro` struct tag
+func NewAvroFormat() Format {
+	return &avroFormat{}
+}
+
+func (f *avroFormat) Type() SchemaType {
+	return Avro
+}
+
+func (f *avroFormat) parse(schema Schema) (avro.Schema, error) {
+	if s, ok := f.schemas.Load(schema.Schema); ok {
+		return s.(avro.Schema), nil
+	}
+	s, err := avro.Parse(schema.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("[schema-registry] parse avro schema got: %w", err)
+	}
+	f.schemas.Store(schema.Schema, s)
+	return s, nil
+}
+
+func (f *avroFormat) Marshal(schema Schema, v interface{}) ([]byte, error) {
+	s, err := f.parse(schema)
+	if err != nil {
+		return nil, err
+	}
+	return avro.Marshal(s, v)
+}
+
+func (f *avroFormat) Unmarshal(schema Schema, data []byte, out interface{}) error {
+	s, err := f.parse(schema)
+	if err != nil {
+		return err
+	}
+	return avro.Unmarshal(s, data, out)
+}
+
+type protobufFormat struct{}
+
+// NewProtobufFormat return Protobuf format, values must be proto.Message.
+// The message indexes of the Confluent framing are derived from the message
+// descriptor.
+func NewProtobufFormat() Format {
+	return protobufFormat{}
+}
+
+func (protobufFormat) Type() SchemaType {
+	return Protobuf
+}
+
+func (protobufFormat) Marshal(_ Schema, v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("[schema-registry] %T is not a proto.Message", v)
+	}
+
+	b := appendMessageIndexes(nil, messageIndexes(m.ProtoReflect().Descriptor()))
+	return proto.MarshalOptions{}.MarshalAppend(b, m)
+}
+
+func (protobufFormat) Unmarshal(_ Schema, data []byte, out interface{}) error {
+	m, ok := out.(proto.Message)
+	if !ok {
+		return fmt.Errorf("[schema-registry] %T is not a proto.Message", out)
+	}
+
+	_, payload, err := parseMessageIndexes(data)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(payload, m)
+}
+
+// messageIndexes return the path of md within its file, e.g. the second
+// message nested in the first top level message is [0, 1]
+func messageIndexes(md protoreflect.MessageDescriptor) []int {
+	var indexes []int
+	var d protoreflect.Descriptor = md
+	for {
+		parent, ok := d.(protoreflect.MessageDescriptor)
+		if !ok {
+			break
+		}
+		indexes = append([]int{parent.Index()}, indexes...)
+		d = parent.Parent()
+	}
+	return indexes
+}
+
+type jsonFormat struct{}
+
+// NewJSONFormat return JSON Schema format encoding values with encoding/json
+func NewJSONFormat() Format {
+	return jsonFormat{}
+}
+
+func (jsonFormat) Type() SchemaType {
+	return JSON
+}
+
+func (jsonFormat) Marshal(_ Schema, v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonFormat) Unmarshal(_ Schema, data []byte, out interface{}) error {
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,77 @@
+package schemaregistry
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryRegistry in-memory schema registry for tests
+type MemoryRegistry struct {
+	mux      sync.RWMutex
+	schemas  []Schema
+	subjects map[string][]int
+}
+
+// NewMemoryRegistry return empty in-memory registry
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		subjects: make(map[string][]int),
+	}
+}
+
+// Register register schema under subject, IDs start at 1 and are shared
+// across subjects like in the Confluent registry
+func (m *MemoryRegistry) Register(_ context.Context, subject string, schema Schema) (int, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if id, ok := m.lookup(subject, schema); ok {
+		return id, nil
+	}
+
+	id := 0
+	for i, s := range m.schemas {
+		if s == schema {
+			id = i + 1
+			break
+		}
+	}
+	if id == 0 {
+		m.schemas = append(m.schemas, schema)
+		id = len(m.schemas)
+	}
+
+	m.subjects[subject] = append(m.subjects[subject], id)
+	return id, nil
+}
+
+// Lookup return ID of schema registered under subject
+func (m *MemoryRegistry) Lookup(_ context.Context, subject string, schema Schema) (int, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	if id, ok := m.lookup(subject, schema); ok {
+		return id, nil
+	}
+	return 0, ErrNotFound
+}
+
+func (m *MemoryRegistry) lookup(subject string, schema Schema) (int, bool) {
+	for _, id := range m.subjects[subject] {
+		if m.schemas[id-1] == schema {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// GetByID return schema registered with id
+func (m *MemoryRegistry) GetByID(_ context.Context, id int) (Schema, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	if id < 1 || id > len(m.schemas) {
+		return Schema{}, ErrNotFound
+	}
+	return m.schemas[id-1], nil
+}
@@ -0,0 +1,51 @@
+// Package schemaregistry serialize kafka messages in the Confluent schema
+// registry wire format: a zero magic byte, the 4 bytes big endian schema ID
+// and the payload encoded with Avro, Protobuf or JSON Schema.
+package schemaregistry
+
+import (
+	"context"
+	"errors"
+)
+
+// SchemaType format of a registered schema
+type SchemaType string
+
+// Schema types supported by the registry
+const (
+	Avro     SchemaType = "AVRO"
+	Protobuf SchemaType = "PROTOBUF"
+	JSON     SchemaType = "JSON"
+)
+
+// ErrNotFound returned when a subject or schema ID is not registered
+var ErrNotFound = errors.New("[schema-registry] schema not found")
+
+// Schema registered schema definition
+type Schema struct {
+	Type   SchemaType `json:"schemaType,omitempty"`
+	Schema string     `json:"schema"`
+}
+
+// Client represents schema registry client
+type Client interface {
+	// Register register schema under subject and return its ID, registering
+	// an already known schema return the existing ID
+	Register(ctx context.Context, subject string, schema Schema) (int, error)
+	// Lookup return ID of schema already registered under subject
+	Lookup(ctx context.Context, subject string, schema Schema) (int, error)
+	// GetByID return schema registered with id
+	GetByID(ctx context.Context, id int) (Schema, error)
+}
+
+//go:generate easytags $GOFILE json,yaml
+
+// Config entity of schema registry connection
+type Config struct {
+	// URL base url of the registry, e.g. http://localhost:8081
+	URL      string `json:"url" yaml:"url"`
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+	// TimeoutSecond request timeout (defaults to 10 seconds)
+	TimeoutSecond int `json:"timeout_second" yaml:"timeout_second"`
+}
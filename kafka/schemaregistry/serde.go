@@ -0,0 +1,128 @@
+package schemaregistry
+
+import (
+	"context"
+	"fmt"
+)
+
+// SubjectNameStrategy return registry subject of a topic key or value schema
+type SubjectNameStrategy func(topic string, isKey bool) string
+
+// TopicNameStrategy default subject name strategy `<topic>-key` or `<topic>-value`
+func TopicNameStrategy(topic string, isKey bool) string {
+	if isKey {
+		return topic + "-key"
+	}
+	return topic + "-value"
+}
+
+// Serializer encode values in the Confluent wire format
+type Serializer struct {
+	client       Client
+	format       Format
+	schema       Schema
+	subject      SubjectNameStrategy
+	isKey        bool
+	autoRegister bool
+}
+
+// SerializerOption configure Serializer
+type SerializerOption func(*Serializer)
+
+// WithSubjectNameStrategy replace TopicNameStrategy
+func WithSubjectNameStrategy(strategy SubjectNameStrategy) SerializerOption {
+	return func(s *Serializer) {
+		s.subject = strategy
+	}
+}
+
+// WithKey serialize message keys, using the `-key` subject
+func WithKey() SerializerOption {
+	return func(s *Serializer) {
+		s.isKey = true
+	}
+}
+
+// WithoutAutoRegister only lookup schema, fail when it is not registered yet
+func WithoutAutoRegister() SerializerOption {
+	return func(s *Serializer) {
+		s.autoRegister = false
+	}
+}
+
+// NewSerializer return serializer encoding values with schema in format
+func NewSerializer(client Client, format Format, schema string, opts ...SerializerOption) *Serializer {
+	s := &Serializer{
+		client:       client,
+		format:       format,
+		schema:       Schema{Type: format.Type(), Schema: schema},
+		subject:      TopicNameStrategy,
+		autoRegister: true,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Serialize encode v for topic, prefixed with magic byte and schema ID
+func (s *Serializer) Serialize(ctx context.Context, topic string, v interface{}) ([]byte, error) {
+	subject := s.subject(topic, s.isKey)
+
+	var id int
+	var err error
+	if s.autoRegister {
+		id, err = s.client.Register(ctx, subject, s.schema)
+	} else {
+		id, err = s.client.Lookup(ctx, subject, s.schema)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := s.format.Marshal(s.schema, v)
+	if err != nil {
+		return nil, fmt.Errorf("[schema-registry] serialize subject %s got: %w", subject, err)
+	}
+
+	return append(appendHeader(make([]byte, 0, headerSize+len(payload)), id), payload...), nil
+}
+
+// Deserializer decode values framed in the Confluent wire format
+type Deserializer struct {
+	client Client
+	format Format
+}
+
+// NewDeserializer return deserializer of format payloads
+func NewDeserializer(client Client, format Format) *Deserializer {
+	return &Deserializer{
+		client: client,
+		format: format,
+	}
+}
+
+// Deserialize decode data into out with the writer schema fetched by ID
+func (d *Deserializer) Deserialize(ctx context.Context, topic string, data []byte, out interface{}) error {
+	id, payload, err := parseHeader(data)
+	if err != nil {
+		return err
+	}
+
+	schema, err := d.client.GetByID(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if schema.Type == "" {
+		schema.Type = Avro
+	}
+	if schema.Type != d.format.Type() {
+		return fmt.Errorf("[schema-registry] topic %s schema id %d is %s, expected %s", topic, id, schema.Type, d.format.Type())
+	}
+
+	if err := d.format.Unmarshal(schema, payload, out); err != nil {
+		return fmt.Errorf("[schema-registry] deserialize topic %s schema id %d got: %w", topic, id, err)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package schemaregistry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type order struct {
+	ID     string  `avro:"id" json:"id"`
+	Amount float64 `avro:"amount" json:"amount"`
+}
+
+const orderAvroSchema = `{
+	"type": "record",
+	"name": "Order",
+	"fields": [
+		{"name": "id", "type": "string"},
+		{"name": "amount", "type": "double"}
+	]
+}`
+
+func TestAvroRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	registry := NewMemoryRegistry()
+	ser := NewSerializer(registry, NewAvroFormat(), orderAvroSchema)
+	des := NewDeserializer(registry, NewAvroFormat())
+
+	data, err := ser.Serialize(ctx, "orders", order{ID: "o-1", Amount: 12.5})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 0, 1}, data[:5])
+
+	id, err := registry.Lookup(ctx, "orders-value", Schema{Type: Avro, Schema: orderAvroSchema})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, id)
+
+	var out order
+	assert.Nil(t, des.Deserialize(ctx, "orders", data, &out))
+	assert.Equal(t, order{ID: "o-1", Amount: 12.5}, out)
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	registry := NewMemoryRegistry()
+	ser := NewSerializer(registry, NewJSONFormat(), `{"type": "object"}`, WithKey())
+
+	data, err := ser.Serialize(ctx, "orders", order{ID: "o-2"})
+	assert.Nil(t, err)
+
+	_, err = registry.Lookup(ctx, "orders-key", Schema{Type: JSON, Schema: `{"type": "object"}`})
+	assert.Nil(t, err)
+
+	var out order
+	assert.Nil(t, NewDeserializer(registry, NewJSONFormat()).Deserialize(ctx, "orders", data, &out))
+	assert.Equal(t, "o-2", out.ID)
+
+	// payload of another format is rejected
+	assert.NotNil(t, NewDeserializer(registry, NewAvroFormat()).Deserialize(ctx, "orders", data, &out))
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	registry := NewMemoryRegistry()
+	ser := NewSerializer(registry, NewProtobufFormat(), `syntax = "proto3";`)
+
+	data, err := ser.Serialize(ctx, "names", wrapperspb.String("gopher"))
+	assert.Nil(t, err)
+
+	out := &wrapperspb.StringValue{}
+	assert.Nil(t, NewDeserializer(registry, NewProtobufFormat()).Deserialize(ctx, "names", data, out))
+	assert.True(t, proto.Equal(wrapperspb.String("gopher"), out))
+}
+
+func TestWithoutAutoRegister(t *testing.T) {
+	ser := NewSerializer(NewMemoryRegistry(), NewJSONFormat(), `{}`, WithoutAutoRegister())
+	_, err := ser.Serialize(context.Background(), "orders", order{})
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMessageIndexes(t *testing.T) {
+	for _, indexes := range [][]int{{0}, {1}, {0, 2}, {3, 1, 4}} {
+		b := appendMessageIndexes(nil, indexes)
+		got, rest, err := parseMessageIndexes(append(b, 0xff))
+		assert.Nil(t, err)
+		assert.Equal(t, indexes, got)
+		assert.Equal(t, []byte{0xff}, rest)
+	}
+	assert.Equal(t, []byte{0}, appendMessageIndexes(nil, []int{0}))
+}
+
+func TestHTTPClient(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		user, pass, _ := r.BasicAuth()
+		assert.Equal(t, "user", user)
+		assert.Equal(t, "secret", pass)
+
+		switch r.URL.Path {
+		case "/subjects/orders-value/versions":
+			var s Schema
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&s))
+			assert.Empty(t, s.Type)
+			_, _ = w.Write([]byte(`{"id": 7}`))
+		case "/schemas/ids/7":
+			_, _ = w.Write([]byte(`{"schema": "\"string\""}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error_code": 40403, "message": "Schema not found"}`))
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	client := NewClient(Config{URL: srv.URL + "/", Username: "user", Password: "secret"})
+
+	id, err := client.Register(ctx, "orders-value", Schema{Type: Avro, Schema: `"string"`})
+	assert.Nil(t, err)
+	assert.Equal(t, 7, id)
+
+	// cached after register
+	schema, err := client.GetByID(ctx, 7)
+	assert.Nil(t, err)
+	assert.Equal(t, Schema{Type: Avro, Schema: `"string"`}, schema)
+	assert.Equal(t, 1, requests)
+
+	_, err = client.GetByID(ctx, 8)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
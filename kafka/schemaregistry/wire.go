@@ -0,0 +1,66 @@
+package schemaregistry
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	magicByte  = 0
+	headerSize = 5
+)
+
+// ErrInvalidWireFormat returned when data is not framed with magic byte and schema ID
+var ErrInvalidWireFormat = errors.New("[schema-registry] invalid wire format")
+
+// appendHeader append magic byte and schema id to b
+func appendHeader(b []byte, id int) []byte {
+	b = append(b, magicByte)
+	return binary.BigEndian.AppendUint32(b, uint32(id))
+}
+
+// parseHeader return schema id and payload of framed data
+func parseHeader(data []byte) (int, []byte, error) {
+	if len(data) < headerSize || data[0] != magicByte {
+		return 0, nil, ErrInvalidWireFormat
+	}
+	return int(binary.BigEndian.Uint32(data[1:headerSize])), data[headerSize:], nil
+}
+
+// appendMessageIndexes append protobuf message indexes as zig-zag varints,
+// the common first message case [0] is written as a single 0
+func appendMessageIndexes(b []byte, indexes []int) []byte {
+	if len(indexes) == 1 && indexes[0] == 0 {
+		return binary.AppendVarint(b, 0)
+	}
+	b = binary.AppendVarint(b, int64(len(indexes)))
+	for _, i := range indexes {
+		b = binary.AppendVarint(b, int64(i))
+	}
+	return b
+}
+
+// parseMessageIndexes return protobuf message indexes and the remaining payload
+func parseMessageIndexes(data []byte) ([]int, []byte, error) {
+	n, size := binary.Varint(data)
+	if size <= 0 || n < 0 {
+		return nil, nil, fmt.Errorf("%w: message indexes", ErrInvalidWireFormat)
+	}
+	data = data[size:]
+
+	if n == 0 {
+		return []int{0}, data, nil
+	}
+
+	indexes := make([]int, 0, n)
+	for i := int64(0); i < n; i++ {
+		v, size := binary.Varint(data)
+		if size <= 0 {
+			return nil, nil, fmt.Errorf("%w: message indexes", ErrInvalidWireFormat)
+		}
+		indexes = append(indexes, int(v))
+		data = data[size:]
+	}
+	return indexes, data, nil
+}
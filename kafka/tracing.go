@@ -0,0 +1,134 @@
+// Package kafka messaging broker
+package kafka
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/IBM/sarama"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// instrumentationName name of the tracer used by producer and consumer spans
+	instrumentationName = "github.com/lukmanlukmin/go-lib/kafka"
+)
+
+// propagator carries W3C traceparent/tracestate and baggage on record headers
+var propagator propagation.TextMapPropagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{},
+	propagation.Baggage{},
+)
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// startProducerSpan start publish span and inject its context into headers
+func startProducerSpan(ctx context.Context, msg *MessageContext, headers map[string]string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		semconv.MessagingSystemKafka,
+		semconv.MessagingOperationTypePublish,
+		semconv.MessagingOperationName("publish"),
+		semconv.MessagingDestinationName(msg.Topic),
+		semconv.MessagingMessageBodySize(len(msg.Value)),
+	}
+	if len(msg.Key) > 0 {
+		attrs = append(attrs, semconv.MessagingKafkaMessageKey(string(msg.Key)))
+	}
+
+	ctx, span := tracer().Start(ctx, msg.Topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attrs...),
+	)
+	propagator.Inject(ctx, propagation.MapCarrier(headers))
+	return ctx, span
+}
+
+// startConsumerSpan extract context from record headers and start process span
+func startConsumerSpan(ctx context.Context, msg *sarama.ConsumerMessage, groupID string, headers map[string]string) (context.Context, trace.Span) {
+	ctx = propagator.Extract(ctx, propagation.MapCarrier(headers))
+
+	attrs := []attribute.KeyValue{
+		semconv.MessagingSystemKafka,
+		semconv.MessagingOperationTypeDeliver,
+		semconv.MessagingOperationName("process"),
+		semconv.MessagingDestinationName(msg.Topic),
+		semconv.MessagingDestinationPartitionID(strconv.Itoa(int(msg.Partition))),
+		semconv.MessagingKafkaMessageOffset(int(msg.Offset)),
+		semconv.MessagingKafkaConsumerGroup(groupID),
+		semconv.MessagingMessageBodySize(len(msg.Value)),
+	}
+	if len(msg.Key) > 0 {
+		attrs = append(attrs, semconv.MessagingKafkaMessageKey(string(msg.Key)))
+	}
+
+	return tracer().Start(ctx, msg.Topic+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// startBatchSpan start process span of a batch linked to every message trace
+func startBatchSpan(ctx context.Context, msgs []*sarama.ConsumerMessage, groupID string, headers []map[string]string) (context.Context, trace.Span) {
+	links := make([]trace.Link, 0, len(msgs))
+	for _, h := range headers {
+		sc := trace.SpanContextFromContext(propagator.Extract(context.Background(), propagation.MapCarrier(h)))
+		if sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+	}
+
+	first := msgs[0]
+	return tracer().Start(ctx, first.Topic+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			semconv.MessagingSystemKafka,
+			semconv.MessagingOperationTypeDeliver,
+			semconv.MessagingOperationName("process"),
+			semconv.MessagingDestinationName(first.Topic),
+			semconv.MessagingDestinationPartitionID(strconv.Itoa(int(first.Partition))),
+			semconv.MessagingKafkaConsumerGroup(groupID),
+			semconv.MessagingBatchMessageCount(len(msgs)),
+		),
+	)
+}
+
+// endSpan record error if any and end the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// recordHeaders convert header map to sarama record headers
+func recordHeaders(headers map[string]string) []sarama.RecordHeader {
+	if len(headers) == 0 {
+		return nil
+	}
+	rh := make([]sarama.RecordHeader, 0, len(headers))
+	for k, v := range headers {
+		rh = append(rh, sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
+	}
+	return rh
+}
+
+// headerMap convert consumed record headers to map, later duplicates win
+func headerMap(headers []*sarama.RecordHeader) map[string]string {
+	m := make(map[string]string, len(headers))
+	for _, h := range headers {
+		if h == nil {
+			continue
+		}
+		m[string(h.Key)] = string(h.Value)
+	}
+	return m
+}
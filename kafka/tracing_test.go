@@ -0,0 +1,88 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func useSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return recorder
+}
+
+func spanAttrs(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestTracePropagateFromProducerToConsumer(t *testing.T) {
+	recorder := useSpanRecorder(t)
+
+	headers := map[string]string{"tenant": "acme"}
+	_, span := startProducerSpan(context.Background(), &MessageContext{Topic: "orders", Key: []byte("o-1"), Value: "value"}, headers)
+	endSpan(span, nil)
+	assert.NotEmpty(t, headers["traceparent"])
+	assert.Equal(t, "acme", headers["tenant"])
+
+	msg := consumerMessage("orders", 3, 7, "o-1")
+	msg.Headers = headerPointers(recordHeaders(headers))
+
+	var handled trace.SpanContext
+	h := NewConsumerHandler(func(ctx context.Context, _ *MessageDecoder) error {
+		handled = trace.SpanContextFromContext(ctx)
+		return nil
+	}, false, "billing")
+	assert.Nil(t, h.ConsumeClaim(newFakeSession(context.Background()), newFakeClaim("orders", 3, msg)))
+
+	spans := recorder.Ended()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	producer, consumer := spans[0], spans[1]
+
+	assert.Equal(t, "orders publish", producer.Name())
+	assert.Equal(t, trace.SpanKindProducer, producer.SpanKind())
+	assert.Equal(t, "orders process", consumer.Name())
+	assert.Equal(t, trace.SpanKindConsumer, consumer.SpanKind())
+
+	// the consumer span continue the trace of the producer span
+	assert.Equal(t, producer.SpanContext().TraceID(), consumer.SpanContext().TraceID())
+	assert.Equal(t, producer.SpanContext().SpanID(), consumer.Parent().SpanID())
+	assert.Equal(t, consumer.SpanContext().SpanID(), handled.SpanID())
+
+	pa := spanAttrs(producer)
+	assert.Equal(t, "kafka", pa[semconv.MessagingSystemKey].AsString())
+	assert.Equal(t, "publish", pa[semconv.MessagingOperationTypeKey].AsString())
+	assert.Equal(t, "orders", pa[semconv.MessagingDestinationNameKey].AsString())
+	assert.Equal(t, "o-1", pa[semconv.MessagingKafkaMessageKeyKey].AsString())
+
+	ca := spanAttrs(consumer)
+	assert.Equal(t, "kafka", ca[semconv.MessagingSystemKey].AsString())
+	assert.Equal(t, "orders", ca[semconv.MessagingDestinationNameKey].AsString())
+	assert.Equal(t, "3", ca[semconv.MessagingDestinationPartitionIDKey].AsString())
+	assert.Equal(t, int64(7), ca[semconv.MessagingKafkaMessageOffsetKey].AsInt64())
+	assert.Equal(t, "billing", ca[semconv.MessagingKafkaConsumerGroupKey].AsString())
+}
+
+func headerPointers(headers []sarama.RecordHeader) []*sarama.RecordHeader {
+	out := make([]*sarama.RecordHeader, len(headers))
+	for i := range headers {
+		out[i] = &headers[i]
+	}
+	return out
+}
@@ -0,0 +1,170 @@
+// Package kafka messaging broker
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/lukmanlukmin/go-lib/log"
+)
+
+type transactionalProducer struct {
+	*producer
+}
+
+// NewTransactionalProducer return producer publishing within transactions,
+// cfg.Producer.TransactionalID must be set. Like NewProducer the brokers
+// are connected on first use. cfg is left untouched, the producer is
+// idempotent whatever cfg.Producer.IdemPotent.
+func NewTransactionalProducer(cfg *Config) (TransactionalProducer, error) {
+	if cfg.Producer.TransactionalID == "" {
+		return nil, &ConfigError{Problems: []error{errors.New("transactional producer require producer transactional_id")}}
+	}
+
+	c := *cfg
+	c.Producer.IdemPotent = true
+	config, err := producerConfig(&c)
+	if err != nil {
+		return nil, err
+	}
+	config.Producer.Transaction.ID = c.Producer.TransactionalID
+	if c.Producer.TransactionTimeoutSecond > 0 {
+		config.Producer.Transaction.Timeout = time.Duration(c.Producer.TransactionTimeoutSecond) * time.Second
+	}
+	if config, err = validClientConfig(config); err != nil {
+		return nil, err
+	}
+
+	return &transactionalProducer{producer: newProducer(&c, config)}, nil
+}
+
+// ValidateExactlyOnce report the consumer settings of cfg breaking the
+// exactly once processing of TransformHandler as a *ConfigError: auto
+// commit mark messages before the transaction commit them and read
+// uncommitted consumers receive messages of aborted transactions.
+func ValidateExactlyOnce(cfg *Config) error {
+	var problems []error
+	if cfg.Consumer.AutoCommit {
+		problems = append(problems, errors.New("exactly once require consumer auto_commit false"))
+	}
+	if cfg.Consumer.IsolationLevel != int8(sarama.ReadCommitted) {
+		problems = append(problems, errors.New("exactly once require consumer isolation_level 1 (read committed)"))
+	}
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// txnClient return the connected producer, transaction methods wait the
+// connection up to the dial timeout
+func (t *transactionalProducer) txnClient() (sarama.SyncProducer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.config.Net.DialTimeout)
+	defer cancel()
+
+	return t.client(ctx)
+}
+
+// BeginTxn start a new transaction
+func (t *transactionalProducer) BeginTxn() error {
+	client, err := t.txnClient()
+	if err != nil {
+		return err
+	}
+	if err := client.BeginTxn(); err != nil {
+		return fmt.Errorf("[kafka-publisher] begin transaction got: %w", err)
+	}
+	return nil
+}
+
+// Commit commit the current transaction
+func (t *transactionalProducer) Commit() error {
+	client, err := t.txnClient()
+	if err != nil {
+		return err
+	}
+	if err := client.CommitTxn(); err != nil {
+		return fmt.Errorf("[kafka-publisher] commit transaction got: %w", err)
+	}
+	return nil
+}
+
+// Abort abort the current transaction
+func (t *transactionalProducer) Abort() error {
+	client, err := t.txnClient()
+	if err != nil {
+		return err
+	}
+	if err := client.AbortTxn(); err != nil {
+		return fmt.Errorf("[kafka-publisher] abort transaction got: %w", err)
+	}
+	return nil
+}
+
+// AddOffset add the offset after msg to the transaction for groupID
+func (t *transactionalProducer) AddOffset(msg *MessageDecoder, groupID string) error {
+	offsets := map[string][]*sarama.PartitionOffsetMetadata{
+		msg.Topic: {{Partition: msg.Partition, Offset: msg.Offset + 1}},
+	}
+	client, err := t.txnClient()
+	if err != nil {
+		return err
+	}
+	if err := client.AddOffsetsToTxn(offsets, groupID); err != nil {
+		return fmt.Errorf("[kafka-publisher] add offset topic: %s, partition %d, offset %d to transaction got: %w", msg.Topic, msg.Partition, msg.Offset, err)
+	}
+	return nil
+}
+
+// TransformFunc map a consumed message into the messages to publish
+type TransformFunc func(ctx context.Context, msg *MessageDecoder) ([]*MessageContext, error)
+
+// TransformHandler return consume-transform-produce Handler. The messages
+// returned by fn and the consumed offset are committed in one transaction,
+// so with read committed downstream consumers every input is processed
+// exactly once. Any failure abort the transaction and return the error so
+// the message is retried by the consumer. Transactions are serialized since
+// a producer has only one transaction open at a time. The consumer must
+// run with the settings ValidateExactlyOnce accept.
+func TransformHandler(p TransactionalProducer, groupID string, fn TransformFunc) Handler {
+	var mux sync.Mutex
+
+	return func(ctx context.Context, msg *MessageDecoder) (err error) {
+		mux.Lock()
+		defer mux.Unlock()
+
+		if err = p.BeginTxn(); err != nil {
+			return err
+		}
+
+		defer func() {
+			if err == nil {
+				return
+			}
+			if aerr := p.Abort(); aerr != nil {
+				log.WithContext(ctx).Warn(aerr.Error())
+			}
+		}()
+
+		out, err := fn(ctx, msg)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range out {
+			if err = p.Publish(ctx, m); err != nil {
+				return err
+			}
+		}
+
+		if err = p.AddOffset(msg, groupID); err != nil {
+			return err
+		}
+
+		return p.Commit()
+	}
+}
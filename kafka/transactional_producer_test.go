@@ -0,0 +1,96 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeTxnProducer struct {
+	calls []string
+}
+
+func (p *fakeTxnProducer) Publish(_ context.Context, msg *MessageContext) error {
+	p.calls = append(p.calls, "publish "+msg.Topic)
+	return nil
+}
+
+func (p *fakeTxnProducer) BeginTxn() error {
+	p.calls = append(p.calls, "begin")
+	return nil
+}
+
+func (p *fakeTxnProducer) Commit() error {
+	p.calls = append(p.calls, "commit")
+	return nil
+}
+
+func (p *fakeTxnProducer) Abort() error {
+	p.calls = append(p.calls, "abort")
+	return nil
+}
+
+func (p *fakeTxnProducer) AddOffset(msg *MessageDecoder, groupID string) error {
+	p.calls = append(p.calls, fmt.Sprintf("offset %s %s %d", groupID, msg.Topic, msg.Offset+1))
+	return nil
+}
+
+func (p *fakeTxnProducer) Close() error { return nil }
+
+func TestTransformHandler(t *testing.T) {
+	p := &fakeTxnProducer{}
+	h := TransformHandler(p, "group", func(_ context.Context, msg *MessageDecoder) ([]*MessageContext, error) {
+		return []*MessageContext{{Topic: "out", Value: string(msg.Body)}}, nil
+	})
+
+	assert.Nil(t, h(context.Background(), &MessageDecoder{Topic: "in", Offset: 4, Body: []byte("v")}))
+	assert.Equal(t, []string{"begin", "publish out", "offset group in 5", "commit"}, p.calls)
+}
+
+func TestTransformHandlerAbortOnError(t *testing.T) {
+	p := &fakeTxnProducer{}
+	h := TransformHandler(p, "group", func(_ context.Context, _ *MessageDecoder) ([]*MessageContext, error) {
+		return nil, errors.New("transform failed")
+	})
+
+	assert.NotNil(t, h(context.Background(), &MessageDecoder{Topic: "in"}))
+	assert.Equal(t, []string{"begin", "abort"}, p.calls)
+}
+
+func TestNewTransactionalProducerConfig(t *testing.T) {
+	cfg := &Config{Brokers: []string{"localhost:9092"}, Producer: ProducerConfig{TransactionalID: "billing-1"}}
+	p, err := NewTransactionalProducer(cfg)
+	assert.Nil(t, err)
+	if assert.NotNil(t, p) {
+		assert.Equal(t, "billing-1", p.(*transactionalProducer).config.Producer.Transaction.ID)
+		assert.True(t, p.(*transactionalProducer).config.Producer.Idempotent)
+		assert.Nil(t, p.Close())
+	}
+	// the caller config is left untouched
+	assert.False(t, cfg.Producer.IdemPotent)
+	assert.Empty(t, cfg.Version)
+
+	// brokers before 0.11 have no transactions
+	cfg.Version = "0.10.2.0"
+	_, err = NewTransactionalProducer(cfg)
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+}
+
+func TestValidateExactlyOnce(t *testing.T) {
+	cfg := &Config{Consumer: ConsumerConfig{IsolationLevel: int8(sarama.ReadCommitted)}}
+	assert.Nil(t, ValidateExactlyOnce(cfg))
+
+	cfg.Consumer = ConsumerConfig{AutoCommit: true}
+	err := ValidateExactlyOnce(cfg)
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+
+	var cerr *ConfigError
+	if assert.True(t, errors.As(err, &cerr)) {
+		// auto commit and read uncommitted
+		assert.Len(t, cerr.Problems, 2)
+	}
+}
@@ -0,0 +1,184 @@
+// Package kafka messaging
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+var (
+	// ErrNoSerializer returned by Encode of a SerdeCodec without serializer
+	ErrNoSerializer = errors.New("[kafka] codec has no serializer")
+	// ErrNoDeserializer returned by Decode of a SerdeCodec without deserializer
+	ErrNoDeserializer = errors.New("[kafka] codec has no deserializer")
+)
+
+// Codec encode and decode message values of type T
+type Codec[T any] interface {
+	Encode(ctx context.Context, topic string, v T) ([]byte, error)
+	Decode(ctx context.Context, topic string, data []byte) (T, error)
+}
+
+// JSONCodec encode values with encoding/json. Values implementing
+// MessageEncoder are encoded with their own Encode.
+type JSONCodec[T any] struct{}
+
+// Encode encode v to bytes
+func (JSONCodec[T]) Encode(_ context.Context, _ string, v T) ([]byte, error) {
+	if enc, ok := any(v).(MessageEncoder); ok {
+		return enc.Encode()
+	}
+	return json.Marshal(v)
+}
+
+// Decode decode data to T
+func (JSONCodec[T]) Decode(_ context.Context, _ string, data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+type serdeCodec[T any] struct {
+	serializer   Serializer
+	deserializer Deserializer
+}
+
+// SerdeCodec return codec backed by serializer and deserializer, e.g. the
+// schema registry ones. Either can be nil when only producing or consuming,
+// Encode then return ErrNoSerializer and Decode ErrNoDeserializer.
+func SerdeCodec[T any](s Serializer, d Deserializer) Codec[T] {
+	return serdeCodec[T]{serializer: s, deserializer: d}
+}
+
+func (c serdeCodec[T]) Encode(ctx context.Context, topic string, v T) ([]byte, error) {
+	if c.serializer == nil {
+		return nil, ErrNoSerializer
+	}
+	return c.serializer.Serialize(ctx, topic, v)
+}
+
+func (c serdeCodec[T]) Decode(ctx context.Context, topic string, data []byte) (T, error) {
+	var v T
+	if c.deserializer == nil {
+		return v, ErrNoDeserializer
+	}
+	// pointer types such as protobuf messages are decoded into a new value,
+	// deserializers can't fill a pointer to a nil pointer
+	if t := reflect.TypeOf(v); t != nil && t.Kind() == reflect.Pointer {
+		v = reflect.New(t.Elem()).Interface().(T)
+		err := c.deserializer.Deserialize(ctx, topic, data, v)
+		return v, err
+	}
+	err := c.deserializer.Deserialize(ctx, topic, data, &v)
+	return v, err
+}
+
+type typedOptions[T any] struct {
+	codec Codec[T]
+	key   func(T) []byte
+}
+
+// TypedOption configure TypedProducer and TypedConsumer
+type TypedOption[T any] func(*typedOptions[T])
+
+// WithCodec replace the default JSONCodec
+func WithCodec[T any](codec Codec[T]) TypedOption[T] {
+	return func(o *typedOptions[T]) {
+		o.codec = codec
+	}
+}
+
+// WithKey derive message key from the value, overriding MessageEncoder.Key
+func WithKey[T any](key func(T) []byte) TypedOption[T] {
+	return func(o *typedOptions[T]) {
+		o.key = key
+	}
+}
+
+func newTypedOptions[T any](opts []TypedOption[T]) typedOptions[T] {
+	o := typedOptions[T]{
+		codec: JSONCodec[T]{},
+		key: func(v T) []byte {
+			if enc, ok := any(v).(MessageEncoder); ok {
+				return []byte(enc.Key())
+			}
+			return nil
+		},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// TypedProducer publish values of type T to a single topic
+type TypedProducer[T any] struct {
+	producer Producer
+	topic    string
+	opts     typedOptions[T]
+}
+
+// NewTypedProducer return producer publishing T values to topic through p
+func NewTypedProducer[T any](p Producer, topic string, opts ...TypedOption[T]) *TypedProducer[T] {
+	return &TypedProducer[T]{
+		producer: p,
+		topic:    topic,
+		opts:     newTypedOptions(opts),
+	}
+}
+
+// Publish encode v and publish it with the derived key
+func (p *TypedProducer[T]) Publish(ctx context.Context, v T, headers map[string]string) error {
+	b, err := p.opts.codec.Encode(ctx, p.topic, v)
+	if err != nil {
+		return err
+	}
+
+	return p.producer.Publish(ctx, &MessageContext{
+		Value:   string(b),
+		Key:     p.opts.key(v),
+		Headers: headers,
+		Topic:   p.topic,
+	})
+}
+
+// TypedHandler process a decoded value, msg carry the message metadata
+type TypedHandler[T any] func(ctx context.Context, v T, msg *MessageDecoder) error
+
+// TypedConsumer consume values of type T
+type TypedConsumer[T any] struct {
+	consumer Consumer
+	opts     typedOptions[T]
+}
+
+// NewTypedConsumer return consumer decoding T values consumed by c
+func NewTypedConsumer[T any](c Consumer, opts ...TypedOption[T]) *TypedConsumer[T] {
+	return &TypedConsumer[T]{
+		consumer: c,
+		opts:     newTypedOptions(opts),
+	}
+}
+
+// Handler return Handler decoding message value before calling h, decoding
+// errors are returned like handler errors
+func (c *TypedConsumer[T]) Handler(h TypedHandler[T]) Handler {
+	return func(ctx context.Context, msg *MessageDecoder) error {
+		v, err := c.opts.codec.Decode(ctx, msg.Topic, msg.Body)
+		if err != nil {
+			return err
+		}
+		return h(ctx, v, msg)
+	}
+}
+
+// Subscribe consume topics as groupID until ctx is done
+func (c *TypedConsumer[T]) Subscribe(ctx context.Context, groupID string, topics []string, h TypedHandler[T]) {
+	c.consumer.Subscribe(&ConsumerContext{
+		Handler: c.Handler(h),
+		Topics:  topics,
+		GroupID: groupID,
+		Context: ctx,
+	})
+}
@@ -0,0 +1,82 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/lukmanlukmin/go-lib/kafka/schemaregistry"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type orderCreated struct {
+	ID     string `json:"id"`
+	Amount int    `json:"amount"`
+}
+
+func (o orderCreated) Encode() ([]byte, error) { return json.Marshal(o) }
+func (o orderCreated) Key() string             { return o.ID }
+func (o orderCreated) Length() int             { return 0 }
+
+func TestTypedProducerAndConsumer(t *testing.T) {
+	ctx := context.Background()
+	fp := &fakeProducer{}
+
+	producer := NewTypedProducer[orderCreated](fp, "orders")
+	assert.Nil(t, producer.Publish(ctx, orderCreated{ID: "o-1", Amount: 3}, map[string]string{"source": "test"}))
+
+	assert.Len(t, fp.published, 1)
+	published := fp.published[0]
+	assert.Equal(t, "orders", published.Topic)
+	assert.Equal(t, []byte("o-1"), published.Key)
+	assert.Equal(t, "test", published.Headers["source"])
+
+	var got orderCreated
+	handler := NewTypedConsumer[orderCreated](nil).Handler(func(_ context.Context, v orderCreated, msg *MessageDecoder) error {
+		got = v
+		assert.Equal(t, "orders", msg.Topic)
+		return nil
+	})
+
+	assert.Nil(t, handler(ctx, &MessageDecoder{Topic: "orders", Body: []byte(published.Value)}))
+	assert.Equal(t, orderCreated{ID: "o-1", Amount: 3}, got)
+
+	// undecodable value is reported as handler error
+	assert.NotNil(t, handler(ctx, &MessageDecoder{Topic: "orders", Body: []byte("{")}))
+}
+
+func TestTypedProducerWithKey(t *testing.T) {
+	fp := &fakeProducer{}
+	producer := NewTypedProducer(fp, "amounts", WithKey(func(v int) []byte {
+		return []byte("fixed")
+	}))
+
+	assert.Nil(t, producer.Publish(context.Background(), 42, nil))
+	assert.Equal(t, "42", fp.published[0].Value)
+	assert.Equal(t, []byte("fixed"), fp.published[0].Key)
+}
+
+func TestSerdeCodecProtobuf(t *testing.T) {
+	ctx := context.Background()
+	registry := schemaregistry.NewMemoryRegistry()
+	codec := SerdeCodec[*wrapperspb.StringValue](
+		schemaregistry.NewSerializer(registry, schemaregistry.NewProtobufFormat(), `syntax = "proto3";`),
+		schemaregistry.NewDeserializer(registry, schemaregistry.NewProtobufFormat()),
+	)
+
+	data, err := codec.Encode(ctx, "names", wrapperspb.String("gopher"))
+	assert.Nil(t, err)
+
+	out, err := codec.Decode(ctx, "names", data)
+	if assert.Nil(t, err) {
+		assert.True(t, proto.Equal(wrapperspb.String("gopher"), out))
+	}
+
+	// producing or consuming only
+	_, err = SerdeCodec[*wrapperspb.StringValue](nil, nil).Encode(ctx, "names", wrapperspb.String("gopher"))
+	assert.ErrorIs(t, err, ErrNoSerializer)
+	_, err = SerdeCodec[*wrapperspb.StringValue](nil, nil).Decode(ctx, "names", data)
+	assert.ErrorIs(t, err, ErrNoDeserializer)
+}
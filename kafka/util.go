@@ -2,18 +2,18 @@
 package kafka
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 
 	"os"
 	"time"
 
-	"github.com/lukmanlukmin/go-lib/log"
-
 	"github.com/xdg/scram"
 )
 
@@ -44,24 +44,26 @@ func (x *XDGSCRAMClient) Done() bool {
 	return x.ClientConversation.Done()
 }
 
-func createTlsConfig(c TLS) (t *tls.Config) {
-	t = &tls.Config{
+func createTlsConfig(c TLS) (*tls.Config, error) {
+	t := &tls.Config{
 		//nolint:gosec // just skip to verify
 		InsecureSkipVerify: c.SkipVerify,
 	}
 	if c.CertFile != "" && c.KeyFile != "" && c.CaFile != "" {
 		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
 		if err != nil {
-			log.Fatal(err)
+			return nil, fmt.Errorf("load key pair %s got: %w", c.CertFile, err)
 		}
 
 		caCert, err := os.ReadFile(c.CaFile)
 		if err != nil {
-			log.Fatal(err)
+			return nil, fmt.Errorf("read ca file got: %w", err)
 		}
 
 		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificate found in ca file %s", c.CaFile)
+		}
 
 		t = &tls.Config{
 			Certificates:       []tls.Certificate{cert},
@@ -69,7 +71,7 @@ func createTlsConfig(c TLS) (t *tls.Config) {
 			InsecureSkipVerify: c.SkipVerify, //nolint:gosec // insecure skip verify
 		}
 	}
-	return t
+	return t, nil
 }
 
 type MessageFormat struct {
@@ -82,15 +84,36 @@ type MessageMetadata struct {
 	EmitTime  int64     `json:"emit_time,omitempty"`
 	Event     string    `json:"event,omitempty"`
 	Hash      string    `json:"hash,omitempty"`
+	Signature string    `json:"signature,omitempty"`
 	Timestamp time.Time `json:"timestamp,omitempty"`
 }
 
-func BuildPayload(data interface{}, topic string) (*MessageFormat, error) {
+// PayloadOption configure BuildPayload
+type PayloadOption func(*payloadOptions)
+
+type payloadOptions struct {
+	signingKey []byte
+}
+
+// WithSigningKey sign the payload data and metadata with HMAC-SHA256 using
+// the shared key
+func WithSigningKey(key []byte) PayloadOption {
+	return func(o *payloadOptions) {
+		o.signingKey = key
+	}
+}
+
+func BuildPayload(data interface{}, topic string, opts ...PayloadOption) (*MessageFormat, error) {
+	o := payloadOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	hostName, err := os.Hostname()
 	if err != nil {
 		return nil, err
 	}
-	hashm, err := hashPayload(data)
+	mb, err := json.Marshal(data)
 	if err != nil {
 		return nil, err
 	}
@@ -99,20 +122,34 @@ func BuildPayload(data interface{}, topic string) (*MessageFormat, error) {
 		EmitHost:  hostName,
 		EmitTime:  nowTime.Unix(),
 		Event:     topic,
-		Hash:      hashm,
+		Hash:      hashPayload(mb),
 		Timestamp: nowTime,
 	}
+	if len(o.signingKey) > 0 {
+		metadata.Signature = signPayload(signedPayload(mb, metadata), o.signingKey)
+	}
 	return &MessageFormat{
 		Data:     data,
 		Metadata: metadata,
 	}, nil
 }
 
-func hashPayload(m interface{}) (string, error) {
-	mb, err := json.Marshal(m)
-	if err != nil {
-		return "", err
-	}
+func hashPayload(mb []byte) string {
 	k := sha256.Sum256(mb)
-	return string(base64.StdEncoding.EncodeToString(k[:])), nil //nolint:unconvert // ignore convert
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// signedPayload return the bytes covered by the signature, data followed by
+// the metadata so neither can be changed without detection
+func signedPayload(mb []byte, m MessageMetadata) []byte {
+	b := make([]byte, 0, len(mb)+128)
+	b = append(b, mb...)
+	b = fmt.Appendf(b, "\n%s\n%s\n%d\n%s\n%s", m.Event, m.EmitHost, m.EmitTime, m.Timestamp.UTC().Format(time.RFC3339Nano), m.Hash)
+	return b
+}
+
+func signPayload(mb []byte, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(mb)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
 }
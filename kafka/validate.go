@@ -0,0 +1,143 @@
+// Package kafka messaging broker
+package kafka
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/IBM/sarama"
+)
+
+// saslMechanisms mechanisms accepted in SASL.Mechanism
+var saslMechanisms = map[string]bool{
+	sarama.SASLTypePlaintext:   true,
+	sarama.SASLTypeOAuth:       true,
+	sarama.SASLTypeSCRAMSHA256: true,
+	sarama.SASLTypeSCRAMSHA512: true,
+}
+
+// clientIDPattern client ids accepted by the brokers
+var clientIDPattern = regexp.MustCompile(`\A[A-Za-z0-9._-]+\z`)
+
+// Validate report every problem of c at once as a *ConfigError, nil when
+// producers and consumers can be built from c. Empty settings are valid,
+// their defaults are applied.
+func (c *Config) Validate() error {
+	var problems []error
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if len(c.Brokers) == 0 {
+		add("brokers is empty")
+	}
+	for i, b := range c.Brokers {
+		if strings.TrimSpace(b) == "" {
+			add("broker %d is empty", i)
+		}
+	}
+
+	if c.ClientID != "" && !clientIDPattern.MatchString(c.ClientID) {
+		add("client_id %q may only contain letters, digits, '.', '_' and '-'", c.ClientID)
+	}
+	if c.Metadata.RefreshSecond < 0 || c.Metadata.RetryMax < 0 || c.Metadata.RetryBackoffMs < 0 {
+		add("metadata refresh_second, retry_max and retry_backoff_ms can't be negative")
+	}
+
+	if c.Version != "" {
+		if _, err := sarama.ParseKafkaVersion(c.Version); err != nil {
+			add("version %q: %w", c.Version, err)
+		}
+	}
+
+	if c.SASL.Enable {
+		mechanism := c.SASL.Mechanism
+		if mechanism == "" {
+			mechanism = sarama.SASLTypePlaintext
+		}
+		if !saslMechanisms[mechanism] {
+			add("sasl mechanism %q not supported", c.SASL.Mechanism)
+		}
+		if mechanism != sarama.SASLTypeOAuth && c.SASL.User == "" {
+			add("sasl user is empty")
+		}
+		if v := c.SASL.Version; c.SASL.VersionSet && v != sarama.SASLHandshakeV0 && v != sarama.SASLHandshakeV1 {
+			add("sasl version %d not supported", v)
+		}
+		if mechanism == sarama.SASLTypeOAuth && c.SASL.VersionSet && c.SASL.Version == sarama.SASLHandshakeV0 {
+			add("sasl oauthbearer require version 1")
+		}
+		if mechanism == sarama.SASLTypeOAuth && c.SASL.TokenProvider == nil {
+			if c.SASL.OAuth.TokenURL == "" {
+				add("sasl oauthbearer require a token provider or oauth token_url")
+			} else if _, err := url.Parse(c.SASL.OAuth.TokenURL); err != nil {
+				add("sasl oauth token_url: %w", err)
+			}
+		}
+	}
+
+	if c.TLS.Enable {
+		if _, err := createTlsConfig(c.TLS); err != nil {
+			add("tls: %w", err)
+		}
+	}
+
+	if s := strings.TrimSpace(c.Producer.PartitionStrategy); s != "" {
+		if _, ok := partitiions[s]; !ok {
+			add("producer partition strategy %q not supported", s)
+		}
+	}
+	if c.Producer.TimeoutSecond < 0 {
+		add("producer timeout_second is negative")
+	}
+	if c.Producer.Compression != "" {
+		var codec sarama.CompressionCodec
+		if err := codec.UnmarshalText([]byte(c.Producer.Compression)); err != nil {
+			add("producer compression: %w", err)
+		}
+	}
+	if c.Producer.MaxMessageBytes < 0 || c.Producer.RetryMax < 0 || c.Producer.RetryBackoffMs < 0 {
+		add("producer max_message_bytes, retry_max and retry_backoff_ms can't be negative")
+	}
+
+	if s := strings.TrimSpace(c.Consumer.RebalanceStrategy); s != "" {
+		if _, ok := balanceStrategies[s]; !ok {
+			add("consumer rebalance strategy %q not supported, use %q, %q or %q", s,
+				sarama.RoundRobinBalanceStrategyName,
+				sarama.RangeBalanceStrategyName,
+				sarama.StickyBalanceStrategyName,
+			)
+		}
+	}
+	if o := c.Consumer.OffsetInitial; o != 0 && o != sarama.OffsetNewest && o != sarama.OffsetOldest {
+		add("consumer offset_initial %d must be %d (newest) or %d (oldest)", o, sarama.OffsetNewest, sarama.OffsetOldest)
+	}
+	if l := c.Consumer.IsolationLevel; l != int8(sarama.ReadUncommitted) && l != int8(sarama.ReadCommitted) {
+		add("consumer isolation_level %d must be 0 or 1", l)
+	}
+	if c.Consumer.Concurrency < 0 || c.Consumer.BatchSize < 0 || c.Consumer.BatchTimeoutMs < 0 || c.Consumer.PatternRefreshSecond < 0 {
+		add("consumer concurrency, batch_size, batch_timeout_ms and pattern_refresh_second can't be negative")
+	}
+	if c.Consumer.FetchMinBytes < 0 || c.Consumer.FetchDefaultBytes < 0 || c.Consumer.FetchMaxBytes < 0 || c.Consumer.MaxWaitTimeMs < 0 {
+		add("consumer fetch sizes and max_wait_time_ms can't be negative")
+	}
+	if _, err := newRetryPolicy(c.Consumer.Retry); err != nil {
+		add("consumer retry: %w", err)
+	}
+	if _, err := newDelayBuckets(c.Delay); err != nil {
+		add("delay: %w", err)
+	}
+
+	for i, t := range c.Topics {
+		if t.Name == "" {
+			add("topic %d name is empty", i)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
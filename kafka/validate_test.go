@@ -0,0 +1,61 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigValidateReportAllProblems(t *testing.T) {
+	cfg := &Config{
+		Version:  "not-a-version",
+		SASL:     SASL{Enable: true, Mechanism: "GSSAPI"},
+		Consumer: ConsumerConfig{OffsetInitial: 5, Concurrency: -1},
+		Topics:   []TopicConfig{{Partitions: 3}},
+	}
+
+	err := cfg.Validate()
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+
+	var cerr *ConfigError
+	if !assert.True(t, errors.As(err, &cerr)) {
+		t.FailNow()
+	}
+	// brokers, version, mechanism, user, offset, concurrency and topic name
+	assert.Len(t, cerr.Problems, 7)
+
+	assert.Nil(t, (&Config{Brokers: []string{"localhost:9092"}}).Validate())
+}
+
+func TestNewProducerInvalidConfig(t *testing.T) {
+	p, err := NewProducer(&Config{Brokers: []string{"localhost:9092"}, Version: "x"})
+	assert.Nil(t, p)
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+}
+
+func TestProducerConnectLazily(t *testing.T) {
+	cfg := &Config{Brokers: []string{"127.0.0.1:1"}, ConnectBackoffMs: 10}
+	config, err := newProducerConfig(cfg)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	config.Metadata.Retry.Max = 0
+	config.Net.DialTimeout = 100 * time.Millisecond
+
+	// unreachable brokers don't fail the constructor
+	p := newProducer(cfg, config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	err = p.Publish(ctx, &MessageContext{Topic: "orders", Value: "v"})
+	assert.ErrorIs(t, err, ErrConnection)
+
+	var cerr *ConnectionError
+	if assert.True(t, errors.As(err, &cerr)) {
+		assert.GreaterOrEqual(t, cerr.Attempts, 1)
+	}
+}